@@ -1,3 +1,9 @@
 package temaki
 
 type ctxKey struct{}
+
+// routeKey holds the *matchedRoute of a request
+type routeKey struct{}
+
+// requestIDKey holds the ID of a request
+type requestIDKey struct{}
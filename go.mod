@@ -8,10 +8,13 @@ require (
 	github.com/gorilla/websocket v1.5.3
 	github.com/gyozatech/noodlog v1.0.2
 	github.com/ulule/limiter v2.2.2+incompatible
+	golang.org/x/net v0.43.0
 	golang.org/x/time v0.11.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/stretchr/testify v1.10.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
 )
@@ -0,0 +1,317 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the upper bounds of the histogram buckets suited to latencies in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry shared by the middlewares and the reverse proxy
+var Default = NewRegistry()
+
+type kind string
+
+const (
+	counterKind   kind = "counter"
+	gaugeKind     kind = "gauge"
+	histogramKind kind = "histogram"
+)
+
+// Registry holds metric families and writes them in the Prometheus text format
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// family is a metric with all the series of its label values
+type family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is a metric for a combination of label values
+type series struct {
+	values []string
+	// value is the value of the counters and the gauges, the sum of the histograms
+	value atomicFloat
+	// counts are the counts of the buckets of the histograms, followed by the total count
+	counts []atomic.Uint64
+}
+
+// register returns the family with the given name, creating it if needed. It panics when the family
+// exists with another kind, other labels or other buckets, as the exposition would be invalid.
+func (r *Registry) register(name, help string, k kind, buckets []float64, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.kind != k || !slices.Equal(f.labels, labels) {
+			panic(fmt.Sprintf("metrics: %s already registered as a %s with labels %v", name, f.kind, f.labels))
+		}
+		if !slices.Equal(f.buckets, buckets) {
+			panic(fmt.Sprintf("metrics: %s already registered with buckets %v", name, f.buckets))
+		}
+		return f
+	}
+	f := &family{name: name, help: help, kind: k, labels: labels, buckets: buckets, series: map[string]*series{}}
+	r.families[name] = f
+	return f
+}
+
+// with returns the series of the given label values, creating it if needed
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: slices.Clone(values)}
+		if f.kind == histogramKind {
+			s.counts = make([]atomic.Uint64, len(f.buckets)+1)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct{ f *family }
+
+// Counter is a value which only increases
+type Counter struct{ s *series }
+
+// Counter registers a counter, or returns the one already registered with the same name
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: r.register(name, help, counterKind, nil, labels)}
+}
+
+// With returns the counter of the given label values, in the order of the labels
+func (v *CounterVec) With(values ...string) *Counter {
+	return &Counter{s: v.f.with(values)}
+}
+
+// Inc increments the counter by 1
+func (c *Counter) Inc() {
+	c.s.value.add(1)
+}
+
+// Add increases the counter: negative values are ignored
+func (c *Counter) Add(delta float64) {
+	if delta > 0 {
+		c.s.value.add(delta)
+	}
+}
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct{ f *family }
+
+// Gauge is a value which can go up and down
+type Gauge struct{ s *series }
+
+// Gauge registers a gauge, or returns the one already registered with the same name
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: r.register(name, help, gaugeKind, nil, labels)}
+}
+
+// With returns the gauge of the given label values, in the order of the labels
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return &Gauge{s: v.f.with(values)}
+}
+
+// Set sets the value of the gauge
+func (g *Gauge) Set(value float64) {
+	g.s.value.store(value)
+}
+
+// Add adds delta, which can be negative, to the gauge
+func (g *Gauge) Add(delta float64) {
+	g.s.value.add(delta)
+}
+
+// Inc increments the gauge by 1
+func (g *Gauge) Inc() {
+	g.s.value.add(1)
+}
+
+// Dec decrements the gauge by 1
+func (g *Gauge) Dec() {
+	g.s.value.add(-1)
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct{ f *family }
+
+// Histogram counts the observed values in buckets
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// Histogram registers a histogram with the given bucket upper bounds, DefaultBuckets when nil, or returns
+// the one already registered with the same name
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = slices.Clone(buckets)
+	sort.Float64s(buckets)
+	return &HistogramVec{f: r.register(name, help, histogramKind, buckets, labels)}
+}
+
+// With returns the histogram of the given label values, in the order of the labels
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return &Histogram{s: v.f.with(values), buckets: v.f.buckets}
+}
+
+// Observe adds a value to the histogram
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	h.s.counts[i].Add(1)
+	h.s.value.add(value)
+}
+
+// Handler serves the metrics of the registry in the Prometheus text format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.WriteText(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// WriteText writes the metrics of the registry in the Prometheus text format, sorted by name and labels
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	var b strings.Builder
+	for _, f := range families {
+		f.write(&b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *family) write(b *strings.Builder) {
+	f.mu.Lock()
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	f.mu.Unlock()
+	if len(all) == 0 {
+		return
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return slices.Compare(all[i].values, all[j].values) < 0
+	})
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.kind)
+	for _, s := range all {
+		labels := f.labelPairs(s.values)
+		if f.kind != histogramKind {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, braces(labels), formatFloat(s.value.load()))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i].Load()
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, braces(append(labels, `le="`+formatFloat(bound)+`"`)), cumulative)
+		}
+		cumulative += s.counts[len(f.buckets)].Load()
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, braces(append(labels, `le="+Inf"`)), cumulative)
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, braces(labels), formatFloat(s.value.load()))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, braces(labels), cumulative)
+	}
+}
+
+func (f *family) labelPairs(values []string) []string {
+	pairs := make([]string, len(values), len(values)+1)
+	for i, value := range values {
+		pairs[i] = f.labels[i] + `="` + escapeLabel(value) + `"`
+	}
+	return pairs
+}
+
+func braces(pairs []string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// atomicFloat is a float64 updated atomically
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+func (f *atomicFloat) store(v float64) {
+	f.bits.Store(math.Float64bits(v))
+}
+
+func (f *atomicFloat) add(delta float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	requests := r.Counter("test_requests_total", "Requests served.\nBy route and code.", "route", "code")
+	requests.With("/b", "200").Add(2)
+	requests.With("/a", "500").Inc()
+	requests.With("/a", "200").Inc()
+	requests.With(`say "hi" \ there`+"\n", "200").Inc()
+	requests.With("/a", "200").Add(-5)
+
+	r.Gauge("test_in_flight", `In-flight "requests"`).With().Set(3)
+	temperature := r.Gauge("test_temperature", "Temperature.", "room").With("lab")
+	temperature.Inc()
+	temperature.Add(0.5)
+	temperature.Dec()
+
+	duration := r.Histogram("test_duration_seconds", "Durations.", []float64{1, 0.1, 0.5}, "route")
+	for _, v := range []float64{0.05, 0.1, 0.3, 0.7, 2} {
+		duration.With("/a").Observe(v)
+	}
+	duration.With("/b")
+
+	// a family without series isn't written
+	r.Counter("test_unused_total", "Unused.")
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/a",le="0.1"} 2
+test_duration_seconds_bucket{route="/a",le="0.5"} 3
+test_duration_seconds_bucket{route="/a",le="1"} 4
+test_duration_seconds_bucket{route="/a",le="+Inf"} 5
+test_duration_seconds_sum{route="/a"} 3.15
+test_duration_seconds_count{route="/a"} 5
+test_duration_seconds_bucket{route="/b",le="0.1"} 0
+test_duration_seconds_bucket{route="/b",le="0.5"} 0
+test_duration_seconds_bucket{route="/b",le="1"} 0
+test_duration_seconds_bucket{route="/b",le="+Inf"} 0
+test_duration_seconds_sum{route="/b"} 0
+test_duration_seconds_count{route="/b"} 0
+# HELP test_in_flight In-flight "requests"
+# TYPE test_in_flight gauge
+test_in_flight 3
+# HELP test_requests_total Requests served.\nBy route and code.
+# TYPE test_requests_total counter
+test_requests_total{route="/a",code="200"} 1
+test_requests_total{route="/a",code="500"} 1
+test_requests_total{route="/b",code="200"} 2
+test_requests_total{route="say \"hi\" \\ there\n",code="200"} 1
+# HELP test_temperature Temperature.
+# TYPE test_temperature gauge
+test_temperature{room="lab"} 0.5
+`
+	if got := b.String(); got != want {
+		t.Errorf("WriteText =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test_total", "Test.").With().Inc()
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if want := "# HELP test_total Test.\n# TYPE test_total counter\ntest_total 1\n"; rec.Body.String() != want {
+		t.Errorf("body = %q, want %q", rec.Body.String(), want)
+	}
+}
+
+func TestRegisterAgain(t *testing.T) {
+	r := NewRegistry()
+	counter := r.Counter("test_total", "Test.", "route")
+	if again := r.Counter("test_total", "Test.", "route"); again.f != counter.f {
+		t.Error("registering the same counter again created another family")
+	}
+	histogram := r.Histogram("test_seconds", "Test.", []float64{1, 0.5}, "route")
+	if again := r.Histogram("test_seconds", "Test.", []float64{0.5, 1}, "route"); again.f != histogram.f {
+		t.Error("registering the same histogram again created another family")
+	}
+
+	tests := map[string]func(){
+		"other kind":    func() { r.Gauge("test_total", "Test.", "route") },
+		"other labels":  func() { r.Counter("test_total", "Test.", "code") },
+		"more labels":   func() { r.Counter("test_total", "Test.", "route", "code") },
+		"other buckets": func() { r.Histogram("test_seconds", "Test.", []float64{1, 2}, "route") },
+		"default buckets": func() {
+			r.Histogram("test_seconds", "Test.", nil, "route")
+		},
+		"wrong label values": func() { counter.With("/a", "200") },
+	}
+	for name, register := range tests {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("no panic")
+				}
+			}()
+			register()
+		})
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	r := NewRegistry()
+	counter := r.Counter("test_total", "Test.", "worker")
+	histogram := r.Histogram("test_seconds", "Test.", nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				counter.With("w").Inc()
+				histogram.With().Observe(0.25)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := counter.With("w").s.value.load(); got != 8000 {
+		t.Errorf("counter = %v, want 8000", got)
+	}
+	h := histogram.With()
+	if got := h.s.value.load(); got != 2000 {
+		t.Errorf("histogram sum = %v, want 2000", got)
+	}
+}
@@ -1,6 +1,11 @@
 package middlewares
 
-import "github.com/gyozatech/noodlog"
+import (
+	"net/http"
+
+	"github.com/gyozatech/noodlog"
+	"github.com/gyozatech/temaki"
+)
 
 var (
 	infoLog  infoLogger
@@ -63,3 +68,11 @@ func logError(message ...interface{}) {
 	InitDefaultLogger()
 	errLog.Error(message)
 }
+
+// withRequestID prefixes the message logged for a request with its ID, when it has one
+func withRequestID(r *http.Request, message ...interface{}) []interface{} {
+	if id := temaki.RequestID(r); id != "" {
+		return append([]interface{}{"[" + id + "]"}, message...)
+	}
+	return message
+}
@@ -0,0 +1,135 @@
+package middlewares
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gyozatech/temaki"
+	"github.com/gyozatech/temaki/metrics"
+)
+
+// responseSizeBuckets are the upper bounds in bytes of the buckets of the response sizes
+var responseSizeBuckets = []float64{100, 1000, 10000, 100000, 1000000, 10000000}
+
+// Metrics is the middleware layer recording the metrics of the HTTP requests in metrics.Default
+func Metrics(next http.Handler) http.Handler {
+	return MetricsWithRegistry(metrics.Default)(next)
+}
+
+// MetricsWithRegistry returns a middleware recording the metrics of the HTTP requests in the given registry.
+// The requests are labeled by method, status class like 2xx and pattern of the matched route, like
+// /stores/{storeId}, so that the paths with parameters don't create a series each: the route is
+// empty for the requests matching no route.
+func MetricsWithRegistry(registry *metrics.Registry) func(http.Handler) http.Handler {
+	requests := registry.Counter("temaki_http_requests_total",
+		"HTTP requests handled, by method, status class and route.", "method", "status", "route")
+	duration := registry.Histogram("temaki_http_request_duration_seconds",
+		"Latency of the HTTP requests, by method, status class and route.", nil, "method", "status", "route")
+	sizes := registry.Histogram("temaki_http_response_size_bytes",
+		"Size of the HTTP response bodies, by method, status class and route.", responseSizeBuckets, "method", "status", "route")
+	inFlight := registry.Gauge("temaki_http_requests_in_flight",
+		"HTTP requests being handled, by method.", "method")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			method := metricsMethod(r.Method)
+			inFlight.With(method).Inc()
+			rec := &statusRecorder{ResponseWriter: w}
+			r = temaki.TrackRoute(r)
+
+			defer func() {
+				inFlight.With(method).Dec()
+				status := rec.status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				labels := []string{method, strconv.Itoa(status/100) + "xx", temaki.RoutePattern(r)}
+				requests.With(labels...).Inc()
+				duration.With(labels...).Observe(time.Since(start).Seconds())
+				sizes.With(labels...).Observe(float64(rec.bytes))
+			}()
+
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
+
+// MetricsHandler serves the metrics of metrics.Default in the Prometheus text format, to be routed on /metrics
+func MetricsHandler() http.Handler {
+	return metrics.Default.Handler()
+}
+
+// metricsMethod bounds the methods used as label, as clients can send any method
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// statusRecorder records the status and the size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	// the informational responses precede the final one
+	if rec.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the io.ReaderFrom of the ResponseWriter, like the sendfile of the files served, counting
+// the bytes copied
+func (rec *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := rec.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(writerOnly{rec.ResponseWriter}, src)
+	}
+	rec.bytes += n
+	return n, err
+}
+
+// Flush flushes the response, for the streaming handlers
+func (rec *statusRecorder) Flush() {
+	_ = http.NewResponseController(rec.ResponseWriter).Flush()
+}
+
+// Hijack allows the handlers to take over the connection, like the WebSocket ones
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(rec.ResponseWriter).Hijack()
+	if err == nil && rec.status == 0 {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap allows http.ResponseController to reach the ResponseWriter of the server
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
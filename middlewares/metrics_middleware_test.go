@@ -0,0 +1,51 @@
+package middlewares
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readerFromRecorder is a ResponseWriter with an io.ReaderFrom, like the one of the server
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestStatusRecorderReadFrom(t *testing.T) {
+	w := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rec := &statusRecorder{ResponseWriter: w}
+	var writer io.Writer = rec
+	rf, ok := writer.(io.ReaderFrom)
+	if !ok {
+		t.Fatal("the statusRecorder hides the io.ReaderFrom")
+	}
+	n, err := rf.ReadFrom(strings.NewReader("hello"))
+	if err != nil || n != 5 {
+		t.Fatalf("ReadFrom = %d, %v", n, err)
+	}
+	if !w.readFrom {
+		t.Error("the io.ReaderFrom of the ResponseWriter wasn't used")
+	}
+	rec.Write([]byte(" world"))
+	if rec.bytes != 11 || rec.status != 200 || w.Body.String() != "hello world" {
+		t.Errorf("bytes %d status %d body %q, want 11 200 hello world", rec.bytes, rec.status, w.Body.String())
+	}
+}
+
+func TestStatusRecorderReadFromWithoutReaderFrom(t *testing.T) {
+	w := httptest.NewRecorder()
+	rec := &statusRecorder{ResponseWriter: w}
+	if n, err := rec.ReadFrom(strings.NewReader("hello")); err != nil || n != 5 {
+		t.Fatalf("ReadFrom = %d, %v", n, err)
+	}
+	if rec.bytes != 5 || w.Body.String() != "hello" {
+		t.Errorf("bytes %d body %q, want 5 hello", rec.bytes, w.Body.String())
+	}
+}
@@ -0,0 +1,48 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/gyozatech/temaki"
+)
+
+// RequestIDConfig configures the RequestIDWithConfig middleware
+type RequestIDConfig struct {
+	// Header is the header carrying the ID, temaki.RequestIDHeader when empty
+	Header string
+	// Generator generates the IDs of the requests without a valid one, temaki.NewULID when nil
+	Generator func() string
+}
+
+// RequestID is the middleware layer giving every request an ID, with the default configuration
+func RequestID(next http.Handler) http.Handler {
+	return RequestIDWithConfig(RequestIDConfig{})(next)
+}
+
+// RequestIDWithConfig returns a middleware giving every request an ID: the one of its header when valid,
+// otherwise a new one. The ID and its header are stored in the context of the request, where temaki.RequestID
+// and temaki.RequestIDHeaderOf find them, the ID is set in the header of the request, so that it's forwarded,
+// and echoed in the header of the response. The logs of the middlewares and of the reverse proxy include it:
+// it must wrap them to be seen by them all.
+func RequestIDWithConfig(config RequestIDConfig) func(http.Handler) http.Handler {
+	header := config.Header
+	if header == "" {
+		header = temaki.RequestIDHeader
+	}
+	generate := config.Generator
+	if generate == nil {
+		generate = temaki.NewULID
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(header)
+			if !temaki.ValidRequestID(id) {
+				id = generate()
+				r.Header.Set(header, id)
+			}
+			w.Header().Set(header, id)
+			next.ServeHTTP(w, temaki.SetRequestIDWithHeader(r, id, header))
+		})
+	}
+}
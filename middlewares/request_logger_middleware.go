@@ -5,12 +5,15 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"runtime/debug"
 	"strings"
 	"time"
+
+	"github.com/gyozatech/temaki"
 )
 
 // RequestLoggerMiddleware is the middleware layer to log all the HTTP requests
@@ -23,14 +26,15 @@ func RequestLoggerMiddleware(next http.Handler) http.Handler {
 
 			defer func() {
 				if rec := recover(); rec != nil {
-					logError("Panic recovered in the RequestLoggerMiddleware: ", string(debug.Stack()))
+					logError(withRequestID(r, "Panic recovered in the RequestLoggerMiddleware: ", string(debug.Stack()))...)
 				}
 			}()
 
 			logInfo(ReqRespLogStruct{
-				Request:  HTTPRequest(r),
-				ExecTime: time.Since(start),
-				Response: HTTPResponse(*rww.statusCode, rww.Header(), rww.r.RequestURI, rww.body.String()),
+				RequestID: temaki.RequestID(r),
+				Request:   HTTPRequest(r),
+				ExecTime:  time.Since(start),
+				Response:  HTTPResponse(*rww.statusCode, rww.Header(), rww.r.RequestURI, rww.body.String()),
 			})
 
 		}()
@@ -40,6 +44,10 @@ func RequestLoggerMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// maxLoggedBody is the maximum size of the response body kept for the log: streamed responses, like
+// Server-Sent Events, aren't kept at all
+const maxLoggedBody = 64 << 10
+
 // ResponseWriterWrapper struct is used to log the response
 type ResponseWriterWrapper struct {
 	r          *http.Request
@@ -61,10 +69,49 @@ func NewResponseWriterWrapper(w *http.ResponseWriter, r *http.Request) ResponseW
 }
 
 func (rww ResponseWriterWrapper) Write(buf []byte) (int, error) {
-	rww.body.Write(buf)
+	rww.capture(buf)
 	return (*rww.w).Write(buf)
 }
 
+// capture keeps the beginning of the response body for the log
+func (rww ResponseWriterWrapper) capture(buf []byte) {
+	if strings.HasPrefix(rww.Header().Get("Content-Type"), "text/event-stream") {
+		return
+	}
+	if room := maxLoggedBody - rww.body.Len(); room > 0 {
+		if len(buf) > room {
+			buf = buf[:room]
+		}
+		rww.body.Write(buf)
+	}
+}
+
+// ReadFrom allows the ResponseWriterWrapper to implement the io.ReaderFrom interface of the underlying
+// http.ResponseWriter, capturing the beginning of the body for the log
+func (rww ResponseWriterWrapper) ReadFrom(src io.Reader) (int64, error) {
+	src = io.TeeReader(src, captureWriter{rww})
+	if rf, ok := (*rww.w).(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{*rww.w}, src)
+}
+
+// Flush allows the ResponseWriterWrapper to implement the http.Flusher interface necessary to stream the response
+func (rww ResponseWriterWrapper) Flush() {
+	_ = rww.FlushError()
+}
+
+// FlushError flushes the response, returning the error of the underlying http.ResponseWriter: it's used by
+// http.ResponseController
+func (rww ResponseWriterWrapper) FlushError() error {
+	return http.NewResponseController(*rww.w).Flush()
+}
+
+// Unwrap returns the underlying http.ResponseWriter, allowing http.ResponseController to reach its features
+func (rww ResponseWriterWrapper) Unwrap() http.ResponseWriter {
+	return *rww.w
+}
+
 // Header function overwrites the http.ResponseWriter Header() function
 func (rww ResponseWriterWrapper) Header() http.Header {
 	return (*rww.w).Header()
@@ -85,13 +132,29 @@ func (rww ResponseWriterWrapper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return h.Hijack()
 }
 
+// writerOnly hides the io.ReaderFrom of the http.ResponseWriter, so that io.Copy reads the TeeReader
+type writerOnly struct {
+	io.Writer
+}
+
+// captureWriter passes the bytes copied by ReadFrom to the captured response body
+type captureWriter struct {
+	rww ResponseWriterWrapper
+}
+
+func (cw captureWriter) Write(buf []byte) (int, error) {
+	cw.rww.capture(buf)
+	return len(buf), nil
+}
+
 /////////////////////////////////////////////////////////////////////////////////////////////
 
 // ReqRespLogStruct struct represents the schema for the HTTP Request/ExecutionTime/Response log
 type ReqRespLogStruct struct {
-	Request  RequestStruct
-	ExecTime time.Duration
-	Response ResponseStruct
+	RequestID string `json:"RequestID,omitempty"`
+	Request   RequestStruct
+	ExecTime  time.Duration
+	Response  ResponseStruct
 }
 
 // RequestStruct struct represents the schema for the HTTP Request log
@@ -118,7 +181,7 @@ func HTTPRequest(r *http.Request) RequestStruct {
 
 	requestDump, err := httputil.DumpRequest(r, true)
 	if err != nil {
-		logInfo(err)
+		logInfo(withRequestID(r, err)...)
 	}
 
 	var req RequestStruct
@@ -0,0 +1,61 @@
+package middlewares
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gyozatech/temaki"
+	"github.com/gyozatech/temaki/tracing"
+)
+
+// Tracing returns a middleware starting a server span for every request with the given tracer, child of
+// the span of the W3C traceparent header if any. The span is named after the method and the pattern of the
+// matched route, like GET /stores/{storeId}, and ends with StatusError for the 5xx responses and the panics.
+// The handlers find the span in the context of the request with tracing.SpanFromContext.
+func Tracing(tracer *tracing.Tracer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			if sc, ok := tracing.Extract(r.Header); ok {
+				ctx = tracing.ContextWithRemoteSpanContext(ctx, sc)
+			}
+			ctx, span := tracer.Start(ctx, r.Method, tracing.SpanKindServer)
+			span.SetAttribute("http.request.method", r.Method)
+			span.SetAttribute("url.path", r.URL.Path)
+			span.SetAttribute("server.address", r.Host)
+			span.SetAttribute("client.address", GetClientIP(r))
+			if ua := r.UserAgent(); ua != "" {
+				span.SetAttribute("user_agent.original", ua)
+			}
+			rec := &statusRecorder{ResponseWriter: w}
+			r = temaki.TrackRoute(r.WithContext(ctx))
+
+			defer func() {
+				if route := temaki.RoutePattern(r); route != "" {
+					span.SetName(r.Method + " " + route)
+					span.SetAttribute("http.route", route)
+				}
+				status := rec.status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				if p := recover(); p != nil {
+					if p != http.ErrAbortHandler {
+						span.RecordError(fmt.Errorf("panic: %v", p))
+						status = http.StatusInternalServerError
+					}
+					span.SetAttribute("http.response.status_code", status)
+					span.End()
+					panic(p)
+				}
+				span.SetAttribute("http.response.status_code", status)
+				if status >= http.StatusInternalServerError {
+					span.SetStatus(tracing.StatusError, http.StatusText(status))
+				}
+				span.End()
+			}()
+
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package temaki
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// RequestIDHeader is the header carrying the ID of a request, unless the RequestID middleware is configured
+// with another one
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the maximum length of the IDs given by the clients
+const maxRequestIDLength = 128
+
+// requestID is the ID of a request with the header carrying it
+type requestID struct {
+	id     string
+	header string
+}
+
+// RequestID returns the ID of the request, as set by the RequestID middleware or the reverse proxy, or an empty
+// string when the request has none
+func RequestID(r *http.Request) string {
+	rid, _ := r.Context().Value(requestIDKey{}).(requestID)
+	return rid.id
+}
+
+// RequestIDHeaderOf returns the header carrying the ID of the request, as configured in the RequestID
+// middleware, RequestIDHeader otherwise
+func RequestIDHeaderOf(r *http.Request) string {
+	if rid, ok := r.Context().Value(requestIDKey{}).(requestID); ok && rid.header != "" {
+		return rid.header
+	}
+	return RequestIDHeader
+}
+
+// SetRequestID returns the request with the given ID, carried by the header of the ID the request already has
+// or by RequestIDHeader
+func SetRequestID(r *http.Request, id string) *http.Request {
+	return SetRequestIDWithHeader(r, id, RequestIDHeaderOf(r))
+}
+
+// SetRequestIDWithHeader returns the request with the given ID, carried by the given header
+func SetRequestIDWithHeader(r *http.Request, id, header string) *http.Request {
+	return enrichRequestContext(r, requestIDKey{}, requestID{id: id, header: header})
+}
+
+// ValidRequestID tells if an ID given by a client can be kept: it's printed in the logs, so only visible
+// ASCII characters are accepted
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// crockford is the Base32 alphabet of the ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewULID generates a ULID, a 26 characters ID sorted by creation time: its first 48 bits are the Unix
+// time in milliseconds, the other 80 bits are random. It's the generator of the request IDs by default.
+func NewULID() string {
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], uint64(time.Now().UnixMilli())<<16)
+	_, _ = rand.Read(id[6:])
+	return encodeULID(id)
+}
+
+// encodeULID encodes the 128 bits of a ULID 5 at a time from the end, the first character taking the 3
+// remaining ones
+func encodeULID(id [16]byte) string {
+	hi, lo := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// NewUUID generates a random UUID (version 4), like 0b9cf6a5-8a8c-4c5e-9b43-2d0e0f6f1a3c
+func NewUUID() string {
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+
+	var out [36]byte
+	hex.Encode(out[0:8], id[0:4])
+	out[8] = '-'
+	hex.Encode(out[9:13], id[4:6])
+	out[13] = '-'
+	hex.Encode(out[14:18], id[6:8])
+	out[18] = '-'
+	hex.Encode(out[19:23], id[8:10])
+	out[23] = '-'
+	hex.Encode(out[24:], id[10:])
+	return string(out[:])
+}
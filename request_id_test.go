@@ -0,0 +1,87 @@
+package temaki
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeULID(t *testing.T) {
+	tests := []struct {
+		id   [16]byte
+		want string
+	}{
+		{id: [16]byte{}, want: "00000000000000000000000000"},
+		{id: [16]byte{15: 1}, want: "00000000000000000000000001"},
+		{id: [16]byte{15: 32}, want: "00000000000000000000000010"},
+		{id: [16]byte{0: 0x80}, want: "40000000000000000000000000"},
+		{id: [16]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			want: "7ZZZZZZZZZZZZZZZZZZZZZZZZZ"},
+		// the example of the ULID specification
+		{id: [16]byte{0x01, 0x56, 0x3d, 0xf3, 0x64, 0xb2, 0x01, 0x80, 0x18, 0x40, 0xb6, 0x28, 0x6b, 0xf5, 0x4e, 0xd0},
+			want: "01ARYZ6S5J0601GG5P51NZAKPG"},
+	}
+	for _, tt := range tests {
+		if got := encodeULID(tt.id); got != tt.want {
+			t.Errorf("encodeULID(%x) = %s, want %s", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestNewULID(t *testing.T) {
+	before := time.Now().UnixMilli()
+	id := NewULID()
+	if !regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`).MatchString(id) {
+		t.Fatalf("%q isn't a ULID", id)
+	}
+	// the first 10 characters encode the time in milliseconds
+	var ms int64
+	for _, c := range id[:10] {
+		ms = ms<<5 | int64(strings.IndexRune(crockford, c))
+	}
+	if ms < before || ms > time.Now().UnixMilli() {
+		t.Errorf("time of %s = %d, want the current time", id, ms)
+	}
+	if NewULID() == id {
+		t.Error("two ULIDs are equal")
+	}
+}
+
+func TestNewUUID(t *testing.T) {
+	id := NewUUID()
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Errorf("%q isn't a version 4 UUID", id)
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"01ARYZ6S5J0601GG5P51NZAKPG": true,
+		"client-id_1.2~":             true,
+		"":                           false,
+		"with space":                 false,
+		"line\nbreak":                false,
+		"café":                       false,
+		strings.Repeat("a", 128):     true,
+		strings.Repeat("a", 129):     false,
+	} {
+		if got := ValidRequestID(id); got != want {
+			t.Errorf("ValidRequestID(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	if RequestID(r) != "" || RequestIDHeaderOf(r) != RequestIDHeader {
+		t.Fatalf("got %q in %q without an ID", RequestID(r), RequestIDHeaderOf(r))
+	}
+	r = SetRequestIDWithHeader(r, "abc", "X-Correlation-ID")
+	// a new ID keeps the header of the previous one
+	r = SetRequestID(r, "def")
+	if RequestID(r) != "def" || RequestIDHeaderOf(r) != "X-Correlation-ID" {
+		t.Errorf("got %q in %q, want def in X-Correlation-ID", RequestID(r), RequestIDHeaderOf(r))
+	}
+}
@@ -0,0 +1,229 @@
+package reverseproxy
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gyozatech/temaki"
+	"github.com/gyozatech/temaki/metrics"
+)
+
+// AccessLog is the access log entry of a request handled by the proxy
+type AccessLog struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Host   string    `json:"host"`
+	Path   string    `json:"path"`
+	// Route is the name of the route matching the request, empty when none matches
+	Route string `json:"route,omitempty"`
+	// Target is the target of the last attempt, empty when no target was contacted
+	Target TargetHost `json:"target,omitempty"`
+	// Status is the status answered to the client, UpstreamStatus the one of the last attempt
+	Status         int `json:"status"`
+	UpstreamStatus int `json:"upstreamStatus,omitempty"`
+	// Latency is the total time spent on the request, UpstreamLatency the time spent by the targets
+	// to answer with the response headers, in all the attempts
+	Latency         Duration `json:"latency"`
+	UpstreamLatency Duration `json:"upstreamLatency,omitempty"`
+	// BytesIn and BytesOut are the sizes of the request body read and of the response body written
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+	Retries  int   `json:"retries"`
+	// Cache is the X-Cache status of a route with a cache, like HIT or MISS
+	Cache string `json:"cache,omitempty"`
+	// Error is the kind of the error when the proxy failed the request
+	Error ErrorKind `json:"error,omitempty"`
+	// RequestID is the ID of the request, as returned by temaki.RequestID
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// AccessLogger receives the access log entry of every HTTP request, once answered: the WebSocket and
+// the tunneled connections report their own stats
+type AccessLogger func(entry AccessLog)
+
+// JSONAccessLogger is the default AccessLogger, logging each entry as a JSON object
+func JSONAccessLogger(entry AccessLog) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding access log: %v", err)
+		return
+	}
+	log.Printf("Access %s", data)
+}
+
+// WithAccessLogger replaces the default access logger: nil disables the access logs
+func (rp *ReverseProxy) WithAccessLogger(logger AccessLogger) *ReverseProxy {
+	rp.accessLogger = logger
+	return rp
+}
+
+// WithMetrics records the metrics of the proxy in the given registry instead of metrics.Default
+func (rp *ReverseProxy) WithMetrics(registry *metrics.Registry) *ReverseProxy {
+	rp.metrics.Store(newProxyMetrics(registry))
+	return rp
+}
+
+// proxyMetrics are the metrics of the requests per route, and of the attempts per route and target
+type proxyMetrics struct {
+	registry         *metrics.Registry
+	requests         *metrics.CounterVec
+	duration         *metrics.HistogramVec
+	bytesIn          *metrics.CounterVec
+	bytesOut         *metrics.CounterVec
+	retries          *metrics.CounterVec
+	cache            *metrics.CounterVec
+	upstreamRequests *metrics.CounterVec
+	upstreamDuration *metrics.HistogramVec
+}
+
+func newProxyMetrics(registry *metrics.Registry) *proxyMetrics {
+	return &proxyMetrics{
+		registry: registry,
+		requests: registry.Counter("temaki_proxy_requests_total",
+			"Requests handled by the proxy, by route and status code.", "route", "code"),
+		duration: registry.Histogram("temaki_proxy_request_duration_seconds",
+			"Total latency of the requests handled by the proxy, by route.", nil, "route"),
+		bytesIn: registry.Counter("temaki_proxy_request_bytes_total",
+			"Bytes of the request bodies read by the proxy, by route.", "route"),
+		bytesOut: registry.Counter("temaki_proxy_response_bytes_total",
+			"Bytes of the response bodies written by the proxy, by route.", "route"),
+		retries: registry.Counter("temaki_proxy_retries_total",
+			"Attempts retried on another target, by route.", "route"),
+		cache: registry.Counter("temaki_proxy_cache_requests_total",
+			"Requests of the routes with a cache, by route and cache status.", "route", "status"),
+		upstreamRequests: registry.Counter("temaki_proxy_upstream_requests_total",
+			"Attempts sent to the targets, by route, target and status code (error when no response).", "route", "target", "code"),
+		upstreamDuration: registry.Histogram("temaki_proxy_upstream_duration_seconds",
+			"Time taken by the targets to answer with the response headers, by route and target.", nil, "route", "target"),
+	}
+}
+
+// observeAttempt records an attempt sent to a target
+func (m *proxyMetrics) observeAttempt(route *route, t *target, resp *http.Response, latency time.Duration) {
+	code := "error"
+	if resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	m.upstreamRequests.With(route.name(), string(t.host), code).Inc()
+	m.upstreamDuration.With(route.name(), string(t.host)).Observe(latency.Seconds())
+}
+
+// observe records a request once answered
+func (m *proxyMetrics) observe(entry AccessLog) {
+	route := entry.Route
+	m.requests.With(route, strconv.Itoa(entry.Status)).Inc()
+	m.duration.With(route).Observe(time.Duration(entry.Latency).Seconds())
+	m.bytesIn.With(route).Add(float64(entry.BytesIn))
+	m.bytesOut.With(route).Add(float64(entry.BytesOut))
+	m.retries.With(route).Add(float64(entry.Retries))
+	if entry.Cache != "" {
+		m.cache.With(route, entry.Cache).Inc()
+	}
+}
+
+// MetricsHandler serves the metrics of the registry of the proxy in the Prometheus text format
+func (rp *ReverseProxy) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rp.metrics.Load().registry.Handler().ServeHTTP(w, req)
+	})
+}
+
+// recordAttempt records the outcome of an attempt of the request for its access log
+func (pr *proxyRequest) recordAttempt(t *target, resp *http.Response, latency time.Duration) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if pr.target != "" {
+		pr.retries++
+	}
+	pr.target = t.host
+	pr.upstreamStatus = 0
+	if resp != nil {
+		pr.upstreamStatus = resp.StatusCode
+	}
+	pr.upstreamLatency += latency
+}
+
+// logAccess logs and records in the metrics a request once answered
+func (rp *ReverseProxy) logAccess(req *http.Request, route *route, w *accessWriter, body *countingBody, start time.Time) {
+	entry := AccessLog{
+		Time:      start,
+		Method:    req.Method,
+		Host:      req.Host,
+		Path:      req.URL.Path,
+		Status:    w.status,
+		Latency:   Duration(time.Since(start)),
+		BytesOut:  w.bytes,
+		RequestID: temaki.RequestID(req),
+	}
+	if route != nil {
+		entry.Route = route.name()
+	}
+	if body != nil {
+		entry.BytesIn = body.n.Load()
+	}
+	if pr := proxyRequestFrom(req); pr != nil {
+		pr.mu.Lock()
+		entry.Target, entry.UpstreamStatus = pr.target, pr.upstreamStatus
+		entry.UpstreamLatency, entry.Retries = Duration(pr.upstreamLatency), pr.retries
+		entry.Cache, entry.Error = pr.cache, pr.errorKind
+		pr.mu.Unlock()
+	}
+	if entry.Status == 0 {
+		// nothing was written: the requests canceled by their clients aren't answered
+		entry.Status = http.StatusOK
+		if entry.Error == ErrorKindClientClosed {
+			entry.Status = StatusClientClosedRequest
+		}
+	}
+
+	rp.metrics.Load().observe(entry)
+	if rp.accessLogger != nil {
+		rp.accessLogger(entry)
+	}
+}
+
+// accessWriter records the status and the size of a response
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessWriter) WriteHeader(code int) {
+	// the informational responses, like 103 Early Hints, precede the final one
+	if w.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to flush the response
+func (w *accessWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingBody counts the bytes read from a request body, which the transport can read in its own goroutine
+type countingBody struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
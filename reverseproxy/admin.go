@@ -0,0 +1,231 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gyozatech/temaki"
+)
+
+// AdminConfig configures the admin API, which must be protected by a bearer token, by mTLS or by both
+type AdminConfig struct {
+	// Token is the bearer token expected in the Authorization header of every admin request
+	Token string
+	// CertFile and KeyFile are the certificate of the admin listener: when set, the admin API is served on HTTPS
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is a PEM file with the certificate authorities of the admin clients: when set, the clients
+	// must present a certificate signed by one of them (mTLS)
+	ClientCAFile string
+}
+
+type adminRouteRequest struct {
+	Host VirtualHost `json:"host,omitempty"`
+	RouteSpec
+}
+
+type adminTargetRequest struct {
+	Target TargetHost `json:"target"`
+	Weight *int64     `json:"weight,omitempty"`
+}
+
+// AdminHandler returns the handler of the admin API, which allows inspecting and changing the routing at runtime:
+//
+//	GET    /routes                                           lists the routes with the state and stats of their targets
+//	POST   /routes                                           adds a route, with a body like {"host": "", "prefix": "/api/", "targets": ["http://api:8080"]}
+//	DELETE /routes?host=&prefix=                             removes a route
+//	POST   /routes/enable?host=&prefix=                      enables a route
+//	POST   /routes/disable?host=&prefix=                     disables a route, which answers 503
+//	POST   /targets?host=&prefix=                            adds a target, with a body like {"target": "http://api2:8080", "weight": 1}
+//	DELETE /targets?host=&prefix=&target=                    removes a target
+//	POST   /targets/enable?host=&prefix=&target=             enables a target
+//	POST   /targets/disable?host=&prefix=&target=            disables (drains) a target
+//	PUT    /targets/weight?host=&prefix=&target=&weight=     changes the weight of a target
+//	PUT    /canary/weight?host=&prefix=&weight=              changes the percentage of requests sent to the canary targets
+//	DELETE /cache?host=&prefix=                              purges the cached responses whose path starts with prefix
+//	GET    /metrics                                          exposes the metrics of the proxy in the Prometheus text format
+//
+// The host parameter is empty for the routes served for any host. When a token is given, every request
+// must carry it as bearer token. With an empty token the handler relies on mTLS instead: it answers 401 to
+// every request not made over TLS with a verified client certificate, so it is never served unauthenticated.
+func (rp *ReverseProxy) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /routes", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, rp.Status())
+	})
+	mux.HandleFunc("POST /routes", func(w http.ResponseWriter, r *http.Request) {
+		var req adminRouteRequest
+		if err := decodeAdminBody(r, &req); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeAdminResult(w, http.StatusCreated, rp.AddRoute(req.Host, req.RouteSpec))
+	})
+	mux.HandleFunc("DELETE /routes", func(w http.ResponseWriter, r *http.Request) {
+		host, prefix := routeParams(r)
+		writeAdminResult(w, http.StatusNoContent, rp.RemoveRoute(host, prefix))
+	})
+	mux.HandleFunc("POST /routes/enable", func(w http.ResponseWriter, r *http.Request) {
+		host, prefix := routeParams(r)
+		writeAdminResult(w, http.StatusNoContent, rp.SetRouteEnabled(host, prefix, true))
+	})
+	mux.HandleFunc("POST /routes/disable", func(w http.ResponseWriter, r *http.Request) {
+		host, prefix := routeParams(r)
+		writeAdminResult(w, http.StatusNoContent, rp.SetRouteEnabled(host, prefix, false))
+	})
+
+	mux.HandleFunc("POST /targets", func(w http.ResponseWriter, r *http.Request) {
+		host, prefix := routeParams(r)
+		var req adminTargetRequest
+		if err := decodeAdminBody(r, &req); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		weight := int64(1)
+		if req.Weight != nil {
+			weight = *req.Weight
+		}
+		writeAdminResult(w, http.StatusCreated, rp.AddTarget(host, prefix, req.Target, weight))
+	})
+	mux.HandleFunc("DELETE /targets", func(w http.ResponseWriter, r *http.Request) {
+		host, prefix := routeParams(r)
+		writeAdminResult(w, http.StatusNoContent, rp.RemoveTarget(host, prefix, TargetHost(r.URL.Query().Get("target"))))
+	})
+	mux.HandleFunc("POST /targets/enable", func(w http.ResponseWriter, r *http.Request) {
+		host, prefix := routeParams(r)
+		writeAdminResult(w, http.StatusNoContent, rp.SetTargetEnabled(host, prefix, TargetHost(r.URL.Query().Get("target")), true))
+	})
+	mux.HandleFunc("POST /targets/disable", func(w http.ResponseWriter, r *http.Request) {
+		host, prefix := routeParams(r)
+		writeAdminResult(w, http.StatusNoContent, rp.SetTargetEnabled(host, prefix, TargetHost(r.URL.Query().Get("target")), false))
+	})
+	mux.HandleFunc("PUT /targets/weight", func(w http.ResponseWriter, r *http.Request) {
+		host, prefix := routeParams(r)
+		weight, err := strconv.ParseInt(r.URL.Query().Get("weight"), 10, 64)
+		if err != nil {
+			writeAdminError(w, fmt.Errorf("invalid weight: %w", err))
+			return
+		}
+		writeAdminResult(w, http.StatusNoContent, rp.SetTargetWeight(host, prefix, TargetHost(r.URL.Query().Get("target")), weight))
+	})
+	mux.HandleFunc("PUT /canary/weight", func(w http.ResponseWriter, r *http.Request) {
+		host, prefix := routeParams(r)
+		weight, err := strconv.ParseFloat(r.URL.Query().Get("weight"), 64)
+		if err != nil {
+			writeAdminError(w, fmt.Errorf("invalid weight: %w", err))
+			return
+		}
+		writeAdminResult(w, http.StatusNoContent, rp.SetCanaryWeight(host, prefix, weight))
+	})
+	mux.HandleFunc("DELETE /cache", func(w http.ResponseWriter, r *http.Request) {
+		host, prefix := routeParams(r)
+		writeAdminJSON(w, http.StatusOK, map[string]int{"purged": rp.PurgeCache(host, string(prefix))})
+	})
+	mux.Handle("GET /metrics", rp.MetricsHandler())
+
+	if token == "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+				writeAdminJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+			mux.ServeHTTP(w, r)
+		})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided, err := temaki.GetBearerToken(r)
+		if err != nil || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// StartAdmin starts the admin API on its own port, separate from the one of the proxied traffic
+func (rp *ReverseProxy) StartAdmin(port int, cfg AdminConfig) error {
+	if cfg.Token == "" && cfg.ClientCAFile == "" {
+		return errors.New("the admin API must be protected by a token or by mTLS")
+	}
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: rp.AdminHandler(cfg.Token),
+	}
+	if cfg.CertFile == "" && cfg.KeyFile == "" {
+		if cfg.ClientCAFile != "" {
+			return errors.New("mTLS on the admin API requires CertFile and KeyFile")
+		}
+		log.Printf("Starting reverse proxy admin API on port %d", port)
+		return server.ListenAndServe()
+	}
+
+	server.TLSConfig = &tls.Config{}
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("error reading admin client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no valid certificate found in admin client CA file %s", cfg.ClientCAFile)
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	log.Printf("Starting reverse proxy admin API with TLS on port %d", port)
+	return server.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
+}
+
+func routeParams(r *http.Request) (VirtualHost, PathPrefix) {
+	return VirtualHost(r.URL.Query().Get("host")), PathPrefix(r.URL.Query().Get("prefix"))
+}
+
+func decodeAdminBody(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+func writeAdminResult(w http.ResponseWriter, status int, err error) {
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, ErrRouteNotFound), errors.Is(err, ErrTargetNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrAlreadyExists):
+		status = http.StatusConflict
+	}
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
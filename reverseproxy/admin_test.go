@@ -0,0 +1,67 @@
+package reverseproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminHandlerAuth(t *testing.T) {
+	rp := New(PathPrefixRoutesMap{"/api/": "http://api"}).WithAccessLogger(nil)
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+
+	tests := []struct {
+		name  string
+		token string
+		auth  string
+		tls   *tls.ConnectionState
+		want  int
+	}{
+		{name: "token", token: "secret", auth: "Bearer secret", want: http.StatusOK},
+		{name: "wrong token", token: "secret", auth: "Bearer guess", want: http.StatusUnauthorized},
+		{name: "missing token", token: "secret", want: http.StatusUnauthorized},
+		{name: "no token without TLS", want: http.StatusUnauthorized},
+		{name: "no token without client certificate", tls: &tls.ConnectionState{}, want: http.StatusUnauthorized},
+		{name: "no token with client certificate", tls: verified, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/routes", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			req.TLS = tt.tls
+			rec := httptest.NewRecorder()
+			rp.AdminHandler(tt.token).ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetTargetCanary(t *testing.T) {
+	rp := New(PathPrefixRoutesMap{"/api/": "http://stable"}).
+		WithRouteConfig("/api/", RouteConfig{Canary: &CanaryConfig{Targets: []TargetHost{"http://canary"}, Weight: 10}}).
+		WithAccessLogger(nil)
+	if rp.configErr != nil {
+		t.Fatal(rp.configErr)
+	}
+
+	if err := rp.SetTargetEnabled("", "/api/", "http://canary", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := rp.SetTargetWeight("", "/api/", "http://canary", 3); err != nil {
+		t.Fatal(err)
+	}
+	_, r, _ := findRoute(rp.table.Load(), "", "/api/")
+	canary := r.canaryPool.find("http://canary")
+	if !canary.disabled.Load() || canary.weight.Load() != 3 {
+		t.Errorf("canary target disabled %v weight %d, want true 3", canary.disabled.Load(), canary.weight.Load())
+	}
+	if err := rp.SetTargetEnabled("", "/api/", "http://unknown", false); err == nil {
+		t.Error("an unknown target was found")
+	}
+}
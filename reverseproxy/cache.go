@@ -0,0 +1,566 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gyozatech/temaki"
+)
+
+const (
+	// defaultCacheSize is the size of the in-memory store used when no store is configured
+	defaultCacheSize = 64 << 20
+	// defaultMaxCacheEntry is the default size limit of a cached body
+	defaultMaxCacheEntry = 1 << 20
+	// maxHeuristicFreshness caps the freshness lifetime computed from Last-Modified
+	maxHeuristicFreshness = 24 * time.Hour
+)
+
+// CacheConfig enables the caching of the responses of a route, following RFC 9111 for a shared cache
+type CacheConfig struct {
+	// DefaultTTL is the freshness lifetime of the responses without an explicit expiration time:
+	// when 0 it's 10% of the time since their Last-Modified date, as suggested by RFC 9111
+	DefaultTTL time.Duration
+	// MaxEntrySize is the maximum size of a cached body (1MB when 0)
+	MaxEntrySize int64
+	// Store is the store of the route: when nil the store of the reverse proxy is used
+	Store CacheStore
+}
+
+func (c *CacheConfig) maxEntrySize() int64 {
+	if c.MaxEntrySize <= 0 {
+		return defaultMaxCacheEntry
+	}
+	return c.MaxEntrySize
+}
+
+// heuristicallyCacheable are the statuses which can be cached without an explicit expiration time
+var heuristicallyCacheable = map[int]bool{
+	http.StatusOK: true, http.StatusNonAuthoritativeInfo: true, http.StatusNoContent: true,
+	http.StatusMultipleChoices: true, http.StatusMovedPermanently: true, http.StatusPermanentRedirect: true,
+	http.StatusNotFound: true, http.StatusMethodNotAllowed: true, http.StatusGone: true,
+	http.StatusRequestURITooLong: true, http.StatusNotImplemented: true,
+}
+
+// responseCache is a store with the fetches in progress, used to coalesce identical concurrent misses
+type responseCache struct {
+	store CacheStore
+	// spec is the configuration file definition of the store, if created from one
+	spec    *CacheStoreSpec
+	mu      sync.Mutex
+	flights map[string]chan struct{}
+}
+
+func newResponseCache(store CacheStore) *responseCache {
+	return &responseCache{store: store, flights: map[string]chan struct{}{}}
+}
+
+// WithCacheStore sets the store of the responses of the routes with caching enabled,
+// which is an in-memory store of 64MB by default
+func (rp *ReverseProxy) WithCacheStore(store CacheStore) *ReverseProxy {
+	rp.cache.Store(newResponseCache(store))
+	return rp
+}
+
+// PurgeCache removes the cached responses of the given host (any host when empty) whose path starts
+// with pathPrefix, returning their number
+func (rp *ReverseProxy) PurgeCache(host VirtualHost, pathPrefix string) int {
+	host = VirtualHost(strings.ToLower(string(host)))
+	match := func(key string) bool {
+		primary, _, _ := strings.Cut(key, "\x00")
+		keyHost, uri, _ := strings.Cut(primary, "/")
+		return (host == "" || VirtualHost(keyHost) == host) && strings.HasPrefix("/"+uri, pathPrefix)
+	}
+	stores := []CacheStore{rp.cache.Load().store}
+	for _, r := range rp.table.Load().routes() {
+		if r.cache != nil && !slices.Contains(stores, r.cache.store) {
+			stores = append(stores, r.cache.store)
+		}
+	}
+	purged := 0
+	for _, store := range stores {
+		purged += store.Purge(match)
+	}
+	log.Printf("Purged %d cached responses of %s%s", purged, host, pathPrefix)
+	return purged
+}
+
+// join registers a fetch of the given key: the first caller is the leader, which must call leave when
+// the fetch completes, while the others get a channel closed at that time
+func (c *responseCache) join(key string) (wait <-chan struct{}, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch, found := c.flights[key]; found {
+		return ch, false
+	}
+	c.flights[key] = make(chan struct{})
+	return nil, true
+}
+
+func (c *responseCache) leave(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch, found := c.flights[key]; found {
+		close(ch)
+		delete(c.flights, key)
+	}
+}
+
+// lookup returns the entry matching the request, following the Vary headers of the stored response
+func (c *responseCache) lookup(key string, req *http.Request) *CacheEntry {
+	entry, found := c.store.Get(key)
+	if !found {
+		return nil
+	}
+	if entry.StatusCode == 0 {
+		// the response varies: the entry only lists the headers it depends on
+		if entry, found = c.store.Get(key + varyKey(req, entry.Vary)); !found {
+			return nil
+		}
+	}
+	return entry
+}
+
+// put stores an entry: a response with Vary headers is stored with the request values of those headers
+func (c *responseCache) put(key string, req *http.Request, entry *CacheEntry) {
+	if len(entry.Vary) == 0 {
+		c.store.Set(key, entry)
+		return
+	}
+	c.store.Set(key, &CacheEntry{Vary: entry.Vary})
+	c.store.Set(key+varyKey(req, entry.Vary), entry)
+}
+
+// invalidate removes all the stored responses of a URI, including its canary variant and the responses
+// varying on the request headers, whose keys start with the one of the URI
+func (c *responseCache) invalidate(uri string) {
+	c.store.Purge(func(key string) bool {
+		primary, _, _ := strings.Cut(key, "\x00")
+		return primary == uri
+	})
+}
+
+// isSafe tells if a request method is safe, so that it doesn't change the resources (RFC 9110, section 9.2.1)
+func isSafe(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// cacheKey identifies the responses of a request by the host and the URI asked by the client
+func cacheKey(inbound *http.Request) string {
+	host := inbound.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host) + inbound.URL.RequestURI()
+}
+
+func varyKey(req *http.Request, vary []string) string {
+	var key strings.Builder
+	for _, name := range vary {
+		key.WriteString("\x00" + name + "=" + strings.Join(req.Header.Values(name), ","))
+	}
+	return key.String()
+}
+
+// cachingTransport serves the requests of a route from the cache, sending them to the next transport on
+// misses and when the stored responses must be revalidated
+type cachingTransport struct {
+	rp    *ReverseProxy
+	route *route
+	next  http.RoundTripper
+}
+
+func (ct *cachingTransport) cache() *responseCache {
+	if ct.route.cache != nil {
+		return ct.route.cache
+	}
+	return ct.rp.cache.Load()
+}
+
+func (ct *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pr := proxyRequestFrom(req)
+	if pr == nil || pr.response != nil {
+		return ct.next.RoundTrip(req)
+	}
+	cache := ct.cache()
+	uri := cacheKey(pr.inbound)
+	key := uri
+	if pr.canary {
+		key += "\x00" + VariantCanary
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp, err := ct.next.RoundTrip(req)
+		if err == nil && resp.StatusCode < http.StatusBadRequest && !isSafe(req.Method) {
+			// an unsafe request invalidates the stored responses of its URI (RFC 9111, section 4.4)
+			cache.invalidate(uri)
+		}
+		return resp, err
+	}
+	reqCC := parseCacheControl(req.Header)
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Range") != "" || reqCC.has("no-store") {
+		return ct.next.RoundTrip(req)
+	}
+
+	if entry := cache.lookup(key, req); entry != nil {
+		return ct.serve(cache, key, req, entry, reqCC)
+	}
+	if reqCC.has("only-if-cached") {
+		return cachedResponse(req, &CacheEntry{StatusCode: http.StatusGatewayTimeout, Header: http.Header{}}, 0, "MISS"), nil
+	}
+	if req.Method == http.MethodHead {
+		return ct.next.RoundTrip(req)
+	}
+
+	wait, leader := cache.join(key)
+	if !leader {
+		// an identical request is being fetched: its response is used if it gets stored
+		select {
+		case <-wait:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if entry := cache.lookup(key, req); entry != nil {
+			return ct.serve(cache, key, req, entry, reqCC)
+		}
+		return ct.fetch(cache, key, req, nil)
+	}
+	return ct.fetch(cache, key, req, func() { cache.leave(key) })
+}
+
+// serve answers a request with a stored entry, revalidating it when stale
+func (ct *cachingTransport) serve(cache *responseCache, key string, req *http.Request, entry *CacheEntry, reqCC cacheControl) (*http.Response, error) {
+	now := time.Now()
+	age := entry.age(now)
+	lifetime := entry.freshness(ct.route.config.Cache)
+	respCC := parseCacheControl(entry.Header)
+
+	revalidate := respCC.has("no-cache") || reqCC.has("no-cache")
+	if maxAge, found := reqCC.seconds("max-age"); found && age > maxAge {
+		revalidate = true
+	}
+	if age < lifetime && !revalidate {
+		return cachedResponse(req, entry, age, "HIT"), nil
+	}
+
+	swr, _ := respCC.seconds("stale-while-revalidate")
+	if !revalidate && !respCC.has("must-revalidate") && age < lifetime+swr {
+		// the stale response is served while it's revalidated in background, once for all the requests
+		if _, leader := cache.join(key); leader {
+			background := req.Clone(context.WithoutCancel(req.Context()))
+			go func() {
+				defer cache.leave(key)
+				resp, err := ct.revalidate(cache, key, background, entry)
+				if err != nil {
+					logRequestf(background, "Error revalidating cached response of %s: %v", key, err)
+					return
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}()
+		}
+		return cachedResponse(req, entry, age, "STALE"), nil
+	}
+	return ct.revalidate(cache, key, req, entry)
+}
+
+// revalidate asks the target whether a stored entry is still valid, using its validators
+func (ct *cachingTransport) revalidate(cache *responseCache, key string, req *http.Request, entry *CacheEntry) (*http.Response, error) {
+	etag, lastModified := entry.Header.Get("ETag"), entry.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return ct.fetch(cache, key, req, nil)
+	}
+	outreq := req.Clone(req.Context())
+	outreq.Header.Del("If-None-Match")
+	outreq.Header.Del("If-Modified-Since")
+	if etag != "" {
+		outreq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		outreq.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	requestTime := time.Now()
+	resp, err := ct.next.RoundTrip(outreq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		return ct.store(cache, key, req, resp, requestTime, nil), nil
+	}
+	resp.Body.Close()
+
+	// the stored response is still valid: its headers are updated with the ones of the 304 response
+	updated := *entry
+	updated.Header = entry.Header.Clone()
+	idHeader := http.CanonicalHeaderKey(temaki.RequestIDHeaderOf(req))
+	for name, values := range resp.Header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Content-Range", idHeader:
+			continue
+		}
+		updated.Header[name] = values
+	}
+	updated.RequestTime, updated.ResponseTime = requestTime, time.Now()
+	cache.put(key, req, &updated)
+	return cachedResponse(req, &updated, updated.age(time.Now()), "REVALIDATED"), nil
+}
+
+// fetch sends a request to the target, storing the response when possible: done is called once the response
+// has been stored or found not storable
+func (ct *cachingTransport) fetch(cache *responseCache, key string, req *http.Request, done func()) (*http.Response, error) {
+	requestTime := time.Now()
+	resp, err := ct.next.RoundTrip(req)
+	if err != nil {
+		if done != nil {
+			done()
+		}
+		return nil, err
+	}
+	return ct.store(cache, key, req, resp, requestTime, done), nil
+}
+
+// store arranges for a response to be stored once its body has been read by the client
+func (ct *cachingTransport) store(cache *responseCache, key string, req *http.Request, resp *http.Response, requestTime time.Time, done func()) *http.Response {
+	if done == nil {
+		done = func() {}
+	}
+	cfg := ct.route.config.Cache
+	vary, storable := storableResponse(req, resp, cfg)
+	if !storable || resp.ContentLength > cfg.maxEntrySize() {
+		done()
+		resp.Header.Set("X-Cache", "MISS")
+		return resp
+	}
+	entry := &CacheEntry{
+		StatusCode:   resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		Vary:         vary,
+		RequestTime:  requestTime,
+		ResponseTime: time.Now(),
+	}
+	// the ID of the request filling the cache isn't served to the others
+	entry.Header.Del(temaki.RequestIDHeaderOf(req))
+	resp.Body = &cacheFillBody{ReadCloser: resp.Body, limit: cfg.maxEntrySize(), done: func(body []byte, complete bool) {
+		if complete {
+			entry.Body = body
+			cache.put(key, req, entry)
+		}
+		done()
+	}}
+	resp.Header.Set("X-Cache", "MISS")
+	return resp
+}
+
+// storableResponse tells if a response can be stored, returning the request headers it varies on
+func storableResponse(req *http.Request, resp *http.Response, cfg *CacheConfig) ([]string, bool) {
+	if req.Method != http.MethodGet || resp.Header.Get("Set-Cookie") != "" {
+		return nil, false
+	}
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-store") || cc.has("private") {
+		return nil, false
+	}
+	explicit := cc.has("s-maxage") || cc.has("max-age") || resp.Header.Get("Expires") != ""
+	validators := resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+	if !explicit && !(heuristicallyCacheable[resp.StatusCode] && (validators || cfg.DefaultTTL > 0)) {
+		return nil, false
+	}
+	if resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusNotModified {
+		return nil, false
+	}
+
+	var vary []string
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" && !slices.Contains(vary, name) {
+				vary = append(vary, name)
+			}
+		}
+	}
+	slices.Sort(vary)
+	return vary, true
+}
+
+// age is the current age of an entry, as defined by RFC 9111 section 4.2.3
+func (e *CacheEntry) age(now time.Time) time.Duration {
+	var apparent time.Duration
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		apparent = max(0, e.ResponseTime.Sub(date))
+	}
+	ageValue, _ := strconv.Atoi(e.Header.Get("Age"))
+	corrected := time.Duration(ageValue)*time.Second + e.ResponseTime.Sub(e.RequestTime)
+	return max(apparent, corrected) + now.Sub(e.ResponseTime)
+}
+
+// freshness is the freshness lifetime of an entry, as defined by RFC 9111 section 4.2.1
+func (e *CacheEntry) freshness(cfg *CacheConfig) time.Duration {
+	cc := parseCacheControl(e.Header)
+	if lifetime, found := cc.seconds("s-maxage"); found {
+		return lifetime
+	}
+	if lifetime, found := cc.seconds("max-age"); found {
+		return lifetime
+	}
+	date, dateErr := http.ParseTime(e.Header.Get("Date"))
+	if dateErr != nil {
+		date = e.ResponseTime
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return max(0, expiresAt.Sub(date))
+	}
+	if !heuristicallyCacheable[e.StatusCode] {
+		return 0
+	}
+	if cfg.DefaultTTL > 0 {
+		return cfg.DefaultTTL
+	}
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil {
+		return min(max(0, date.Sub(lastModified)/10), maxHeuristicFreshness)
+	}
+	return 0
+}
+
+// cachedResponse builds the response of a request from a stored entry, answering 304 Not Modified
+// when the client already has it
+func cachedResponse(req *http.Request, entry *CacheEntry, age time.Duration, status string) *http.Response {
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.StatusCode, http.StatusText(entry.StatusCode)),
+		StatusCode:    entry.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        entry.Header.Clone(),
+		Request:       req,
+		ContentLength: int64(len(entry.Body)),
+		Body:          io.NopCloser(bytes.NewReader(entry.Body)),
+	}
+	resp.Header.Set("Age", strconv.Itoa(int(age.Seconds())))
+	resp.Header.Set("X-Cache", status)
+	if req.Method == http.MethodHead {
+		resp.Body = http.NoBody
+	}
+	if entry.StatusCode == http.StatusOK && notModified(req, entry.Header) {
+		resp.StatusCode = http.StatusNotModified
+		resp.Status = fmt.Sprintf("%d %s", http.StatusNotModified, http.StatusText(http.StatusNotModified))
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = 0
+		resp.Body = http.NoBody
+	}
+	return resp
+}
+
+// notModified evaluates the conditional headers of the client request against a stored response
+func notModified(req *http.Request, header http.Header) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ims)
+}
+
+// cacheFillBody collects the body of a response while the client reads it, reporting it once
+// complete: bodies larger than limit are not reported
+type cacheFillBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+	once     sync.Once
+	done     func(body []byte, complete bool)
+}
+
+func (b *cacheFillBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.overflow {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.once.Do(func() { b.done(b.buf.Bytes(), !b.overflow) })
+	}
+	return n, err
+}
+
+func (b *cacheFillBody) Close() error {
+	b.once.Do(func() { b.done(nil, false) })
+	return b.ReadCloser.Close()
+}
+
+// cacheControl holds the directives of a Cache-Control header
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	values := header.Values("Cache-Control")
+	if len(values) == 0 && strings.EqualFold(header.Get("Pragma"), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, found := cc[directive]
+	return found
+}
+
+// seconds returns the value of a directive like max-age as a duration
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	arg, found := cc[directive]
+	if !found {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, true
+	}
+	return time.Duration(seconds) * time.Second, true
+}
@@ -0,0 +1,240 @@
+package reverseproxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheEntry is a response stored in a CacheStore. Entries are never changed once stored.
+type CacheEntry struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body,omitempty"`
+	// Vary lists the request headers the response depends on
+	Vary []string `json:"vary,omitempty"`
+	// RequestTime and ResponseTime are the times the request was sent to the target and its response received
+	RequestTime  time.Time `json:"requestTime"`
+	ResponseTime time.Time `json:"responseTime"`
+}
+
+// CacheStore stores the cached responses of the reverse proxy: implementations must be safe for concurrent use
+type CacheStore interface {
+	// Get returns the entry stored with the given key
+	Get(key string) (*CacheEntry, bool)
+	// Set stores an entry, replacing the one with the same key
+	Set(key string, entry *CacheEntry)
+	// Delete removes the entry with the given key
+	Delete(key string)
+	// Purge removes the entries whose key matches, returning their number
+	Purge(match func(key string) bool) int
+}
+
+// MemoryCacheStore is a CacheStore keeping the entries in memory, evicting the least recently used ones
+// when the size of the entries exceeds its maximum size
+type MemoryCacheStore struct {
+	maxSize int64
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	items   map[string]*list.Element
+}
+
+type memoryCacheItem struct {
+	key   string
+	entry *CacheEntry
+	size  int64
+}
+
+// NewMemoryCacheStore creates an in-memory store holding at most maxSize bytes of entries
+func NewMemoryCacheStore(maxSize int64) *MemoryCacheStore {
+	return &MemoryCacheStore{maxSize: maxSize, lru: list.New(), items: map[string]*list.Element{}}
+}
+
+// Get implements CacheStore
+func (s *MemoryCacheStore) Get(key string) (*CacheEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, found := s.items[key]
+	if !found {
+		return nil, false
+	}
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*memoryCacheItem).entry, true
+}
+
+// Set implements CacheStore: an entry larger than the store is not stored
+func (s *MemoryCacheStore) Set(key string, entry *CacheEntry) {
+	item := &memoryCacheItem{key: key, entry: entry, size: entrySize(key, entry)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, found := s.items[key]; found {
+		s.remove(elem)
+	}
+	if item.size > s.maxSize {
+		return
+	}
+	s.items[key] = s.lru.PushFront(item)
+	s.size += item.size
+	for s.size > s.maxSize {
+		s.remove(s.lru.Back())
+	}
+}
+
+// Delete implements CacheStore
+func (s *MemoryCacheStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, found := s.items[key]; found {
+		s.remove(elem)
+	}
+}
+
+// Purge implements CacheStore
+func (s *MemoryCacheStore) Purge(match func(key string) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purged := 0
+	for key, elem := range s.items {
+		if match(key) {
+			s.remove(elem)
+			purged++
+		}
+	}
+	return purged
+}
+
+func (s *MemoryCacheStore) remove(elem *list.Element) {
+	item := s.lru.Remove(elem).(*memoryCacheItem)
+	delete(s.items, item.key)
+	s.size -= item.size
+}
+
+// entrySize estimates the memory used by an entry
+func entrySize(key string, entry *CacheEntry) int64 {
+	size := int64(len(key) + len(entry.Body) + 128)
+	for name, values := range entry.Header {
+		size += int64(len(name))
+		for _, v := range values {
+			size += int64(len(v))
+		}
+	}
+	return size
+}
+
+// FileCacheStore is a CacheStore keeping each entry in a file of a directory, which survives restarts
+type FileCacheStore struct {
+	dir string
+}
+
+type fileCacheItem struct {
+	Key   string      `json:"key"`
+	Entry *CacheEntry `json:"entry"`
+}
+
+// NewFileCacheStore creates a store keeping the entries in the given directory, which is created if missing
+func NewFileCacheStore(dir string) (*FileCacheStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileCacheStore{dir: dir}, nil
+}
+
+func (s *FileCacheStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// Get implements CacheStore
+func (s *FileCacheStore) Get(key string) (*CacheEntry, bool) {
+	item, err := readFileCacheItem(s.path(key))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Error reading cache entry %s: %v", key, err)
+		}
+		return nil, false
+	}
+	if item.Key != key {
+		return nil, false
+	}
+	return item.Entry, true
+}
+
+// Set implements CacheStore: the entry is written to a temporary file renamed into place, so that
+// concurrent readers never see a partial entry
+func (s *FileCacheStore) Set(key string, entry *CacheEntry) {
+	data, err := json.Marshal(fileCacheItem{Key: key, Entry: entry})
+	if err != nil {
+		log.Printf("Error encoding cache entry %s: %v", key, err)
+		return
+	}
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		log.Printf("Error writing cache entry %s: %v", key, err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Error writing cache entry %s: %v", key, err)
+	}
+}
+
+// Delete implements CacheStore
+func (s *FileCacheStore) Delete(key string) {
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Error deleting cache entry %s: %v", key, err)
+	}
+}
+
+// Purge implements CacheStore, reading the key of every entry of the directory
+func (s *FileCacheStore) Purge(match func(key string) bool) int {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("Error reading cache directory %s: %v", s.dir, err)
+		return 0
+	}
+	purged := 0
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(s.dir, file.Name())
+		item, err := readFileCacheItem(path)
+		if err != nil || !match(item.Key) {
+			continue
+		}
+		if os.Remove(path) == nil {
+			purged++
+		}
+	}
+	return purged
+}
+
+func readFileCacheItem(path string) (*fileCacheItem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var item fileCacheItem
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
@@ -0,0 +1,143 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// newCachingProxy returns the handler of a proxy caching the responses of upstream under /api/
+func newCachingProxy(t *testing.T, upstream http.Handler) http.Handler {
+	t.Helper()
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+	rp := New(PathPrefixRoutesMap{"/api/": TargetHost(server.URL)}).
+		WithRouteConfig("/api/", RouteConfig{Cache: &CacheConfig{}})
+	if rp.configErr != nil {
+		t.Fatal(rp.configErr)
+	}
+	return rp.handler()
+}
+
+func TestCacheFreshness(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		wantSecond   string
+		wantFetches  int32
+	}{
+		{name: "fresh", cacheControl: "max-age=60", wantSecond: "HIT", wantFetches: 1},
+		{name: "stale", cacheControl: "max-age=0", wantSecond: "MISS", wantFetches: 2},
+		{name: "no-store", cacheControl: "no-store", wantSecond: "MISS", wantFetches: 2},
+		{name: "private", cacheControl: "private, max-age=60", wantSecond: "MISS", wantFetches: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			handler := newCachingProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				fmt.Fprint(w, "body")
+			}))
+
+			if got := serve(handler, http.MethodGet, "/api/item").Header().Get("X-Cache"); got != "MISS" {
+				t.Errorf("first X-Cache = %q, want MISS", got)
+			}
+			second := serve(handler, http.MethodGet, "/api/item")
+			if got := second.Header().Get("X-Cache"); got != tt.wantSecond {
+				t.Errorf("second X-Cache = %q, want %q", got, tt.wantSecond)
+			}
+			if second.Body.String() != "body" {
+				t.Errorf("second body = %q, want %q", second.Body.String(), "body")
+			}
+			if got := fetches.Load(); got != tt.wantFetches {
+				t.Errorf("upstream fetches = %d, want %d", got, tt.wantFetches)
+			}
+		})
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch} {
+		t.Run(method, func(t *testing.T) {
+			var version atomic.Int32
+			version.Store(1)
+			handler := newCachingProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet {
+					version.Add(1)
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				w.Header().Set("Cache-Control", "max-age=60")
+				fmt.Fprintf(w, "v%d", version.Load())
+			}))
+
+			serve(handler, http.MethodGet, "/api/item")
+			if rec := serve(handler, http.MethodGet, "/api/item"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "v1" {
+				t.Fatalf("before %s: X-Cache %q body %q, want HIT v1", method, rec.Header().Get("X-Cache"), rec.Body.String())
+			}
+			serve(handler, method, "/api/item")
+			if rec := serve(handler, http.MethodGet, "/api/item"); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "v2" {
+				t.Errorf("after %s: X-Cache %q body %q, want MISS v2", method, rec.Header().Get("X-Cache"), rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestCacheInvalidationKeepsFailedAndSafeRequests(t *testing.T) {
+	handler := newCachingProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "body")
+	}))
+
+	serve(handler, http.MethodGet, "/api/item")
+	serve(handler, http.MethodPost, "/api/item")
+	serve(handler, http.MethodOptions, "/api/item")
+	if got := serve(handler, http.MethodGet, "/api/item").Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("X-Cache = %q, want HIT: failed and safe requests must not invalidate", got)
+	}
+}
+
+func TestResponseCacheInvalidateVariants(t *testing.T) {
+	cache := newResponseCache(NewMemoryCacheStore(defaultCacheSize))
+	entry := &CacheEntry{StatusCode: http.StatusOK, Header: http.Header{}}
+	removed := []string{
+		"example.com/item",
+		"example.com/item\x00" + VariantCanary,
+		"example.com/item\x00Accept-Encoding=gzip",
+		"example.com/item\x00" + VariantCanary + "\x00Accept-Encoding=gzip",
+	}
+	kept := []string{"example.com/item?page=2", "example.com/items", "other.com/item"}
+	for _, key := range append(removed, kept...) {
+		cache.store.Set(key, entry)
+	}
+
+	cache.invalidate("example.com/item")
+	for _, key := range removed {
+		if _, found := cache.store.Get(key); found {
+			t.Errorf("%q is still stored", key)
+		}
+	}
+	for _, key := range kept {
+		if _, found := cache.store.Get(key); !found {
+			t.Errorf("%q was removed", key)
+		}
+	}
+}
+
+func TestIsSafe(t *testing.T) {
+	for method, want := range map[string]bool{
+		http.MethodGet: true, http.MethodHead: true, http.MethodOptions: true, http.MethodTrace: true,
+		http.MethodPost: false, http.MethodPut: false, http.MethodDelete: false, http.MethodPatch: false,
+	} {
+		if got := isSafe(method); got != want {
+			t.Errorf("isSafe(%s) = %v, want %v", method, got, want)
+		}
+	}
+}
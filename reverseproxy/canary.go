@@ -0,0 +1,196 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// VariantStable is the value of the override header or cookie forcing the stable targets of a route
+	VariantStable = "stable"
+	// VariantCanary is the value of the override header or cookie forcing the canary targets of a route
+	VariantCanary = "canary"
+
+	// EnvCanaryStickyCookie and EnvCanaryOverrideHeader are the sticky cookie and the override header
+	// of the canaries collected from the env vars
+	EnvCanaryStickyCookie   = "proxy_variant"
+	EnvCanaryOverrideHeader = "X-Proxy-Variant"
+
+	// defaultStickyCookieMaxAge is the lifetime of the sticky cookie when CanaryConfig.StickyCookieMaxAge is 0
+	defaultStickyCookieMaxAge = 24 * time.Hour
+)
+
+// canaryRand draws the variant of the requests without an override or a sticky one: it's fixed in tests
+var canaryRand = rand.Float64
+
+// CanaryConfig splits the requests of a route between its targets, the stable group, and a canary group.
+// The variant of a request is chosen, in order, by the override header, the override cookie, the sticky cookie,
+// the hash of the sticky header and finally at random by Weight.
+type CanaryConfig struct {
+	// Targets are the canary targets, balanced like the stable ones
+	Targets []TargetHost
+	// Weight is the percentage of the requests sent to the canary targets, from 0 to 100
+	Weight float64
+	// OverrideHeader and OverrideCookie name a header and a cookie whose value, "stable" or "canary",
+	// forces the variant of a request
+	OverrideHeader string
+	OverrideCookie string
+	// StickyCookie names a cookie set on the responses to keep the clients on the variant they were
+	// assigned to at random
+	StickyCookie string
+	// StickyCookieMaxAge is the lifetime of the sticky cookie (24h when 0)
+	StickyCookieMaxAge time.Duration
+	// StickyHeader names a request header, like X-User-Id, whose hash chooses the variant: the same value
+	// always gets the same variant, as long as Weight doesn't change
+	StickyHeader string
+}
+
+// WithCanary splits the requests of a route between its targets and the canary ones
+func (rp *ReverseProxy) WithCanary(prefix PathPrefix, canary CanaryConfig) *ReverseProxy {
+	return rp.WithVirtualHostCanary("", prefix, canary)
+}
+
+// WithVirtualHostCanary splits the requests of a route of a virtual host between its targets and the canary ones
+func (rp *ReverseProxy) WithVirtualHostCanary(host VirtualHost, prefix PathPrefix, canary CanaryConfig) *ReverseProxy {
+	_, r, err := findRoute(rp.table.Load(), host, prefix)
+	if err != nil {
+		rp.setConfigError(err)
+		return rp
+	}
+	cfg := r.config
+	cfg.Canary = &canary
+	return rp.WithVirtualHostRouteConfig(host, prefix, cfg)
+}
+
+// WithCanaries adds the given canaries to the routes with the same PathPrefix
+func (rp *ReverseProxy) WithCanaries(canaries map[PathPrefix]CanaryConfig) *ReverseProxy {
+	for prefix, canary := range canaries {
+		rp.WithCanary(prefix, canary)
+	}
+	return rp
+}
+
+// CollectCanaryRulesFromEnvVar collects the env vars like:
+// PROXY_CANARY_WEATHER_API=/weather/>https://canary.weather.com>10
+// This means that 10% of the clients of the route /weather/ are sent to https://canary.weather.com
+// (several canary targets can be separated by commas). The clients are kept on their variant by the
+// proxy_variant cookie, and the X-Proxy-Variant header forces the variant with the values stable or canary.
+func CollectCanaryRulesFromEnvVar() map[PathPrefix]CanaryConfig {
+	canaries := map[PathPrefix]CanaryConfig{}
+	for _, envVar := range os.Environ() {
+		envVarName, envVarValue, _ := strings.Cut(envVar, "=")
+		if !strings.HasPrefix(envVarName, "PROXY_CANARY_") {
+			continue
+		}
+		parts := strings.Split(envVarValue, ">")
+		if len(parts) != 3 {
+			log.Printf("Ignoring malformed canary rule %s: expected <pathprefix>><targets>><weight>", envVarName)
+			continue
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(parts[2]), 64)
+		if err != nil || weight < 0 || weight > 100 {
+			log.Printf("Ignoring canary rule %s: invalid weight %q", envVarName, parts[2])
+			continue
+		}
+		canary := CanaryConfig{Weight: weight, StickyCookie: EnvCanaryStickyCookie, OverrideHeader: EnvCanaryOverrideHeader}
+		for _, target := range strings.Split(parts[1], ",") {
+			canary.Targets = append(canary.Targets, TargetHost(strings.TrimSpace(target)))
+		}
+		canaries[PathPrefix(parts[0])] = canary
+	}
+	return canaries
+}
+
+// SetCanaryWeight changes the percentage of the requests sent to the canary targets of a route
+func (rp *ReverseProxy) SetCanaryWeight(host VirtualHost, prefix PathPrefix, weight float64) error {
+	if weight < 0 || weight > 100 {
+		return fmt.Errorf("invalid canary weight %v", weight)
+	}
+	return rp.updateTable(func(table *routingTable) error {
+		vh, r, err := findRoute(table, host, prefix)
+		if err != nil {
+			return err
+		}
+		if r.config.Canary == nil {
+			return fmt.Errorf("route %s has no canary", r.name())
+		}
+		return rp.replaceRoute(table, vh, r, func(c *route) error {
+			canary := *c.config.Canary
+			canary.Weight = weight
+			c.config.Canary = &canary
+			return nil
+		})
+	})
+}
+
+// canaryTargets returns the normalized canary targets of the route
+func (r *route) canaryTargets() []TargetHost {
+	var targets []TargetHost
+	if r.config.Canary != nil {
+		for _, target := range r.config.Canary.Targets {
+			targets = append(targets, normalizeTargetHost(target))
+		}
+	}
+	return targets
+}
+
+// variant chooses the variant of a request, telling also if the sticky cookie must be set on the response
+func (c *CanaryConfig) variant(req *http.Request) (canary bool, setCookie bool) {
+	if c.OverrideHeader != "" {
+		if v, found := parseVariant(req.Header.Get(c.OverrideHeader)); found {
+			return v, false
+		}
+	}
+	if c.OverrideCookie != "" {
+		if cookie, err := req.Cookie(c.OverrideCookie); err == nil {
+			if v, found := parseVariant(cookie.Value); found {
+				return v, false
+			}
+		}
+	}
+	if c.StickyCookie != "" {
+		if cookie, err := req.Cookie(c.StickyCookie); err == nil {
+			if v, found := parseVariant(cookie.Value); found {
+				return v, false
+			}
+		}
+	}
+	if c.StickyHeader != "" {
+		if value := req.Header.Get(c.StickyHeader); value != "" {
+			h := fnv.New32a()
+			h.Write([]byte(value))
+			return float64(h.Sum32()%10000) < c.Weight*100, false
+		}
+	}
+	return canaryRand()*100 < c.Weight, c.StickyCookie != ""
+}
+
+func parseVariant(value string) (canary bool, found bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case VariantCanary:
+		return true, true
+	case VariantStable:
+		return false, true
+	}
+	return false, false
+}
+
+// stickyCookie is the cookie keeping a client on its variant
+func (c *CanaryConfig) stickyCookie(canary bool) *http.Cookie {
+	maxAge := c.StickyCookieMaxAge
+	if maxAge <= 0 {
+		maxAge = defaultStickyCookieMaxAge
+	}
+	value := VariantStable
+	if canary {
+		value = VariantCanary
+	}
+	return &http.Cookie{Name: c.StickyCookie, Value: value, Path: "/", MaxAge: int(maxAge.Seconds()), HttpOnly: true}
+}
@@ -0,0 +1,154 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fixCanaryRand makes the random variants of the test reproducible
+func fixCanaryRand(t *testing.T) {
+	t.Helper()
+	r := rand.New(rand.NewPCG(1, 2))
+	canaryRand = r.Float64
+	t.Cleanup(func() { canaryRand = rand.Float64 })
+}
+
+func TestCanaryVariantPrecedence(t *testing.T) {
+	c := &CanaryConfig{
+		Weight:         50,
+		OverrideHeader: "X-Variant",
+		OverrideCookie: "variant",
+		StickyCookie:   "sticky",
+		StickyHeader:   "X-User",
+	}
+	tests := []struct {
+		name       string
+		header     http.Header
+		cookies    map[string]string
+		wantCanary bool
+	}{
+		{name: "override header", header: http.Header{"X-Variant": {"Canary"}}, cookies: map[string]string{"variant": "stable", "sticky": "stable"}, wantCanary: true},
+		{name: "override cookie", cookies: map[string]string{"variant": "canary", "sticky": "stable"}, wantCanary: true},
+		{name: "sticky cookie", cookies: map[string]string{"sticky": "stable"}, header: http.Header{"X-User": {"u"}}, wantCanary: false},
+		{name: "invalid override ignored", header: http.Header{"X-Variant": {"beta"}}, cookies: map[string]string{"sticky": "canary"}, wantCanary: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for name, values := range tt.header {
+				req.Header[name] = values
+			}
+			for name, value := range tt.cookies {
+				req.AddCookie(&http.Cookie{Name: name, Value: value})
+			}
+			canary, setCookie := c.variant(req)
+			if canary != tt.wantCanary || setCookie {
+				t.Errorf("variant = %v, set cookie %v, want %v without cookie", canary, setCookie, tt.wantCanary)
+			}
+		})
+	}
+}
+
+func TestCanaryVariantStickyHeader(t *testing.T) {
+	c := &CanaryConfig{Weight: 30, StickyHeader: "X-User", StickyCookie: "sticky"}
+	canaries := 0
+	for i := 0; i < 10000; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-User", fmt.Sprintf("user-%d", i))
+		first, setCookie := c.variant(req)
+		if setCookie {
+			t.Fatal("the sticky cookie is set for a client kept by the sticky header")
+		}
+		for j := 0; j < 3; j++ {
+			if again, _ := c.variant(req); again != first {
+				t.Fatalf("user-%d changed variant", i)
+			}
+		}
+		if first {
+			canaries++
+		}
+	}
+	if canaries < 2700 || canaries > 3300 {
+		t.Errorf("%d canary users out of 10000, want about 3000", canaries)
+	}
+}
+
+func TestCanaryVariantSplit(t *testing.T) {
+	fixCanaryRand(t)
+	for _, weight := range []float64{0, 10, 50, 100} {
+		c := &CanaryConfig{Weight: weight, StickyCookie: "sticky"}
+		canaries := 0
+		for i := 0; i < 10000; i++ {
+			canary, setCookie := c.variant(httptest.NewRequest(http.MethodGet, "/", nil))
+			if !setCookie {
+				t.Fatal("the sticky cookie isn't set for a client without a variant")
+			}
+			if canary {
+				canaries++
+			}
+		}
+		want := int(weight * 100)
+		if canaries < want-200 || canaries > want+200 {
+			t.Errorf("weight %v: %d canary requests out of 10000, want about %d", weight, canaries, want)
+		}
+		if (weight == 0 && canaries != 0) || (weight == 100 && canaries != 10000) {
+			t.Errorf("weight %v: %d canary requests out of 10000", weight, canaries)
+		}
+	}
+}
+
+func TestCanaryStickyCookie(t *testing.T) {
+	fixCanaryRand(t)
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+	}
+	stable, canary := newUpstream("stable"), newUpstream("canary")
+	defer stable.Close()
+	defer canary.Close()
+
+	rp := New(PathPrefixRoutesMap{"/app/": TargetHost(stable.URL)}).
+		WithAccessLogger(nil).
+		WithCanary("/app/", CanaryConfig{Targets: []TargetHost{TargetHost(canary.URL)}, Weight: 50, StickyCookie: "sticky"})
+
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		rec := serve(rp.handler(), http.MethodGet, "/app/")
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != "sticky" || cookies[0].Value != rec.Body.String() {
+			t.Fatalf("response %q with cookies %v, want the sticky cookie of its variant", rec.Body.String(), cookies)
+		}
+		variant := rec.Body.String()
+		seen[variant] = true
+
+		// the client keeps its variant without getting the cookie again
+		for j := 0; j < 5; j++ {
+			req := httptest.NewRequest(http.MethodGet, "/app/", nil)
+			req.AddCookie(cookies[0])
+			again := httptest.NewRecorder()
+			rp.handler().ServeHTTP(again, req)
+			if again.Body.String() != variant || again.Header().Get("Set-Cookie") != "" {
+				t.Fatalf("sticky client of %s got %q, Set-Cookie %q", variant, again.Body.String(), again.Header().Get("Set-Cookie"))
+			}
+		}
+	}
+	if !seen["stable"] || !seen["canary"] {
+		t.Errorf("variants assigned to the new clients: %v, want both", seen)
+	}
+}
+
+func TestCircuitStatesListsCanaryTargets(t *testing.T) {
+	rp := New(PathPrefixRoutesMap{"/app/": "http://stable"}).
+		WithAccessLogger(nil).
+		WithRouteConfig("/app/", RouteConfig{CircuitBreaker: &CircuitBreakerConfig{}}).
+		WithCanary("/app/", CanaryConfig{Targets: []TargetHost{"http://canary"}, Weight: 10})
+	states := rp.CircuitStates()["/app/"]
+	if len(states) != 2 || states["http://stable"] != CircuitClosed || states["http://canary"] != CircuitClosed {
+		t.Errorf("circuit states = %v, want the stable and the canary targets", states)
+	}
+}
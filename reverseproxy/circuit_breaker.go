@@ -0,0 +1,273 @@
+package reverseproxy
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned when every target of a route has its circuit breaker open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// Clock tells the current time: it can be replaced by a fake clock in tests
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// CircuitState is the state of a circuit breaker
+type CircuitState int
+
+const (
+	// CircuitClosed lets all the requests through while measuring their outcome
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails all the requests fast, without reaching the upstream
+	CircuitOpen
+	// CircuitHalfOpen lets a few probe requests through to decide whether to close the circuit again
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// windowBuckets is the number of buckets the rolling window of a circuit breaker is divided into
+const windowBuckets = 10
+
+// CircuitBreakerConfig configures the circuit breakers of the targets of a route.
+// The circuit of a target opens when, over the rolling Window and with at least MinRequests,
+// the rate of failed requests reaches ErrorRateThreshold or the rate of requests slower than
+// LatencyThreshold reaches SlowRateThreshold.
+type CircuitBreakerConfig struct {
+	// Window is the duration of the rolling window of measures (10s when 0)
+	Window time.Duration
+	// MinRequests is the minimum number of requests in the window to evaluate the thresholds (20 when 0)
+	MinRequests int
+	// ErrorRateThreshold is the rate of failed requests, between 0 and 1, opening the circuit (0.5 when 0)
+	ErrorRateThreshold float64
+	// LatencyThreshold is the latency above which a request is slow (0 disables the latency check)
+	LatencyThreshold time.Duration
+	// SlowRateThreshold is the rate of slow requests, between 0 and 1, opening the circuit (0.5 when 0)
+	SlowRateThreshold float64
+	// OpenTimeout is how long the circuit stays open before letting probes through (30s when 0)
+	OpenTimeout time.Duration
+	// HalfOpenRequests is the number of successful probes needed to close the circuit (1 when 0)
+	HalfOpenRequests int
+	// OpenResponse writes the response sent while the circuit is open: when nil the error handler of the
+	// reverse proxy answers 503 Service Unavailable
+	OpenResponse http.HandlerFunc
+	// Clock is the source of time of the circuit breakers (the system clock when nil)
+	Clock Clock
+}
+
+// equal tells if two configurations create the same circuit breakers, ignoring the OpenResponse and the Clock,
+// which can't be compared
+func (cfg *CircuitBreakerConfig) equal(other *CircuitBreakerConfig) bool {
+	if cfg == nil || other == nil {
+		return cfg == other
+	}
+	return cfg.Window == other.Window && cfg.MinRequests == other.MinRequests &&
+		cfg.ErrorRateThreshold == other.ErrorRateThreshold && cfg.LatencyThreshold == other.LatencyThreshold &&
+		cfg.SlowRateThreshold == other.SlowRateThreshold && cfg.OpenTimeout == other.OpenTimeout &&
+		cfg.HalfOpenRequests == other.HalfOpenRequests
+}
+
+func (cfg CircuitBreakerConfig) withDefaults() CircuitBreakerConfig {
+	if cfg.Window <= 0 {
+		cfg.Window = 10 * time.Second
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 20
+	}
+	if cfg.ErrorRateThreshold <= 0 {
+		cfg.ErrorRateThreshold = 0.5
+	}
+	if cfg.SlowRateThreshold <= 0 {
+		cfg.SlowRateThreshold = 0.5
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = 30 * time.Second
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = realClock{}
+	}
+	return cfg
+}
+
+type bucket struct {
+	epoch    int64
+	total    int
+	failures int
+	slow     int
+}
+
+// CircuitBreaker tracks the outcome of the requests to a single upstream
+type CircuitBreaker struct {
+	cfg      CircuitBreakerConfig
+	mu       sync.Mutex
+	state    CircuitState
+	openedAt time.Time
+	buckets  [windowBuckets]bucket
+	probes   int
+	passed   int
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(cfg CircuitBreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{cfg: cfg.withDefaults()}
+}
+
+// State returns the current state of the circuit
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.expireOpen()
+	return cb.state
+}
+
+// Allow tells whether a request can be sent to the upstream. Every allowed request must be followed
+// by a call to Record with its outcome, or to Release when the outcome is unknown.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.expireOpen()
+	switch cb.state {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		if cb.probes >= cb.cfg.HalfOpenRequests {
+			return false
+		}
+		cb.probes++
+	}
+	return true
+}
+
+// Record registers the outcome of a request allowed by Allow
+func (cb *CircuitBreaker) Record(failed bool, latency time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	slow := cb.cfg.LatencyThreshold > 0 && latency > cb.cfg.LatencyThreshold
+
+	switch cb.state {
+	case CircuitHalfOpen:
+		if failed || slow {
+			cb.open()
+			return
+		}
+		cb.passed++
+		if cb.passed >= cb.cfg.HalfOpenRequests {
+			cb.state = CircuitClosed
+			cb.buckets = [windowBuckets]bucket{}
+		}
+	case CircuitClosed:
+		b := cb.currentBucket()
+		b.total++
+		if failed {
+			b.failures++
+		}
+		if slow {
+			b.slow++
+		}
+		if cb.tripped() {
+			cb.open()
+		}
+	}
+}
+
+// Release gives back the permission of a request allowed by Allow whose outcome tells nothing about the
+// upstream, like a request canceled by its client: in the half-open state another probe can take its place
+func (cb *CircuitBreaker) Release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == CircuitHalfOpen && cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+func (cb *CircuitBreaker) open() {
+	cb.state = CircuitOpen
+	cb.openedAt = cb.cfg.Clock.Now()
+}
+
+// expireOpen moves an open circuit to half-open once the OpenTimeout is elapsed
+func (cb *CircuitBreaker) expireOpen() {
+	if cb.state == CircuitOpen && cb.cfg.Clock.Now().Sub(cb.openedAt) >= cb.cfg.OpenTimeout {
+		cb.state = CircuitHalfOpen
+		cb.probes = 0
+		cb.passed = 0
+	}
+}
+
+func (cb *CircuitBreaker) bucketDuration() int64 {
+	d := int64(cb.cfg.Window / windowBuckets)
+	if d <= 0 {
+		return 1
+	}
+	return d
+}
+
+func (cb *CircuitBreaker) currentBucket() *bucket {
+	epoch := cb.cfg.Clock.Now().UnixNano() / cb.bucketDuration()
+	b := &cb.buckets[epoch%windowBuckets]
+	if b.epoch != epoch {
+		*b = bucket{epoch: epoch}
+	}
+	return b
+}
+
+// tripped tells if the measures of the rolling window exceed the thresholds
+func (cb *CircuitBreaker) tripped() bool {
+	epoch := cb.cfg.Clock.Now().UnixNano() / cb.bucketDuration()
+	var total, failures, slow int
+	for _, b := range cb.buckets {
+		if epoch-b.epoch < windowBuckets {
+			total += b.total
+			failures += b.failures
+			slow += b.slow
+		}
+	}
+	if total < cb.cfg.MinRequests {
+		return false
+	}
+	return float64(failures)/float64(total) >= cb.cfg.ErrorRateThreshold ||
+		(cb.cfg.LatencyThreshold > 0 && float64(slow)/float64(total) >= cb.cfg.SlowRateThreshold)
+}
+
+// CircuitStates returns the state of the circuit breaker of every target, grouped by route.
+// The routes of a virtual host are keyed by the host followed by the PathPrefix, like api.example.com/v1/.
+// The canary targets are listed with the stable ones. Routes without a CircuitBreaker configuration are not listed.
+func (rp *ReverseProxy) CircuitStates() map[PathPrefix]map[TargetHost]CircuitState {
+	states := map[PathPrefix]map[TargetHost]CircuitState{}
+	for _, r := range rp.table.Load().routes() {
+		if r.config.CircuitBreaker == nil {
+			continue
+		}
+		name := PathPrefix(r.name())
+		states[name] = map[TargetHost]CircuitState{}
+		for _, pool := range []*targetPool{r.pool, r.canaryPool} {
+			if pool == nil {
+				continue
+			}
+			for _, t := range pool.targets {
+				states[name][t.host] = t.breaker.State()
+			}
+		}
+	}
+	return states
+}
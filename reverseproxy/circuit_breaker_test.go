@@ -0,0 +1,229 @@
+package reverseproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock moved forward by the tests
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// record lets a request through the breaker and records its outcome
+func record(t *testing.T, cb *CircuitBreaker, failed bool, latency time.Duration) {
+	t.Helper()
+	if !cb.Allow() {
+		t.Fatalf("request not allowed in state %s", cb.State())
+	}
+	cb.Record(failed, latency)
+}
+
+func TestCircuitBreakerOpensOnErrorRate(t *testing.T) {
+	clock := newFakeClock()
+	cb := NewCircuitBreaker(CircuitBreakerConfig{MinRequests: 4, ErrorRateThreshold: 0.5, Clock: clock})
+
+	record(t, cb, true, time.Millisecond)
+	record(t, cb, true, time.Millisecond)
+	record(t, cb, true, time.Millisecond)
+	if cb.State() != CircuitClosed {
+		t.Fatalf("state = %s below MinRequests, want closed", cb.State())
+	}
+	record(t, cb, false, time.Millisecond)
+	if cb.State() != CircuitOpen {
+		t.Fatalf("state = %s with 3 failures out of 4, want open", cb.State())
+	}
+	if cb.Allow() {
+		t.Error("an open circuit allowed a request")
+	}
+}
+
+func TestCircuitBreakerStaysClosedBelowThreshold(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{MinRequests: 4, ErrorRateThreshold: 0.5, Clock: newFakeClock()})
+	for _, failed := range []bool{true, false, false, false, false, false} {
+		record(t, cb, failed, time.Millisecond)
+	}
+	if cb.State() != CircuitClosed {
+		t.Errorf("state = %s, want closed", cb.State())
+	}
+}
+
+func TestCircuitBreakerOpensOnSlowRate(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{MinRequests: 2, LatencyThreshold: 100 * time.Millisecond,
+		SlowRateThreshold: 0.5, Clock: newFakeClock()})
+	record(t, cb, false, 10*time.Millisecond)
+	record(t, cb, false, time.Second)
+	if cb.State() != CircuitOpen {
+		t.Errorf("state = %s with half the requests slow, want open", cb.State())
+	}
+}
+
+func TestCircuitBreakerWindowExpires(t *testing.T) {
+	clock := newFakeClock()
+	cb := NewCircuitBreaker(CircuitBreakerConfig{Window: 10 * time.Second, MinRequests: 4, Clock: clock})
+	record(t, cb, true, time.Millisecond)
+	record(t, cb, true, time.Millisecond)
+	record(t, cb, true, time.Millisecond)
+	// the failures leave the rolling window
+	clock.Advance(11 * time.Second)
+	record(t, cb, true, time.Millisecond)
+	if cb.State() != CircuitClosed {
+		t.Errorf("state = %s with the old failures out of the window, want closed", cb.State())
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	tests := []struct {
+		name   string
+		failed bool
+		want   CircuitState
+	}{
+		{name: "probe succeeds", failed: false, want: CircuitClosed},
+		{name: "probe fails", failed: true, want: CircuitOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			cb := NewCircuitBreaker(CircuitBreakerConfig{MinRequests: 1, OpenTimeout: 30 * time.Second, Clock: clock})
+			record(t, cb, true, time.Millisecond)
+
+			clock.Advance(29 * time.Second)
+			if cb.State() != CircuitOpen {
+				t.Fatalf("state = %s before the OpenTimeout, want open", cb.State())
+			}
+			clock.Advance(time.Second)
+			if cb.State() != CircuitHalfOpen {
+				t.Fatalf("state = %s after the OpenTimeout, want half-open", cb.State())
+			}
+			if !cb.Allow() {
+				t.Fatal("the probe wasn't allowed")
+			}
+			if cb.Allow() {
+				t.Fatal("a second probe was allowed with HalfOpenRequests 1")
+			}
+			cb.Record(tt.failed, time.Millisecond)
+			if cb.State() != tt.want {
+				t.Errorf("state = %s, want %s", cb.State(), tt.want)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerHalfOpenNeedsAllProbes(t *testing.T) {
+	clock := newFakeClock()
+	cb := NewCircuitBreaker(CircuitBreakerConfig{MinRequests: 1, HalfOpenRequests: 2, Clock: clock})
+	record(t, cb, true, time.Millisecond)
+	clock.Advance(30 * time.Second)
+
+	record(t, cb, false, time.Millisecond)
+	if cb.State() != CircuitHalfOpen {
+		t.Fatalf("state = %s after 1 of 2 probes, want half-open", cb.State())
+	}
+	record(t, cb, false, time.Millisecond)
+	if cb.State() != CircuitClosed {
+		t.Errorf("state = %s after 2 of 2 probes, want closed", cb.State())
+	}
+}
+
+func TestCircuitBreakerRelease(t *testing.T) {
+	clock := newFakeClock()
+	cb := NewCircuitBreaker(CircuitBreakerConfig{MinRequests: 1, Clock: clock})
+	record(t, cb, true, time.Millisecond)
+	clock.Advance(30 * time.Second)
+
+	if !cb.Allow() {
+		t.Fatal("the probe wasn't allowed")
+	}
+	cb.Release()
+	if cb.State() != CircuitHalfOpen {
+		t.Fatalf("state = %s after a released probe, want half-open", cb.State())
+	}
+	if !cb.Allow() {
+		t.Error("the released probe wasn't given back")
+	}
+}
+
+func TestAttemptOutcome(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	timedOut, cancelTimeout := context.WithCancelCause(context.Background())
+	cancelTimeout(ErrResponseTimeout)
+	errUpstream := errors.New("timeout awaiting response headers")
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		err        error
+		cond       RetryCondition
+		wantFailed bool
+		wantKnown  bool
+	}{
+		{name: "success", ctx: context.Background(), wantKnown: true},
+		{name: "5xx", ctx: context.Background(), cond: RetryOn503, wantFailed: true, wantKnown: true},
+		{name: "transport error", ctx: context.Background(), err: errUpstream, wantFailed: true, wantKnown: true},
+		{name: "proxy timeout", ctx: timedOut, err: context.Canceled, wantFailed: true, wantKnown: true},
+		{name: "client canceled", ctx: canceled, err: context.Canceled, wantKnown: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(tt.ctx)
+			failed, known := attemptOutcome(req, tt.err, tt.cond)
+			if failed != tt.wantFailed || known != tt.wantKnown {
+				t.Errorf("attemptOutcome = (%v, %v), want (%v, %v)", failed, known, tt.wantFailed, tt.wantKnown)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerOpensOnResponseTimeouts(t *testing.T) {
+	hung := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hung:
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	defer close(hung)
+
+	rp := New(PathPrefixRoutesMap{"/api/": TargetHost(upstream.URL)}).
+		WithRouteConfig("/api/", RouteConfig{
+			Limits:         &Limits{ResponseTimeout: 50 * time.Millisecond},
+			CircuitBreaker: &CircuitBreakerConfig{MinRequests: 2},
+		})
+	handler := rp.handler()
+
+	for i := 0; i < 2; i++ {
+		if rec := serve(handler, http.MethodGet, "/api/"); rec.Code != http.StatusGatewayTimeout {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusGatewayTimeout)
+		}
+	}
+	if state := rp.CircuitStates()["/api/"][TargetHost(upstream.URL)]; state != CircuitOpen {
+		t.Errorf("state = %s after 2 timeouts, want open", state)
+	}
+	if rec := serve(handler, http.MethodGet, "/api/"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d with the circuit open, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
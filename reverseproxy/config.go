@@ -0,0 +1,710 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the declarative configuration of the reverse proxy, read from a YAML or JSON file like:
+//
+//	forwardedHeaders:
+//	  trustedProxies: ["10.0.0.0/8"]
+//	routes:
+//	  - prefix: /weather/
+//	    targets: ["https://api.weather.com", "https://api2.weather.com"]
+//	    retry: {attempts: 3, perTryTimeout: 2s}
+//	virtualHosts:
+//	  - host: "*.tenant.example.com"
+//	    routes:
+//	      - prefix: /
+//	        targets: ["http://tenants:8080"]
+type Config struct {
+	// Transport configures the transport shared by all the routes
+	Transport *TransportSpec `json:"transport,omitempty"`
+	// ForwardedHeaders configures the forwarding headers sent to the upstreams
+	ForwardedHeaders *ForwardedHeaders `json:"forwardedHeaders,omitempty"`
+	// Cache configures the store of the responses of the routes with caching enabled
+	Cache *CacheStoreSpec `json:"cache,omitempty"`
+	// Connect enables the CONNECT forward proxy mode
+	Connect *ConnectSpec `json:"connect,omitempty"`
+	// Routes are the routes served for any host
+	Routes []RouteSpec `json:"routes,omitempty"`
+	// VirtualHosts are the routes served only for given hosts
+	VirtualHosts []VirtualHostSpec `json:"virtualHosts,omitempty"`
+}
+
+// VirtualHostSpec is the configuration of a virtual host
+type VirtualHostSpec struct {
+	Host     VirtualHost `json:"host"`
+	CertFile string      `json:"certFile,omitempty"`
+	KeyFile  string      `json:"keyFile,omitempty"`
+	Routes   []RouteSpec `json:"routes"`
+}
+
+// RouteSpec is the configuration of a route: the first target is the TargetHost of the route
+type RouteSpec struct {
+	Prefix         PathPrefix          `json:"prefix"`
+	Targets        []TargetHost        `json:"targets"`
+	PathRewrite    *PathRewrite        `json:"pathRewrite,omitempty"`
+	Headers        *HeaderRules        `json:"headers,omitempty"`
+	Retry          *RetrySpec          `json:"retry,omitempty"`
+	CircuitBreaker *CircuitBreakerSpec `json:"circuitBreaker,omitempty"`
+	Transport      *TransportSpec      `json:"transport,omitempty"`
+	Cache          *CacheSpec          `json:"cache,omitempty"`
+	Mirror         *MirrorSpec         `json:"mirror,omitempty"`
+	Canary         *CanarySpec         `json:"canary,omitempty"`
+	Limits         *LimitsSpec         `json:"limits,omitempty"`
+	WebSocket      *WebSocketSpec      `json:"webSocket,omitempty"`
+	Tunnel         *TunnelConfig       `json:"tunnel,omitempty"`
+	FlushInterval  Duration            `json:"flushInterval,omitempty"`
+	GRPC           *GRPCConfig         `json:"grpc,omitempty"`
+}
+
+// ConnectSpec is the configuration file form of a ConnectConfig
+type ConnectSpec struct {
+	AllowedDestinations []string `json:"allowedDestinations"`
+	DialTimeout         Duration `json:"dialTimeout,omitempty"`
+}
+
+// WebSocketSpec is the configuration file form of a WebSocketConfig
+type WebSocketSpec struct {
+	HandshakeTimeout  Duration `json:"handshakeTimeout,omitempty"`
+	WriteTimeout      Duration `json:"writeTimeout,omitempty"`
+	AllowedOrigins    []string `json:"allowedOrigins,omitempty"`
+	MaxMessageSize    int64    `json:"maxMessageSize,omitempty"`
+	IdleTimeout       Duration `json:"idleTimeout,omitempty"`
+	ReadBufferSize    int      `json:"readBufferSize,omitempty"`
+	WriteBufferSize   int      `json:"writeBufferSize,omitempty"`
+	EnableCompression bool     `json:"enableCompression,omitempty"`
+	MaxConnections    int      `json:"maxConnections,omitempty"`
+}
+
+// LimitsSpec is the configuration file form of Limits
+type LimitsSpec struct {
+	ResponseTimeout  Duration `json:"responseTimeout,omitempty"`
+	RequestTimeout   Duration `json:"requestTimeout,omitempty"`
+	MaxRequestBody   int64    `json:"maxRequestBody,omitempty"`
+	MaxRequestHeader int64    `json:"maxRequestHeader,omitempty"`
+}
+
+// CanarySpec is the configuration file form of a CanaryConfig
+type CanarySpec struct {
+	Targets            []TargetHost `json:"targets"`
+	Weight             float64      `json:"weight"`
+	OverrideHeader     string       `json:"overrideHeader,omitempty"`
+	OverrideCookie     string       `json:"overrideCookie,omitempty"`
+	StickyCookie       string       `json:"stickyCookie,omitempty"`
+	StickyCookieMaxAge Duration     `json:"stickyCookieMaxAge,omitempty"`
+	StickyHeader       string       `json:"stickyHeader,omitempty"`
+}
+
+// MirrorSpec is the configuration file form of a MirrorConfig
+type MirrorSpec struct {
+	Target     TargetHost `json:"target"`
+	Percentage float64    `json:"percentage"`
+	MaxBody    int64      `json:"maxBody,omitempty"`
+	Timeout    Duration   `json:"timeout,omitempty"`
+}
+
+// CacheStoreSpec configures the cache store: the responses are kept in a directory when Dir is set,
+// in memory otherwise
+type CacheStoreSpec struct {
+	// MaxSize is the maximum size in bytes of the in-memory store (64MB when 0)
+	MaxSize int64  `json:"maxSize,omitempty"`
+	Dir     string `json:"dir,omitempty"`
+}
+
+// CacheSpec is the configuration file form of a CacheConfig
+type CacheSpec struct {
+	DefaultTTL   Duration `json:"defaultTTL,omitempty"`
+	MaxEntrySize int64    `json:"maxEntrySize,omitempty"`
+}
+
+// RetrySpec is the configuration file form of a RetryPolicy
+type RetrySpec struct {
+	Attempts           int              `json:"attempts"`
+	PerTryTimeout      Duration         `json:"perTryTimeout,omitempty"`
+	BackoffBase        Duration         `json:"backoffBase,omitempty"`
+	BackoffMax         Duration         `json:"backoffMax,omitempty"`
+	RetryOn            []RetryCondition `json:"retryOn,omitempty"`
+	RetryNonIdempotent bool             `json:"retryNonIdempotent,omitempty"`
+	MaxBufferedBody    int64            `json:"maxBufferedBody,omitempty"`
+}
+
+// CircuitBreakerSpec is the configuration file form of a CircuitBreakerConfig
+type CircuitBreakerSpec struct {
+	Window             Duration `json:"window,omitempty"`
+	MinRequests        int      `json:"minRequests,omitempty"`
+	ErrorRateThreshold float64  `json:"errorRateThreshold,omitempty"`
+	LatencyThreshold   Duration `json:"latencyThreshold,omitempty"`
+	SlowRateThreshold  float64  `json:"slowRateThreshold,omitempty"`
+	OpenTimeout        Duration `json:"openTimeout,omitempty"`
+	HalfOpenRequests   int      `json:"halfOpenRequests,omitempty"`
+}
+
+// TransportSpec is the configuration file form of a TransportConfig
+type TransportSpec struct {
+	MaxIdleConns          int      `json:"maxIdleConns,omitempty"`
+	MaxIdleConnsPerHost   int      `json:"maxIdleConnsPerHost,omitempty"`
+	MaxConnsPerHost       int      `json:"maxConnsPerHost,omitempty"`
+	IdleConnTimeout       Duration `json:"idleConnTimeout,omitempty"`
+	DialTimeout           Duration `json:"dialTimeout,omitempty"`
+	KeepAlive             Duration `json:"keepAlive,omitempty"`
+	TLSHandshakeTimeout   Duration `json:"tlsHandshakeTimeout,omitempty"`
+	ResponseHeaderTimeout Duration `json:"responseHeaderTimeout,omitempty"`
+	DisableHTTP2          bool     `json:"disableHTTP2,omitempty"`
+	RootCAFile            string   `json:"rootCAFile,omitempty"`
+	ClientCertFile        string   `json:"clientCertFile,omitempty"`
+	ClientKeyFile         string   `json:"clientKeyFile,omitempty"`
+	InsecureSkipVerify    bool     `json:"insecureSkipVerify,omitempty"`
+}
+
+// Duration is a time.Duration written in the configuration file as a string like "1.5s" or "300ms"
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations must be strings like \"2s\", found %s", data)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig reads and validates a configuration file: files with the .json extension are parsed as JSON,
+// all the others as YAML
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data, strings.EqualFold(filepath.Ext(path), ".json"))
+}
+
+// ParseConfig parses and validates a configuration in JSON or YAML format. Unknown fields are rejected.
+func ParseConfig(data []byte, isJSON bool) (*Config, error) {
+	if !isJSON {
+		// the YAML document is converted to JSON, so that both formats share the same schema
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("invalid YAML: %w", err)
+		}
+		converted, err := json.Marshal(doc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid YAML: %w", err)
+		}
+		data = converted
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var cfg Config
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the configuration, returning all the problems found
+func (cfg *Config) Validate() error {
+	var errs []error
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if cfg.ForwardedHeaders != nil {
+		for i, proxy := range cfg.ForwardedHeaders.TrustedProxies {
+			if _, err := parseIPNet(proxy); err != nil {
+				fail(fmt.Sprintf("forwardedHeaders.trustedProxies[%d]", i), "%v", err)
+			}
+		}
+	}
+	if cfg.Cache != nil && cfg.Cache.MaxSize < 0 {
+		fail("cache.maxSize", "can't be negative")
+	}
+	if c := cfg.Connect; c != nil {
+		if len(c.AllowedDestinations) == 0 {
+			fail("connect.allowedDestinations", "at least one destination is required")
+		}
+		if c.DialTimeout < 0 {
+			fail("connect.dialTimeout", "can't be negative")
+		}
+	}
+	validateRoutes("routes", cfg.Routes, fail)
+
+	hosts := map[VirtualHost]bool{}
+	for i, vh := range cfg.VirtualHosts {
+		field := fmt.Sprintf("virtualHosts[%d]", i)
+		host := normalizeVirtualHost(vh.Host)
+		switch {
+		case host == "":
+			fail(field+".host", "is required")
+		case strings.Contains(strings.TrimPrefix(string(host), "*."), "*"):
+			fail(field+".host", "only a leading wildcard like *.example.com is allowed")
+		case hosts[host]:
+			fail(field+".host", "duplicate virtual host %s", host)
+		}
+		hosts[host] = true
+		if (vh.CertFile == "") != (vh.KeyFile == "") {
+			fail(field, "certFile and keyFile must be set together")
+		}
+		validateRoutes(field+".routes", vh.Routes, fail)
+	}
+	return errors.Join(errs...)
+}
+
+func validateTarget(field string, target TargetHost, fail func(field, format string, args ...interface{})) {
+	if scheme, _, found := strings.Cut(string(target), "://"); found {
+		switch strings.TrimSpace(scheme) {
+		case "http", "https", "ws", "wss":
+		default:
+			fail(field, "unsupported scheme %q", scheme)
+			return
+		}
+	}
+	if u, err := url.Parse(string(normalizeTargetHost(target))); err != nil || u.Host == "" {
+		fail(field, "invalid target URL %q", target)
+	}
+}
+
+func validateRoutes(field string, routes []RouteSpec, fail func(field, format string, args ...interface{})) {
+	prefixes := map[PathPrefix]bool{}
+	for i, r := range routes {
+		field := fmt.Sprintf("%s[%d]", field, i)
+		if strings.TrimSpace(string(r.Prefix)) == "" {
+			fail(field+".prefix", "is required")
+		} else if prefix := normalizePathPrefix(r.Prefix); prefixes[prefix] {
+			fail(field+".prefix", "duplicate prefix %s", prefix)
+		} else {
+			prefixes[prefix] = true
+		}
+
+		if len(r.Targets) == 0 {
+			fail(field+".targets", "at least one target is required")
+		}
+		for j, target := range r.Targets {
+			validateTarget(fmt.Sprintf("%s.targets[%d]", field, j), target, fail)
+		}
+
+		if rw := r.PathRewrite; rw != nil {
+			if _, err := regexp.Compile(rw.Regex); err != nil {
+				fail(field+".pathRewrite.regex", "%v", err)
+			}
+			if rw.Regex == "" && rw.Replacement != "" {
+				fail(field+".pathRewrite.replacement", "requires a regex")
+			}
+		}
+
+		if h := r.Headers; h != nil {
+			for _, ops := range []struct {
+				field string
+				ops   HeaderOps
+			}{{"request", h.Request}, {"response", h.Response}} {
+				for name, attr := range ops.ops.Copy {
+					if err := validateRequestAttribute(attr); err != nil {
+						fail(fmt.Sprintf("%s.headers.%s.copy.%s", field, ops.field, name), "%v", err)
+					}
+				}
+			}
+		}
+
+		if l := r.Limits; l != nil && (l.ResponseTimeout < 0 || l.RequestTimeout < 0 || l.MaxRequestBody < 0 || l.MaxRequestHeader < 0) {
+			fail(field+".limits", "responseTimeout, requestTimeout, maxRequestBody and maxRequestHeader can't be negative")
+		}
+
+		if ws := r.WebSocket; ws != nil {
+			if ws.HandshakeTimeout < 0 || ws.WriteTimeout < 0 || ws.IdleTimeout < 0 {
+				fail(field+".webSocket", "handshakeTimeout, writeTimeout and idleTimeout can't be negative")
+			}
+			if ws.MaxMessageSize < 0 || ws.ReadBufferSize < 0 || ws.WriteBufferSize < 0 || ws.MaxConnections < 0 {
+				fail(field+".webSocket", "maxMessageSize, readBufferSize, writeBufferSize and maxConnections can't be negative")
+			}
+		}
+
+		if c := r.Canary; c != nil {
+			if len(c.Targets) == 0 {
+				fail(field+".canary.targets", "at least one target is required")
+			}
+			for j, target := range c.Targets {
+				validateTarget(fmt.Sprintf("%s.canary.targets[%d]", field, j), target, fail)
+			}
+			if c.Weight < 0 || c.Weight > 100 {
+				fail(field+".canary.weight", "must be between 0 and 100")
+			}
+		}
+
+		if m := r.Mirror; m != nil {
+			validateTarget(field+".mirror.target", m.Target, fail)
+			if m.Percentage < 0 || m.Percentage > 100 {
+				fail(field+".mirror.percentage", "must be between 0 and 100")
+			}
+		}
+
+		if c := r.Cache; c != nil && (c.DefaultTTL < 0 || c.MaxEntrySize < 0) {
+			fail(field+".cache", "defaultTTL and maxEntrySize can't be negative")
+		}
+
+		if rt := r.Retry; rt != nil {
+			if rt.Attempts < 0 {
+				fail(field+".retry.attempts", "can't be negative")
+			}
+			if rt.PerTryTimeout < 0 || rt.BackoffBase < 0 || rt.BackoffMax < 0 {
+				fail(field+".retry", "durations can't be negative")
+			}
+			for j, cond := range rt.RetryOn {
+				switch cond {
+				case RetryOnConnectError, RetryOnTimeout, RetryOn502, RetryOn503, RetryOn504:
+				default:
+					fail(fmt.Sprintf("%s.retry.retryOn[%d]", field, j), "unknown condition %q", cond)
+				}
+			}
+		}
+
+		if cb := r.CircuitBreaker; cb != nil {
+			if cb.ErrorRateThreshold < 0 || cb.ErrorRateThreshold > 1 || cb.SlowRateThreshold < 0 || cb.SlowRateThreshold > 1 {
+				fail(field+".circuitBreaker", "thresholds must be between 0 and 1")
+			}
+			if cb.Window < 0 || cb.LatencyThreshold < 0 || cb.OpenTimeout < 0 {
+				fail(field+".circuitBreaker", "durations can't be negative")
+			}
+		}
+
+		if tr := r.Transport; tr != nil && (tr.ClientCertFile == "") != (tr.ClientKeyFile == "") {
+			fail(field+".transport", "clientCertFile and clientKeyFile must be set together")
+		}
+	}
+}
+
+func (spec *TransportSpec) transportConfig() TransportConfig {
+	return TransportConfig{
+		MaxIdleConns:          spec.MaxIdleConns,
+		MaxIdleConnsPerHost:   spec.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       spec.MaxConnsPerHost,
+		IdleConnTimeout:       time.Duration(spec.IdleConnTimeout),
+		DialTimeout:           time.Duration(spec.DialTimeout),
+		KeepAlive:             time.Duration(spec.KeepAlive),
+		TLSHandshakeTimeout:   time.Duration(spec.TLSHandshakeTimeout),
+		ResponseHeaderTimeout: time.Duration(spec.ResponseHeaderTimeout),
+		DisableHTTP2:          spec.DisableHTTP2,
+		RootCAFile:            spec.RootCAFile,
+		ClientCertFile:        spec.ClientCertFile,
+		ClientKeyFile:         spec.ClientKeyFile,
+		InsecureSkipVerify:    spec.InsecureSkipVerify,
+	}
+}
+
+// routeConfig converts the specification of a route to its RouteConfig
+func (spec RouteSpec) routeConfig() RouteConfig {
+	cfg := RouteConfig{
+		Targets:       spec.Targets[1:],
+		PathRewrite:   spec.PathRewrite,
+		Headers:       spec.Headers,
+		Tunnel:        spec.Tunnel,
+		FlushInterval: time.Duration(spec.FlushInterval),
+		GRPC:          spec.GRPC,
+	}
+	if rt := spec.Retry; rt != nil {
+		cfg.Retry = &RetryPolicy{
+			Attempts:           rt.Attempts,
+			PerTryTimeout:      time.Duration(rt.PerTryTimeout),
+			BackoffBase:        time.Duration(rt.BackoffBase),
+			BackoffMax:         time.Duration(rt.BackoffMax),
+			RetryOn:            rt.RetryOn,
+			RetryNonIdempotent: rt.RetryNonIdempotent,
+			MaxBufferedBody:    rt.MaxBufferedBody,
+		}
+	}
+	if cb := spec.CircuitBreaker; cb != nil {
+		cfg.CircuitBreaker = &CircuitBreakerConfig{
+			Window:             time.Duration(cb.Window),
+			MinRequests:        cb.MinRequests,
+			ErrorRateThreshold: cb.ErrorRateThreshold,
+			LatencyThreshold:   time.Duration(cb.LatencyThreshold),
+			SlowRateThreshold:  cb.SlowRateThreshold,
+			OpenTimeout:        time.Duration(cb.OpenTimeout),
+			HalfOpenRequests:   cb.HalfOpenRequests,
+		}
+	}
+	if spec.Transport != nil {
+		transport := spec.Transport.transportConfig()
+		cfg.Transport = &transport
+	}
+	if l := spec.Limits; l != nil {
+		cfg.Limits = &Limits{
+			ResponseTimeout:  time.Duration(l.ResponseTimeout),
+			RequestTimeout:   time.Duration(l.RequestTimeout),
+			MaxRequestBody:   l.MaxRequestBody,
+			MaxRequestHeader: l.MaxRequestHeader,
+		}
+	}
+	if ws := spec.WebSocket; ws != nil {
+		cfg.WebSocket = &WebSocketConfig{
+			HandshakeTimeout:  time.Duration(ws.HandshakeTimeout),
+			WriteTimeout:      time.Duration(ws.WriteTimeout),
+			AllowedOrigins:    ws.AllowedOrigins,
+			MaxMessageSize:    ws.MaxMessageSize,
+			IdleTimeout:       time.Duration(ws.IdleTimeout),
+			ReadBufferSize:    ws.ReadBufferSize,
+			WriteBufferSize:   ws.WriteBufferSize,
+			EnableCompression: ws.EnableCompression,
+			MaxConnections:    ws.MaxConnections,
+		}
+	}
+	if c := spec.Canary; c != nil {
+		cfg.Canary = &CanaryConfig{
+			Targets:            c.Targets,
+			Weight:             c.Weight,
+			OverrideHeader:     c.OverrideHeader,
+			OverrideCookie:     c.OverrideCookie,
+			StickyCookie:       c.StickyCookie,
+			StickyCookieMaxAge: time.Duration(c.StickyCookieMaxAge),
+			StickyHeader:       c.StickyHeader,
+		}
+	}
+	if m := spec.Mirror; m != nil {
+		cfg.Mirror = &MirrorConfig{Target: m.Target, Percentage: m.Percentage, MaxBody: m.MaxBody, Timeout: time.Duration(m.Timeout)}
+	}
+	if spec.Cache != nil {
+		cfg.Cache = &CacheConfig{DefaultTTL: time.Duration(spec.Cache.DefaultTTL), MaxEntrySize: spec.Cache.MaxEntrySize}
+	}
+	return cfg
+}
+
+// store creates the cache store described by the specification
+func (spec *CacheStoreSpec) store() (CacheStore, error) {
+	if spec.Dir != "" {
+		return NewFileCacheStore(spec.Dir)
+	}
+	size := spec.MaxSize
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+	return NewMemoryCacheStore(size), nil
+}
+
+// buildTable creates a routing table from a validated configuration: the routes of the old table with the same
+// virtual host and PathPrefix are replaced by the new ones, which keep the state of their targets. The old table
+// isn't changed: the targets whose weight and runtime state are to be reset once the new table is in use are
+// returned instead. On error, the transports created for the new table are closed.
+func (rp *ReverseProxy) buildTable(cfg *Config, old *routingTable) (_ *routingTable, _ []*target, err error) {
+	transportCfg := TransportConfig{}
+	if cfg.Transport != nil {
+		transportCfg = cfg.Transport.transportConfig()
+	}
+	transport := old.transport
+	if transportCfg != old.transportConfig {
+		transport, err = NewTransport(transportCfg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid transport configuration: %w", err)
+		}
+	}
+	table := newRoutingTable(transport, transportCfg)
+	var reset []*target
+	defer func() {
+		if err != nil {
+			closeReplacedTransports(table, old)
+		}
+	}()
+
+	addRoutes := func(host VirtualHost, specs []RouteSpec) error {
+		vh := table.virtualHost(host)
+		for _, spec := range specs {
+			var prev *route
+			if _, r, err := findRoute(old, host, spec.Prefix); err == nil {
+				prev = r
+			}
+			r, err := rp.buildRoute(table, host, spec, prev)
+			// a route failing its setup is added too, so that its transports are closed with the others
+			vh.addRoute(r)
+			if err != nil {
+				return err
+			}
+			if prev != nil {
+				for _, pool := range []*targetPool{r.pool, r.canaryPool} {
+					if pool != nil {
+						reset = append(reset, pool.targets...)
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := addRoutes("", cfg.Routes); err != nil {
+		return nil, nil, err
+	}
+	for _, spec := range cfg.VirtualHosts {
+		host := normalizeVirtualHost(spec.Host)
+		if err := addRoutes(host, spec.Routes); err != nil {
+			return nil, nil, err
+		}
+		if spec.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(spec.CertFile, spec.KeyFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error loading certificate of virtual host %s: %w", host, err)
+			}
+			table.virtualHost(host).certificate = &cert
+		}
+	}
+	return table, reset, nil
+}
+
+// buildRoute creates a route of the given routing table from its validated specification. When the route
+// replaces prev, the targets still present keep their stats, health and circuit breaker, and the open
+// WebSocket connections still count. The route is returned also when its setup fails.
+func (rp *ReverseProxy) buildRoute(table *routingTable, host VirtualHost, spec RouteSpec, prev *route) (*route, error) {
+	r := &route{
+		host:   host,
+		prefix: normalizePathPrefix(spec.Prefix),
+		target: normalizeTargetHost(spec.Targets[0]),
+		config: spec.routeConfig(),
+	}
+	return r, rp.setupRoute(table, r, prev)
+}
+
+// ApplyConfig replaces the whole routing table of the reverse proxy with the one described by the configuration,
+// discarding also the changes made at runtime through the admin API: the weights and the states set at runtime
+// are reset. The targets of the routes still present keep their stats, health and circuit breaker state, and the
+// open WebSocket connections still count.
+// The swap is atomic: the in-flight requests complete on the previous routes, and on error nothing is changed.
+// The certificates set with WithVirtualHostCertificate or StartTLS are kept for the virtual hosts without one.
+func (rp *ReverseProxy) ApplyConfig(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	// the table is built under the lock, so that no runtime change is lost between the build and the swap
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	// the cache store is replaced only when its configuration changes, keeping the cached responses
+	var cache *responseCache
+	if current := rp.cache.Load(); cfg.Cache != nil && (current.spec == nil || *current.spec != *cfg.Cache) {
+		store, err := cfg.Cache.store()
+		if err != nil {
+			return fmt.Errorf("invalid cache configuration: %w", err)
+		}
+		cache = newResponseCache(store)
+		spec := *cfg.Cache
+		cache.spec = &spec
+	}
+
+	old := rp.table.Load()
+	table, reset, err := rp.buildTable(cfg, old)
+	if err != nil {
+		return err
+	}
+	fwd := &forwarder{}
+	if cfg.ForwardedHeaders != nil {
+		fwd.useForwarded = cfg.ForwardedHeaders.UseForwarded
+		for _, proxy := range cfg.ForwardedHeaders.TrustedProxies {
+			ipNet, _ := parseIPNet(proxy)
+			fwd.trusted = append(fwd.trusted, ipNet)
+		}
+	}
+	for name, vh := range old.hosts {
+		if vh.certificate != nil && (table.hosts[name] == nil || table.hosts[name].certificate == nil) {
+			table.virtualHost(name).certificate = vh.certificate
+		}
+	}
+
+	if cache != nil {
+		rp.cache.Store(cache)
+	}
+	rp.table.Store(table)
+	for _, t := range reset {
+		t.weight.Store(1)
+		t.disabled.Store(false)
+	}
+	rp.forwarder.Store(fwd)
+	var connect *ConnectConfig
+	if cfg.Connect != nil {
+		connect = &ConnectConfig{AllowedDestinations: cfg.Connect.AllowedDestinations, DialTimeout: time.Duration(cfg.Connect.DialTimeout)}
+	}
+	rp.connect.Store(connect)
+	closeReplacedTransports(old, table)
+	return nil
+}
+
+// NewFromConfigFile creates a reverse proxy from a YAML or JSON configuration file
+func NewFromConfigFile(path string) (*ReverseProxy, error) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	rp := New(PathPrefixRoutesMap{})
+	if err := rp.ApplyConfig(cfg); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// WatchConfigFile checks the configuration file every interval (2s when 0) and applies it when its content changes,
+// until the context is done. An invalid configuration is rejected and logged, and the reverse proxy keeps the
+// previous one.
+func (rp *ReverseProxy) WatchConfigFile(ctx context.Context, path string, interval time.Duration) *ReverseProxy {
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	var last [sha256.Size]byte
+	if data, err := os.ReadFile(path); err == nil {
+		last = sha256.Sum256(data)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			sum := sha256.Sum256(data)
+			if sum == last {
+				continue
+			}
+			last = sum
+
+			cfg, err := ParseConfig(data, strings.EqualFold(filepath.Ext(path), ".json"))
+			if err == nil {
+				err = rp.ApplyConfig(cfg)
+			}
+			if err != nil {
+				log.Printf("Rejected configuration reload from %s, keeping the previous one: %v", path, err)
+				continue
+			}
+			log.Printf("Reloaded configuration from %s", path)
+		}
+	}()
+	return rp
+}
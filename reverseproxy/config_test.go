@@ -0,0 +1,315 @@
+package reverseproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	yamlDoc := `
+routes:
+  - prefix: /weather/
+    targets: ["https://api.weather.com", "api2.weather.com"]
+    retry: {attempts: 3, perTryTimeout: 2s, retryOn: [connect-error, "503"]}
+    circuitBreaker: {minRequests: 10, openTimeout: 1m}
+virtualHosts:
+  - host: "*.tenant.example.com"
+    routes:
+      - prefix: /
+        targets: ["http://tenants:8080"]
+`
+	jsonDoc := `{"routes": [{"prefix": "/weather/", "targets": ["https://api.weather.com", "api2.weather.com"],
+		"retry": {"attempts": 3, "perTryTimeout": "2s", "retryOn": ["connect-error", "503"]},
+		"circuitBreaker": {"minRequests": 10, "openTimeout": "1m"}}],
+		"virtualHosts": [{"host": "*.tenant.example.com", "routes": [{"prefix": "/", "targets": ["http://tenants:8080"]}]}]}`
+
+	for name, doc := range map[string]struct {
+		data   string
+		isJSON bool
+	}{"yaml": {yamlDoc, false}, "json": {jsonDoc, true}} {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := ParseConfig([]byte(doc.data), doc.isJSON)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cfg.Routes) != 1 || len(cfg.VirtualHosts) != 1 {
+				t.Fatalf("got %d routes and %d virtual hosts, want 1 and 1", len(cfg.Routes), len(cfg.VirtualHosts))
+			}
+			rc := cfg.Routes[0].routeConfig()
+			if rc.Retry.Attempts != 3 || rc.Retry.PerTryTimeout != 2*time.Second || len(rc.Retry.RetryOn) != 2 {
+				t.Errorf("retry = %+v", rc.Retry)
+			}
+			if rc.CircuitBreaker.MinRequests != 10 || rc.CircuitBreaker.OpenTimeout != time.Minute {
+				t.Errorf("circuitBreaker = %+v", rc.CircuitBreaker)
+			}
+			if len(rc.Targets) != 1 || rc.Targets[0] != "api2.weather.com" {
+				t.Errorf("targets = %v, want the targets after the first one", rc.Targets)
+			}
+		})
+	}
+}
+
+func TestParseConfigRejectsUnknownFields(t *testing.T) {
+	_, err := ParseConfig([]byte("routes:\n  - prefix: /a/\n    targets: [http://a]\n    retires: {attempts: 2}\n"), false)
+	if err == nil || !strings.Contains(err.Error(), "retires") {
+		t.Errorf("error = %v, want the unknown field", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want []string
+	}{
+		{name: "missing prefix and targets", yaml: "routes: [{targets: []}]",
+			want: []string{"routes[0].prefix: is required", "routes[0].targets: at least one target is required"}},
+		{name: "duplicate prefix", yaml: "routes: [{prefix: /a, targets: [http://a]}, {prefix: /a/, targets: [http://b]}]",
+			want: []string{"routes[1].prefix: duplicate prefix"}},
+		{name: "unsupported scheme", yaml: "routes: [{prefix: /a/, targets: [ftp://a]}]",
+			want: []string{`routes[0].targets[0]: unsupported scheme "ftp"`}},
+		{name: "invalid regex", yaml: "routes: [{prefix: /a/, targets: [http://a], pathRewrite: {regex: '('}}]",
+			want: []string{"routes[0].pathRewrite.regex"}},
+		{name: "unknown retry condition", yaml: "routes: [{prefix: /a/, targets: [http://a], retry: {attempts: 2, retryOn: [always]}}]",
+			want: []string{`routes[0].retry.retryOn[0]: unknown condition "always"`}},
+		{name: "breaker threshold", yaml: "routes: [{prefix: /a/, targets: [http://a], circuitBreaker: {errorRateThreshold: 2}}]",
+			want: []string{"routes[0].circuitBreaker: thresholds must be between 0 and 1"}},
+		{name: "canary weight", yaml: "routes: [{prefix: /a/, targets: [http://a], canary: {targets: [http://b], weight: 120}}]",
+			want: []string{"routes[0].canary.weight: must be between 0 and 100"}},
+		{name: "virtual host", yaml: "virtualHosts: [{host: 'a.*.com', certFile: a.pem, routes: []}]",
+			want: []string{"virtualHosts[0].host: only a leading wildcard", "virtualHosts[0]: certFile and keyFile must be set together"}},
+		{name: "trusted proxy", yaml: "forwardedHeaders: {trustedProxies: [not-an-ip]}",
+			want: []string{"forwardedHeaders.trustedProxies[0]"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(tt.yaml), false)
+			if err == nil {
+				t.Fatal("the configuration was accepted")
+			}
+			// all the problems are reported together
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func mustParseConfig(t *testing.T, doc string) *Config {
+	t.Helper()
+	cfg, err := ParseConfig([]byte(doc), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestApplyConfigKeepsState(t *testing.T) {
+	rp := New(PathPrefixRoutesMap{}).WithAccessLogger(nil)
+	cfg := mustParseConfig(t, `
+routes:
+  - prefix: /a/
+    targets: [http://a1, http://a2]
+    circuitBreaker: {minRequests: 1}
+    webSocket: {maxConnections: 10}
+`)
+	if err := rp.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	_, before, _ := findRoute(rp.table.Load(), "", "/a/")
+	a1 := before.pool.find("http://a1")
+	a1.requests.Add(5)
+	a1.breaker.Allow()
+	a1.breaker.Record(true, time.Millisecond)
+	before.wsConns.Add(3)
+	if err := rp.SetTargetWeight("", "/a/", "http://a2", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new route and a new target don't affect the ones unchanged
+	if err := rp.ApplyConfig(mustParseConfig(t, `
+routes:
+  - prefix: /a/
+    targets: [http://a1, http://a2, http://a3]
+    circuitBreaker: {minRequests: 1}
+    webSocket: {maxConnections: 10}
+  - prefix: /b/
+    targets: [http://b]
+`)); err != nil {
+		t.Fatal(err)
+	}
+	_, after, _ := findRoute(rp.table.Load(), "", "/a/")
+	if after == before {
+		t.Fatal("the route wasn't rebuilt")
+	}
+	if got := after.pool.find("http://a1"); got != a1 || got.requests.Load() != 5 {
+		t.Error("the stats of the target weren't kept")
+	}
+	if state := after.pool.find("http://a1").breaker.State(); state != CircuitOpen {
+		t.Errorf("breaker state = %s, want open", state)
+	}
+	if got := after.wsConns.Load(); got != 3 {
+		t.Errorf("open WebSocket connections = %d, want 3", got)
+	}
+	if got := after.pool.find("http://a2").weight.Load(); got != 1 {
+		t.Errorf("weight set at runtime = %d, want it reset to 1", got)
+	}
+
+	// a different circuit breaker configuration starts from new breakers
+	if err := rp.ApplyConfig(mustParseConfig(t, `
+routes:
+  - prefix: /a/
+    targets: [http://a1]
+    circuitBreaker: {minRequests: 5}
+`)); err != nil {
+		t.Fatal(err)
+	}
+	_, changed, _ := findRoute(rp.table.Load(), "", "/a/")
+	if state := changed.pool.find("http://a1").breaker.State(); state != CircuitClosed {
+		t.Errorf("breaker state = %s with a new configuration, want closed", state)
+	}
+}
+
+func TestApplyConfigClosesReplacedTransports(t *testing.T) {
+	closed := make(chan struct{}, 10)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	rp := New(PathPrefixRoutesMap{}).WithAccessLogger(nil)
+	routes := "routes: [{prefix: /a/, targets: [" + upstream.URL + "], transport: {maxIdleConns: %s}}]"
+	if err := rp.ApplyConfig(mustParseConfig(t, strings.Replace(routes, "%s", "10", 1))); err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(rp.handler(), http.MethodGet, "/a/"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+
+	// the same transport configuration keeps the transport and its connections
+	_, before, _ := findRoute(rp.table.Load(), "", "/a/")
+	if err := rp.ApplyConfig(mustParseConfig(t, strings.Replace(routes, "%s", "10", 1))); err != nil {
+		t.Fatal(err)
+	}
+	if _, after, _ := findRoute(rp.table.Load(), "", "/a/"); after.transport != before.transport {
+		t.Error("the unchanged transport of the route was replaced")
+	}
+	shared := rp.table.Load().transport
+	if err := rp.ApplyConfig(mustParseConfig(t, strings.Replace(routes, "%s", "10", 1))); err != nil {
+		t.Fatal(err)
+	}
+	if rp.table.Load().transport != shared {
+		t.Error("the unchanged shared transport was replaced")
+	}
+
+	if err := rp.ApplyConfig(mustParseConfig(t, strings.Replace(routes, "%s", "20", 1))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Error("the idle connection of the replaced transport wasn't closed")
+	}
+}
+
+func TestApplyConfigFailureChangesNothing(t *testing.T) {
+	rp := New(PathPrefixRoutesMap{}).WithAccessLogger(nil)
+	routes := `
+routes:
+  - prefix: /a/
+    targets: [http://a1, http://a2]
+`
+	if err := rp.ApplyConfig(mustParseConfig(t, routes)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rp.SetTargetWeight("", "/a/", "http://a1", 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := rp.SetTargetEnabled("", "/a/", "http://a2", false); err != nil {
+		t.Fatal(err)
+	}
+	table := rp.table.Load()
+
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for name, doc := range map[string]string{
+		"certificate": routes + `
+virtualHosts:
+  - host: example.com
+    certFile: /missing/cert.pem
+    keyFile: /missing/key.pem
+    routes: [{prefix: /, targets: [http://b]}]
+`,
+		"cache dir": routes + "cache: {dir: " + filepath.Join(file, "cache") + "}\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := rp.ApplyConfig(mustParseConfig(t, doc)); err == nil {
+				t.Fatal("the configuration was applied")
+			}
+			if rp.table.Load() != table {
+				t.Error("the routing table was replaced")
+			}
+			_, r, _ := findRoute(rp.table.Load(), "", "/a/")
+			if got := r.pool.find("http://a1").weight.Load(); got != 5 {
+				t.Errorf("weight = %d, want 5", got)
+			}
+			if !r.pool.find("http://a2").disabled.Load() {
+				t.Error("the disabled target was enabled")
+			}
+		})
+	}
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.yaml")
+	write := func(prefix string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte("routes: [{prefix: "+prefix+", targets: [http://a]}]"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("/a/")
+	proxy, err := NewFromConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.WithAccessLogger(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	proxy.WatchConfigFile(ctx, path, 10*time.Millisecond)
+
+	routed := func(prefix PathPrefix) bool {
+		_, _, err := findRoute(proxy.table.Load(), "", prefix)
+		return err == nil
+	}
+	write("/b/")
+	deadline := time.Now().Add(2 * time.Second)
+	for !routed("/b/") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !routed("/b/") || routed("/a/") {
+		t.Fatal("the changed file wasn't applied")
+	}
+
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	write("/c/")
+	time.Sleep(100 * time.Millisecond)
+	if routed("/c/") {
+		t.Error("the file was applied after the watch was stopped")
+	}
+}
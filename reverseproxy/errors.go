@@ -0,0 +1,179 @@
+package reverseproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/gyozatech/temaki"
+)
+
+// ErrorKind classifies the errors of the reverse proxy
+type ErrorKind string
+
+const (
+	ErrorKindNoRoute               ErrorKind = "no_route"
+	ErrorKindRouteDisabled         ErrorKind = "route_disabled"
+	ErrorKindCircuitOpen           ErrorKind = "circuit_open"
+	ErrorKindNoTarget              ErrorKind = "no_target"
+	ErrorKindTimeout               ErrorKind = "timeout"
+	ErrorKindConnectionRefused     ErrorKind = "connection_refused"
+	ErrorKindBodyTooLarge          ErrorKind = "body_too_large"
+	ErrorKindHeaderTooLarge        ErrorKind = "header_too_large"
+	ErrorKindOriginNotAllowed      ErrorKind = "origin_not_allowed"
+	ErrorKindTooManyConnections    ErrorKind = "too_many_connections"
+	ErrorKindDestinationNotAllowed ErrorKind = "destination_not_allowed"
+	ErrorKindClientClosed          ErrorKind = "client_closed"
+	ErrorKindUpstream              ErrorKind = "upstream_error"
+	ErrorKindInternal              ErrorKind = "internal_error"
+)
+
+// StatusClientClosedRequest is the status of the requests canceled by their clients, as used by nginx:
+// it's only logged, as the clients are gone
+const StatusClientClosedRequest = 499
+
+// ProxyError is an error of the reverse proxy, classified with the status answered to the client
+type ProxyError struct {
+	Kind   ErrorKind
+	Status int
+	// Detail describes the error without any internal detail, like the host names of the targets,
+	// so that it can be shown to the clients
+	Detail string
+	// Route is the route of the request, empty when no route matched
+	Route string
+	// CorrelationID identifies the request in the logs, as returned by temaki.RequestID
+	CorrelationID string
+	// Err is the underlying error, which must not be shown to the clients
+	Err error
+}
+
+func (e *ProxyError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s: %s", e.Kind, e.Detail)
+	}
+	return fmt.Sprintf("%s: %s: %v", e.Kind, e.Detail, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorHandler writes the response of a request failed by the reverse proxy
+type ErrorHandler func(w http.ResponseWriter, req *http.Request, perr *ProxyError)
+
+// WithErrorHandler replaces the default error handler, ProblemErrorHandler. The errors are logged
+// with their full detail before the handler is called, and the requests canceled by their clients
+// are only logged.
+func (rp *ReverseProxy) WithErrorHandler(handler ErrorHandler) *ReverseProxy {
+	rp.errorHandler = handler
+	return rp
+}
+
+// problem is a problem details document, as defined by RFC 9457
+type problem struct {
+	Type          string `json:"type"`
+	Title         string `json:"title"`
+	Status        int    `json:"status"`
+	Detail        string `json:"detail"`
+	Instance      string `json:"instance"`
+	Kind          string `json:"kind"`
+	CorrelationID string `json:"correlationId"`
+}
+
+// ProblemErrorHandler is the default ErrorHandler: it answers with a JSON problem document (RFC 9457)
+func ProblemErrorHandler(w http.ResponseWriter, req *http.Request, perr *ProxyError) {
+	title := http.StatusText(perr.Status)
+	if perr.Status == StatusClientClosedRequest {
+		title = "Client Closed Request"
+	}
+	body, _ := json.Marshal(problem{
+		Type:          "about:blank",
+		Title:         title,
+		Status:        perr.Status,
+		Detail:        perr.Detail,
+		Instance:      req.URL.Path,
+		Kind:          string(perr.Kind),
+		CorrelationID: perr.CorrelationID,
+	})
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(perr.Status)
+	_, _ = w.Write(body)
+}
+
+// handleError logs an error of a request with its correlation ID and answers with the error handler,
+// which is given the request as received from the client
+func (rp *ReverseProxy) handleError(w http.ResponseWriter, req *http.Request, perr *ProxyError) {
+	if pr := proxyRequestFrom(req); pr != nil {
+		pr.mu.Lock()
+		pr.errorKind = perr.Kind
+		pr.mu.Unlock()
+	}
+	req = inboundRequest(req)
+	if temaki.RequestID(req) == "" {
+		req = withRequestID(w, req)
+	}
+	perr.CorrelationID = temaki.RequestID(req)
+	w.Header().Set(temaki.RequestIDHeaderOf(req), perr.CorrelationID)
+	log.Printf("[%s] Proxy error %s %s (route %q): %v", perr.CorrelationID, req.Method, req.URL.Path, perr.Route, perr)
+	if perr.Kind == ErrorKindClientClosed {
+		// the client is gone: the access log records the request with StatusClientClosedRequest
+		return
+	}
+
+	handler := rp.errorHandler
+	if handler == nil {
+		handler = ProblemErrorHandler
+		if protocolOf(req.Header) != notGRPC {
+			handler = GRPCErrorHandler
+		}
+	}
+	handler(w, req, perr)
+}
+
+// classifyError maps an error of the proxying of a request to the status answered to the client
+func classifyError(req *http.Request, err error, limits *Limits) *ProxyError {
+	if limits == nil {
+		limits = &Limits{}
+	}
+	var maxBytesErr *http.MaxBytesError
+	var headerErr *RequestHeaderTooLargeError
+	var netErr net.Error
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return &ProxyError{Kind: ErrorKindBodyTooLarge, Status: http.StatusRequestEntityTooLarge, Err: err,
+			Detail: fmt.Sprintf("the request body exceeds the limit of %d bytes", maxBytesErr.Limit)}
+	case errors.As(err, &headerErr):
+		return &ProxyError{Kind: ErrorKindHeaderTooLarge, Status: http.StatusRequestHeaderFieldsTooLarge, Err: err,
+			Detail: fmt.Sprintf("the request header exceeds the limit of %d bytes", headerErr.Limit)}
+	case errors.Is(err, ErrCircuitOpen):
+		return &ProxyError{Kind: ErrorKindCircuitOpen, Status: http.StatusServiceUnavailable, Err: err,
+			Detail: "the service is temporarily unavailable"}
+	case errors.Is(err, ErrNoTargetAvailable):
+		return &ProxyError{Kind: ErrorKindNoTarget, Status: http.StatusServiceUnavailable, Err: err,
+			Detail: "no target is available for the request"}
+	case errors.Is(err, ErrResponseTimeout):
+		return &ProxyError{Kind: ErrorKindTimeout, Status: http.StatusGatewayTimeout, Err: err,
+			Detail: fmt.Sprintf("the service didn't answer within the response timeout of %s", limits.ResponseTimeout)}
+	case errors.Is(context.Cause(req.Context()), ErrRequestTimeout):
+		return &ProxyError{Kind: ErrorKindTimeout, Status: http.StatusGatewayTimeout, Err: context.Cause(req.Context()),
+			Detail: fmt.Sprintf("the request didn't complete within the request timeout of %s", limits.RequestTimeout)}
+	case req.Context().Err() != nil && errors.Is(err, context.Canceled):
+		return &ProxyError{Kind: ErrorKindClientClosed, Status: StatusClientClosedRequest, Err: err,
+			Detail: "the client closed the request"}
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return &ProxyError{Kind: ErrorKindTimeout, Status: http.StatusGatewayTimeout, Err: err,
+			Detail: "the service didn't answer in time"}
+	case errors.Is(err, syscall.ECONNREFUSED) || (errors.As(err, &opErr) && opErr.Op == "dial"):
+		return &ProxyError{Kind: ErrorKindConnectionRefused, Status: http.StatusBadGateway, Err: err,
+			Detail: "the service can't be reached"}
+	}
+	return &ProxyError{Kind: ErrorKindUpstream, Status: http.StatusBadGateway, Err: err,
+		Detail: "the service answered with an invalid response"}
+}
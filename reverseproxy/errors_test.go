@@ -0,0 +1,129 @@
+package reverseproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	limits := &Limits{ResponseTimeout: 5 * time.Second, RequestTimeout: time.Minute}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithTimeoutCause(context.Background(), 0, fmt.Errorf("%w: test", ErrRequestTimeout))
+	defer cancelExpired()
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		err        error
+		wantKind   ErrorKind
+		wantStatus int
+	}{
+		{
+			name:       "connection refused",
+			err:        &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			wantKind:   ErrorKindConnectionRefused,
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "unknown host",
+			err:        &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "target"}},
+			wantKind:   ErrorKindConnectionRefused,
+			wantStatus: http.StatusBadGateway,
+		},
+		{name: "deadline exceeded", err: fmt.Errorf("round trip: %w", context.DeadlineExceeded), wantKind: ErrorKindTimeout, wantStatus: http.StatusGatewayTimeout},
+		{
+			name:       "network timeout",
+			err:        &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded},
+			wantKind:   ErrorKindTimeout,
+			wantStatus: http.StatusGatewayTimeout,
+		},
+		{name: "response timeout", err: fmt.Errorf("%w: test", ErrResponseTimeout), wantKind: ErrorKindTimeout, wantStatus: http.StatusGatewayTimeout},
+		{name: "request timeout", ctx: expired, err: context.DeadlineExceeded, wantKind: ErrorKindTimeout, wantStatus: http.StatusGatewayTimeout},
+		{name: "circuit open", err: fmt.Errorf("target: %w", ErrCircuitOpen), wantKind: ErrorKindCircuitOpen, wantStatus: http.StatusServiceUnavailable},
+		{name: "no target", err: ErrNoTargetAvailable, wantKind: ErrorKindNoTarget, wantStatus: http.StatusServiceUnavailable},
+		{name: "client canceled", ctx: canceled, err: context.Canceled, wantKind: ErrorKindClientClosed, wantStatus: StatusClientClosedRequest},
+		{name: "canceled upstream", err: context.Canceled, wantKind: ErrorKindUpstream, wantStatus: http.StatusBadGateway},
+		{name: "body too large", err: &http.MaxBytesError{Limit: 10}, wantKind: ErrorKindBodyTooLarge, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "header too large", err: &RequestHeaderTooLargeError{Limit: 10}, wantKind: ErrorKindHeaderTooLarge, wantStatus: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "invalid response", err: errors.New("malformed HTTP response"), wantKind: ErrorKindUpstream, wantStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.ctx != nil {
+				req = req.WithContext(tt.ctx)
+			}
+			perr := classifyError(req, tt.err, limits)
+			if perr.Kind != tt.wantKind || perr.Status != tt.wantStatus {
+				t.Errorf("classifyError = %s %d, want %s %d", perr.Kind, perr.Status, tt.wantKind, tt.wantStatus)
+			}
+			if perr.Err == nil || perr.Detail == "" {
+				t.Errorf("classifyError = %+v, want the error and a detail", perr)
+			}
+		})
+	}
+}
+
+func TestClientClosedRequestIsNotAnswered(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	entries := make(chan AccessLog, 1)
+	rp := New(PathPrefixRoutesMap{"/": TargetHost(upstream.URL)}).
+		WithAccessLogger(func(entry AccessLog) { entries <- entry })
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	rp.handler().ServeHTTP(rec, req)
+
+	if rec.Body.Len() != 0 || rec.Header().Get("Content-Type") != "" {
+		t.Errorf("the canceled request was answered: %q", rec.Body.String())
+	}
+	entry := <-entries
+	if entry.Status != StatusClientClosedRequest || entry.Error != ErrorKindClientClosed {
+		t.Errorf("access log status %d, error %q, want %d %s", entry.Status, entry.Error, StatusClientClosedRequest, ErrorKindClientClosed)
+	}
+}
+
+func TestCustomErrorHandler(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	var got []*ProxyError
+	rp := New(PathPrefixRoutesMap{"/down/": TargetHost(closed.URL)}).
+		WithAccessLogger(nil).
+		WithErrorHandler(func(w http.ResponseWriter, req *http.Request, perr *ProxyError) {
+			got = append(got, perr)
+			w.WriteHeader(http.StatusTeapot)
+			fmt.Fprintf(w, "%s %s", perr.Kind, req.URL.Path)
+		})
+
+	tests := map[string]ErrorKind{"/down/x": ErrorKindConnectionRefused, "/missing": ErrorKindNoRoute}
+	for path, wantKind := range tests {
+		got = nil
+		rec := serve(rp.handler(), http.MethodGet, path)
+		if rec.Code != http.StatusTeapot || rec.Body.String() != fmt.Sprintf("%s %s", wantKind, path) {
+			t.Errorf("%s: response %d %q from the custom handler", path, rec.Code, rec.Body.String())
+		}
+		if len(got) != 1 || got[0].CorrelationID == "" || rec.Header().Get("X-Request-ID") != got[0].CorrelationID {
+			t.Errorf("%s: the handler wasn't given the correlation ID of the response", path)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForwardedHeaders configures the forwarding headers sent to the upstreams.
+// When the request comes from a trusted proxy, the forwarding headers it set are kept and the address of the
+// proxy is appended to them. Otherwise they're discarded and replaced with the values of the current request.
+type ForwardedHeaders struct {
+	// TrustedProxies lists the IPs or CIDRs, like 10.0.0.0/8, of the proxies whose forwarding headers are trusted
+	TrustedProxies []string `json:"trustedProxies,omitempty"`
+	// UseForwarded sends the RFC 7239 Forwarded header besides the X-Forwarded-* ones
+	UseForwarded bool `json:"useForwarded,omitempty"`
+}
+
+type forwarder struct {
+	trusted      []*net.IPNet
+	useForwarded bool
+}
+
+// WithForwardedHeaders configures how the forwarding headers are sent to the upstreams.
+// An invalid trusted proxy is returned as error by Start.
+func (rp *ReverseProxy) WithForwardedHeaders(cfg ForwardedHeaders) *ReverseProxy {
+	fwd := &forwarder{useForwarded: cfg.UseForwarded}
+	for _, proxy := range cfg.TrustedProxies {
+		ipNet, err := parseIPNet(proxy)
+		if err != nil {
+			rp.setConfigError(fmt.Errorf("invalid trusted proxy: %w", err))
+			return rp
+		}
+		fwd.trusted = append(fwd.trusted, ipNet)
+	}
+	rp.forwarder.Store(fwd)
+	return rp
+}
+
+// parseIPNet parses a CIDR, or a single IP as a network containing only that IP
+func parseIPNet(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		return ipNet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	bits := 8 * net.IPv4len
+	if ip.To4() == nil {
+		bits = 8 * net.IPv6len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func (f *forwarder) isTrusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range f.trusted {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client: when the request comes from a trusted proxy it's the
+// rightmost address of the X-Forwarded-For chain which doesn't belong to a trusted proxy
+func (f *forwarder) clientIP(req *http.Request, peer string) string {
+	if !f.isTrusted(peer) {
+		return peer
+	}
+	chain := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(chain[i])
+		if ip != "" && !f.isTrusted(ip) {
+			return ip
+		}
+	}
+	return peer
+}
+
+// apply sets the forwarding headers of the outgoing request, before its Host is changed to the target one
+func (f *forwarder) apply(req *http.Request) {
+	peer, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		peer = req.RemoteAddr
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	trusted := f.isTrusted(peer)
+	req.Header.Set("X-Real-IP", f.clientIP(req, peer))
+	if !trusted {
+		// httputil.ReverseProxy appends the peer address to X-Forwarded-For, which is then the only value
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Forwarded-Host")
+		req.Header.Del("X-Forwarded-Proto")
+		req.Header.Del("Forwarded")
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+
+	if f.useForwarded {
+		element := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(peer), quoteForwarded(req.Host), proto)
+		if prior := strings.Join(req.Header.Values("Forwarded"), ", "); prior != "" {
+			element = prior + ", " + element
+		}
+		req.Header.Set("Forwarded", element)
+	}
+}
+
+// forwardedNode formats an IP as node of the Forwarded header, where IPv6 addresses are bracketed and quoted
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// quoteForwarded quotes a value of the Forwarded header when it contains characters not allowed in a token
+func quoteForwarded(value string) string {
+	if strings.ContainsAny(value, `:[]" ,;=`) {
+		return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+	}
+	return value
+}
@@ -0,0 +1,172 @@
+package reverseproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newForwarder(t *testing.T, useForwarded bool, trusted ...string) *forwarder {
+	t.Helper()
+	f := &forwarder{useForwarded: useForwarded}
+	for _, proxy := range trusted {
+		ipNet, err := parseIPNet(proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.trusted = append(f.trusted, ipNet)
+	}
+	return f
+}
+
+func TestForwarderApply(t *testing.T) {
+	tests := []struct {
+		name       string
+		forwarder  *forwarder
+		remoteAddr string
+		host       string
+		tls        bool
+		header     http.Header
+		// want holds the expected headers, where an empty value means a missing header
+		want map[string]string
+	}{
+		{
+			name:       "untrusted peer with spoofed headers",
+			forwarder:  newForwarder(t, false, "10.0.0.0/8"),
+			remoteAddr: "203.0.113.7:51000",
+			host:       "example.com",
+			header: http.Header{
+				"X-Forwarded-For":   {"1.2.3.4"},
+				"X-Forwarded-Host":  {"evil.com"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {"for=1.2.3.4"},
+			},
+			want: map[string]string{
+				"X-Real-IP":         "203.0.113.7",
+				"X-Forwarded-For":   "",
+				"X-Forwarded-Host":  "example.com",
+				"X-Forwarded-Proto": "http",
+				"Forwarded":         "",
+			},
+		},
+		{
+			name:       "trusted hop chain",
+			forwarder:  newForwarder(t, false, "10.0.0.0/8", "192.168.1.1"),
+			remoteAddr: "10.0.0.2:51000",
+			host:       "example.com",
+			header: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1, 203.0.113.9", "192.168.1.1"},
+				"X-Forwarded-Host":  {"public.example.com"},
+				"X-Forwarded-Proto": {"https"},
+			},
+			want: map[string]string{
+				"X-Real-IP":         "203.0.113.9",
+				"X-Forwarded-For":   "198.51.100.1, 203.0.113.9, 192.168.1.1",
+				"X-Forwarded-Host":  "public.example.com",
+				"X-Forwarded-Proto": "https",
+			},
+		},
+		{
+			name:       "chain of trusted proxies only",
+			forwarder:  newForwarder(t, false, "10.0.0.0/8"),
+			remoteAddr: "10.0.0.2:51000",
+			host:       "example.com",
+			header:     http.Header{"X-Forwarded-For": {"10.0.0.3"}},
+			want:       map[string]string{"X-Real-IP": "10.0.0.2", "X-Forwarded-For": "10.0.0.3"},
+		},
+		{
+			name:       "IPv6 peer with port",
+			forwarder:  newForwarder(t, true),
+			remoteAddr: "[2001:db8::1]:443",
+			host:       "example.com:8443",
+			tls:        true,
+			want: map[string]string{
+				"X-Real-IP":         "2001:db8::1",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         `for="[2001:db8::1]";host="example.com:8443";proto=https`,
+			},
+		},
+		{
+			name:       "trusted IPv6 proxy",
+			forwarder:  newForwarder(t, true, "2001:db8::/32"),
+			remoteAddr: "[2001:db8::1]:443",
+			host:       "example.com",
+			header: http.Header{
+				"X-Forwarded-For": {"198.51.100.1"},
+				"Forwarded":       {"for=198.51.100.1;proto=https"},
+			},
+			want: map[string]string{
+				"X-Real-IP": "198.51.100.1",
+				"Forwarded": `for=198.51.100.1;proto=https, for="[2001:db8::1]";host=example.com;proto=http`,
+			},
+		},
+		{
+			name:       "peer without port",
+			forwarder:  newForwarder(t, true),
+			remoteAddr: "203.0.113.7",
+			host:       "example.com",
+			want:       map[string]string{"X-Real-IP": "203.0.113.7", "Forwarded": "for=203.0.113.7;host=example.com;proto=http"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Host = tt.host
+			req.TLS = nil
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			for name, values := range tt.header {
+				req.Header[name] = values
+			}
+			tt.forwarder.apply(req)
+			for name, want := range tt.want {
+				got := req.Header.Get(name)
+				if name == "X-Forwarded-For" {
+					got = strings.Join(req.Header.Values(name), ", ")
+				}
+				if got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestQuoteForwarded(t *testing.T) {
+	tests := map[string]string{
+		"example.com":      "example.com",
+		"example.com:8080": `"example.com:8080"`,
+		"[2001:db8::1]":    `"[2001:db8::1]"`,
+		`a"b`:              `"a\"b"`,
+		"a b;c":            `"a b;c"`,
+	}
+	for value, want := range tests {
+		if got := quoteForwarded(value); got != want {
+			t.Errorf("quoteForwarded(%q) = %s, want %s", value, got, want)
+		}
+	}
+}
+
+func TestParseIPNet(t *testing.T) {
+	for _, s := range []string{"10.0.0.1", " 10.0.0.0/8 ", "2001:db8::1", "2001:db8::/32"} {
+		ipNet, err := parseIPNet(s)
+		if err != nil {
+			t.Errorf("parseIPNet(%q): %v", s, err)
+			continue
+		}
+		if ip, _, _ := net.ParseCIDR(ipNet.String()); !ipNet.Contains(ip) {
+			t.Errorf("parseIPNet(%q) = %s", s, ipNet)
+		}
+	}
+	if _, err := parseIPNet("10.0.0"); err == nil {
+		t.Error("an invalid IP was accepted")
+	}
+	if _, err := parseIPNet("10.0.0.0/33"); err == nil {
+		t.Error("an invalid CIDR was accepted")
+	}
+}
@@ -0,0 +1,310 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// GRPCConfig proxies the gRPC requests of a route over HTTP/2 to its targets: h2c for the http targets
+// and h2 for the https ones
+type GRPCConfig struct {
+	// Web translates the gRPC-Web requests of the browsers to gRPC, and the responses back to gRPC-Web
+	Web bool `json:"web"`
+}
+
+// grpcProtocol is the protocol of a request given its Content-Type
+type grpcProtocol int
+
+const (
+	notGRPC grpcProtocol = iota
+	grpcNative
+	grpcWeb
+	// grpcWebText is gRPC-Web with base64 encoded bodies
+	grpcWebText
+)
+
+// grpcWebTrailerFlag marks the frame carrying the trailers at the end of a gRPC-Web response
+const grpcWebTrailerFlag = 0x80
+
+// protocolOf tells which gRPC protocol a request or a response uses
+func protocolOf(header http.Header) grpcProtocol {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return notGRPC
+	}
+	subtype, found := strings.CutPrefix(mediaType, "application/grpc")
+	if !found {
+		return notGRPC
+	}
+	// the subtype can be followed by the message format, like application/grpc+proto
+	subtype, _, _ = strings.Cut(subtype, "+")
+	switch subtype {
+	case "":
+		return grpcNative
+	case "-web":
+		return grpcWeb
+	case "-web-text":
+		return grpcWebText
+	}
+	return notGRPC
+}
+
+// isGRPCRequest tells if a request is a gRPC request, gRPC-Web excluded
+func isGRPCRequest(req *http.Request) bool {
+	return protocolOf(req.Header) == grpcNative
+}
+
+// h2Transport is the HTTP/2 only transport of the gRPC requests: h2c for the http targets and h2 for the https ones
+type h2Transport struct {
+	h2  *http2.Transport
+	h2c *http2.Transport
+}
+
+// newGRPCTransport creates the HTTP/2 only transport of the gRPC requests, with the dialing and the TLS
+// configuration of the given transport
+func newGRPCTransport(transport *http.Transport) *h2Transport {
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	tlsConfig := &tls.Config{}
+	if transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+	tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+	return &h2Transport{
+		h2: &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := dial(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				tlsConn := tls.Client(conn, cfg)
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			},
+			IdleConnTimeout: transport.IdleConnTimeout,
+		},
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+			IdleConnTimeout: transport.IdleConnTimeout,
+		},
+	}
+}
+
+func (t *h2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.h2.RoundTrip(req)
+}
+
+func (t *h2Transport) CloseIdleConnections() {
+	t.h2.CloseIdleConnections()
+	t.h2c.CloseIdleConnections()
+}
+
+// grpcTransport sends the gRPC requests through the HTTP/2 transport and the other requests through next
+type grpcTransport struct {
+	next http.RoundTripper
+	h2   http.RoundTripper
+}
+
+func (gt *grpcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isGRPCRequest(req) {
+		// the gRPC targets require the support of the trailers, which the gRPC-Web clients don't announce
+		req.Header.Set("Te", "trailers")
+		return gt.h2.RoundTrip(req)
+	}
+	return gt.next.RoundTrip(req)
+}
+
+// translateGRPCWebRequest turns a gRPC-Web request into a gRPC one: the messages are framed the same way,
+// only the base64 encoding of the text variant must be removed
+func translateGRPCWebRequest(req *http.Request, protocol grpcProtocol) {
+	contentType := req.Header.Get("Content-Type")
+	if protocol == grpcWebText {
+		contentType = strings.Replace(contentType, "application/grpc-web-text", "application/grpc", 1)
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{base64.NewDecoder(base64.StdEncoding, req.Body), req.Body}
+		}
+		req.ContentLength = -1
+		req.Header.Del("Content-Length")
+	} else {
+		contentType = strings.Replace(contentType, "application/grpc-web", "application/grpc", 1)
+	}
+	req.Header.Set("Content-Type", contentType)
+}
+
+// translateGRPCWebResponse turns the gRPC response of a gRPC-Web request back into gRPC-Web: the trailers,
+// which the browsers can't read, are sent in a last frame of the body
+func translateGRPCWebResponse(resp *http.Response, protocol grpcProtocol) {
+	if protocolOf(resp.Header) != grpcNative {
+		// not a gRPC response, like the error of a target
+		return
+	}
+	webType := "application/grpc-web"
+	if protocol == grpcWebText {
+		webType = "application/grpc-web-text"
+	}
+	resp.Header.Set("Content-Type", strings.Replace(resp.Header.Get("Content-Type"), "application/grpc", webType, 1))
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Trailer")
+	resp.ContentLength = -1
+	// the announced trailers are removed so that they aren't sent as HTTP trailers too: the transport sets
+	// them back once the body is read
+	resp.Trailer = nil
+
+	body := &grpcWebBody{resp: resp, body: resp.Body}
+	resp.Body = body
+	if protocol == grpcWebText {
+		pr, pw := io.Pipe()
+		go func() {
+			encoder := base64.NewEncoder(base64.StdEncoding, pw)
+			_, err := io.Copy(encoder, body)
+			if err == nil {
+				err = encoder.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{pr, closerFunc(func() error {
+			pr.Close()
+			return body.Close()
+		})}
+	}
+}
+
+// grpcWebBody appends the trailers of a gRPC response to its body, once read entirely
+type grpcWebBody struct {
+	resp    *http.Response
+	body    io.ReadCloser
+	trailer *bytes.Reader
+}
+
+func (b *grpcWebBody) Read(p []byte) (int, error) {
+	if b.trailer == nil {
+		n, err := b.body.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		// the trailers are known once the body is read
+		b.trailer = bytes.NewReader(grpcWebTrailerFrame(b.resp.Trailer))
+		b.resp.Trailer = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return b.trailer.Read(p)
+}
+
+func (b *grpcWebBody) Close() error {
+	return b.body.Close()
+}
+
+// grpcWebTrailerFrame encodes the trailers in the frame ending a gRPC-Web response, empty when there are
+// none as a trailers-only response has its status in its headers
+func grpcWebTrailerFrame(trailer http.Header) []byte {
+	if len(trailer) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(trailer))
+	for name := range trailer {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var fields bytes.Buffer
+	for _, name := range names {
+		for _, value := range trailer[name] {
+			fields.WriteString(strings.ToLower(name) + ": " + value + "\r\n")
+		}
+	}
+	frame := make([]byte, 5, 5+fields.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(fields.Len()))
+	return append(frame, fields.Bytes()...)
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// grpcStatus maps the status of a proxy error to the gRPC status codes
+func grpcStatus(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return 3 // INVALID_ARGUMENT
+	case http.StatusUnauthorized:
+		return 16 // UNAUTHENTICATED
+	case http.StatusForbidden:
+		return 7 // PERMISSION_DENIED
+	case http.StatusNotFound:
+		return 12 // UNIMPLEMENTED
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return 8 // RESOURCE_EXHAUSTED
+	case StatusClientClosedRequest:
+		return 1 // CANCELLED
+	case http.StatusGatewayTimeout:
+		return 4 // DEADLINE_EXCEEDED
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return 14 // UNAVAILABLE
+	}
+	return 13 // INTERNAL
+}
+
+// GRPCErrorHandler answers the proxy errors of the gRPC and gRPC-Web requests with a trailers-only response,
+// carrying the gRPC status matching the error: it's the default for those requests when no ErrorHandler is set
+func GRPCErrorHandler(w http.ResponseWriter, req *http.Request, perr *ProxyError) {
+	contentType := "application/grpc"
+	switch protocolOf(req.Header) {
+	case grpcWeb:
+		contentType = "application/grpc-web"
+	case grpcWebText:
+		contentType = "application/grpc-web-text"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Grpc-Status", strconv.Itoa(grpcStatus(perr.Status)))
+	w.Header().Set("Grpc-Message", grpcMessage(fmt.Sprintf("%s: %s", perr.Kind, perr.Detail)))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcMessage percent-encodes a message for the grpc-message header
+func grpcMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
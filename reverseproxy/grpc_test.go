@@ -0,0 +1,96 @@
+package reverseproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestProtocolOf(t *testing.T) {
+	for contentType, want := range map[string]grpcProtocol{
+		"application/grpc":                     grpcNative,
+		"application/grpc+proto":               grpcNative,
+		"application/grpc-web":                 grpcWeb,
+		"application/grpc-web+proto":           grpcWeb,
+		"application/grpc-web-text":            grpcWebText,
+		"application/grpc-web-text+proto; q=1": grpcWebText,
+		"application/grpcx":                    notGRPC,
+		"application/json":                     notGRPC,
+		"":                                     notGRPC,
+	} {
+		header := http.Header{"Content-Type": {contentType}}
+		if got := protocolOf(header); got != want {
+			t.Errorf("protocolOf(%q) = %d, want %d", contentType, got, want)
+		}
+	}
+}
+
+// h2cClient is an HTTP/2 client in plain text, with prior knowledge
+func h2cClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+func TestGRPCOverH2C(t *testing.T) {
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Te") != "trailers" {
+			http.Error(w, "gRPC requires HTTP/2 with trailers", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer upstream.Close()
+
+	call := func(proxy *httptest.Server) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/payments/Pay", strings.NewReader("\x00\x00\x00\x00\x02hi"))
+		req.Header.Set("Content-Type", "application/grpc")
+		return h2cClient().Do(req)
+	}
+
+	// without a gRPC route the proxy doesn't accept h2c
+	plain := httptest.NewServer(New(PathPrefixRoutesMap{"/payments/": TargetHost(upstream.URL)}).WithAccessLogger(nil).newServer(0).Handler)
+	defer plain.Close()
+	if resp, err := call(plain); err == nil {
+		resp.Body.Close()
+		t.Error("h2c is accepted without a gRPC route")
+	}
+
+	rp := New(PathPrefixRoutesMap{"/api/": "http://api", "/payments/": TargetHost(upstream.URL)}).
+		WithAccessLogger(nil).
+		WithRouteConfig("/payments/", RouteConfig{GRPC: &GRPCConfig{}})
+	proxy := httptest.NewServer(rp.newServer(0).Handler)
+	defer proxy.Close()
+	resp, err := call(proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 || string(body) != "\x00\x00\x00\x00\x02hi" {
+		t.Fatalf("response %s %d %q", resp.Proto, resp.StatusCode, body)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Grpc-Status trailer = %q, want 0", got)
+	}
+
+	// the HTTP/1.1 requests are still served
+	if rec := serve(rp.newServer(0).Handler, http.MethodGet, "/missing"); rec.Code != http.StatusNotFound {
+		t.Errorf("HTTP/1.1 status = %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,208 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// HeaderRules are the declarative header changes of a route
+type HeaderRules struct {
+	// Request changes the headers of the requests sent to the targets
+	Request HeaderOps `json:"request,omitempty"`
+	// Response changes the headers of the responses sent back to the clients
+	Response HeaderOps `json:"response,omitempty"`
+	// HideServerHeaders removes the Server and X-Powered-By headers from the responses
+	HideServerHeaders bool `json:"hideServerHeaders,omitempty"`
+	// CookieDomains rewrites the Domain attribute of the cookies set by the targets, from the target domain to
+	// the public one: the "*" key matches any domain, and an empty value removes the attribute
+	CookieDomains map[string]string `json:"cookieDomains,omitempty"`
+	// CookiePaths rewrites the Path attribute of the cookies set by the targets, replacing the longest matching
+	// target path prefix with the public one
+	CookiePaths map[string]string `json:"cookiePaths,omitempty"`
+}
+
+// HeaderOps are header changes, applied in the order of the fields
+type HeaderOps struct {
+	// Remove lists the headers to remove: a trailing * removes all the headers with the given prefix, like X-Internal-*
+	Remove []string `json:"remove,omitempty"`
+	// Rename renames headers, keeping their values
+	Rename map[string]string `json:"rename,omitempty"`
+	// Copy sets headers to the value of an attribute of the client request: client-ip, host, method, path, query,
+	// scheme, header:<name>, query:<name> or cookie:<name>
+	Copy map[string]string `json:"copy,omitempty"`
+	// Set sets headers, replacing their values
+	Set map[string]string `json:"set,omitempty"`
+	// Add adds a value to headers
+	Add map[string]string `json:"add,omitempty"`
+}
+
+// inboundRequest returns the request received from the client, used to resolve the request attributes
+// when changing the headers of the response
+func inboundRequest(req *http.Request) *http.Request {
+	if pr := proxyRequestFrom(req); pr != nil {
+		return pr.inbound
+	}
+	return req
+}
+
+// validateRequestAttribute checks an attribute name of HeaderOps.Copy
+func validateRequestAttribute(attr string) error {
+	switch attr {
+	case "client-ip", "host", "method", "path", "query", "scheme":
+		return nil
+	}
+	kind, name, found := strings.Cut(attr, ":")
+	if found && name != "" && (kind == "header" || kind == "query" || kind == "cookie") {
+		return nil
+	}
+	return fmt.Errorf("unknown request attribute %q", attr)
+}
+
+// requestAttribute resolves an attribute of the client request
+func (rp *ReverseProxy) requestAttribute(req *http.Request, attr string) (string, bool) {
+	switch attr {
+	case "client-ip":
+		peer, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			peer = req.RemoteAddr
+		}
+		return rp.forwarder.Load().clientIP(req, peer), true
+	case "host":
+		return req.Host, true
+	case "method":
+		return req.Method, true
+	case "path":
+		return req.URL.Path, true
+	case "query":
+		return req.URL.RawQuery, req.URL.RawQuery != ""
+	case "scheme":
+		if req.TLS != nil {
+			return "https", true
+		}
+		return "http", true
+	}
+	kind, name, _ := strings.Cut(attr, ":")
+	switch kind {
+	case "header":
+		value := req.Header.Get(name)
+		return value, value != ""
+	case "query":
+		if values, found := req.URL.Query()[name]; found && len(values) > 0 {
+			return values[0], true
+		}
+	case "cookie":
+		if cookie, err := req.Cookie(name); err == nil {
+			return cookie.Value, true
+		}
+	}
+	return "", false
+}
+
+// apply changes the given headers, resolving the Copy attributes from the client request
+func (ops *HeaderOps) apply(rp *ReverseProxy, header http.Header, client *http.Request) {
+	for _, name := range ops.Remove {
+		if prefix, isPrefix := strings.CutSuffix(name, "*"); isPrefix {
+			prefix = http.CanonicalHeaderKey(prefix)
+			for key := range header {
+				if strings.HasPrefix(key, prefix) {
+					header.Del(key)
+				}
+			}
+			continue
+		}
+		header.Del(name)
+	}
+	for from, to := range ops.Rename {
+		if values := header.Values(from); len(values) > 0 {
+			header.Del(from)
+			for _, v := range values {
+				header.Add(to, v)
+			}
+		}
+	}
+	for name, attr := range ops.Copy {
+		if value, found := rp.requestAttribute(client, attr); found {
+			header.Set(name, value)
+		}
+	}
+	for name, value := range ops.Set {
+		header.Set(name, value)
+	}
+	for name, value := range ops.Add {
+		header.Add(name, value)
+	}
+}
+
+// applyRequest changes the headers of the request sent to a target
+func (rules *HeaderRules) applyRequest(rp *ReverseProxy, req *http.Request) {
+	rules.Request.apply(rp, req.Header, inboundRequest(req))
+}
+
+// applyResponse changes the headers of the response sent back to the client
+func (rules *HeaderRules) applyResponse(rp *ReverseProxy, resp *http.Response) {
+	rules.Response.apply(rp, resp.Header, inboundRequest(resp.Request))
+	if rules.HideServerHeaders {
+		resp.Header.Del("Server")
+		resp.Header.Del("X-Powered-By")
+	}
+	if len(rules.CookieDomains) == 0 && len(rules.CookiePaths) == 0 {
+		return
+	}
+	cookies := resp.Header.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	resp.Header.Del("Set-Cookie")
+	for _, cookie := range cookies {
+		resp.Header.Add("Set-Cookie", rules.rewriteCookie(cookie))
+	}
+}
+
+// rewriteCookie rewrites the Domain and Path attributes of a Set-Cookie header, leaving the rest untouched
+func (rules *HeaderRules) rewriteCookie(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	rewritten := parts[:1]
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch strings.ToLower(name) {
+		case "domain":
+			newDomain, found := rules.CookieDomains[strings.TrimPrefix(strings.ToLower(value), ".")]
+			if !found {
+				newDomain, found = rules.CookieDomains["*"]
+			}
+			if found {
+				if newDomain == "" {
+					continue
+				}
+				part = " Domain=" + newDomain
+			}
+		case "path":
+			if newPath, found := rewriteCookiePath(value, rules.CookiePaths); found {
+				part = " Path=" + newPath
+			}
+		}
+		rewritten = append(rewritten, part)
+	}
+	return strings.Join(rewritten, ";")
+}
+
+func rewriteCookiePath(path string, rewrites map[string]string) (string, bool) {
+	prefixes := make([]string, 0, len(rewrites))
+	for prefix := range rewrites {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			newPath := rewrites[prefix] + strings.TrimPrefix(path, prefix)
+			if !strings.HasPrefix(newPath, "/") {
+				newPath = "/" + newPath
+			}
+			return strings.ReplaceAll(newPath, "//", "/"), true
+		}
+	}
+	return path, false
+}
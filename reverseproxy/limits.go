@@ -0,0 +1,149 @@
+package reverseproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+var (
+	// ErrResponseTimeout is returned when the targets of a route don't answer within its ResponseTimeout
+	ErrResponseTimeout = errors.New("response timeout exceeded")
+	// ErrRequestTimeout is the cause of the cancellation of a request exceeding the RequestTimeout of its route
+	ErrRequestTimeout = errors.New("request timeout exceeded")
+)
+
+// Limits bounds the requests of a route
+type Limits struct {
+	// ResponseTimeout bounds the wait for the response headers of the targets, retries included (0 means no bound)
+	ResponseTimeout time.Duration
+	// RequestTimeout bounds the whole request, until the end of the response body: it's the deadline of the
+	// context of the request, seen by the modifiers and the transports (0 means no bound)
+	RequestTimeout time.Duration
+	// MaxRequestBody is the maximum size in bytes of a request body: larger bodies are answered
+	// 413 Request Entity Too Large (0 means no limit)
+	MaxRequestBody int64
+	// MaxRequestHeader is the maximum size in bytes of the header of a request, counted as sent on the wire
+	// by HTTP/1.1: larger headers are answered 431 Request Header Fields Too Large (0 means no limit)
+	MaxRequestHeader int64
+}
+
+// RequestHeaderTooLargeError is returned when the header of a request exceeds the MaxRequestHeader of its route
+type RequestHeaderTooLargeError struct {
+	Limit int64
+}
+
+func (e *RequestHeaderTooLargeError) Error() string {
+	return fmt.Sprintf("request header too large: the limit is %d bytes", e.Limit)
+}
+
+// ServerTimeouts bounds the connections of the clients, see http.Server
+type ServerTimeouts struct {
+	// ReadHeaderTimeout bounds the reading of the request headers
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds the reading of the whole request, body included
+	ReadTimeout time.Duration
+	// WriteTimeout bounds the writing of the response
+	WriteTimeout time.Duration
+	// IdleTimeout bounds the wait for the next request on a keep-alive connection
+	IdleTimeout time.Duration
+}
+
+// WithServerTimeouts sets the timeouts of the client connections of Start and StartTLS
+func (rp *ReverseProxy) WithServerTimeouts(timeouts ServerTimeouts) *ReverseProxy {
+	rp.serverTimeouts = timeouts
+	return rp
+}
+
+// newServer creates the server of the proxied traffic on the given port
+func (rp *ReverseProxy) newServer(port int) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           rp.serverHandler(),
+		ReadHeaderTimeout: rp.serverTimeouts.ReadHeaderTimeout,
+		ReadTimeout:       rp.serverTimeouts.ReadTimeout,
+		WriteTimeout:      rp.serverTimeouts.WriteTimeout,
+		IdleTimeout:       rp.serverTimeouts.IdleTimeout,
+	}
+}
+
+// serverHandler accepts HTTP/2 without TLS too when a route proxies gRPC, for the gRPC clients connecting
+// with h2c: otherwise the server keeps the default protocols. The routes are the ones of the server start.
+func (rp *ReverseProxy) serverHandler() http.Handler {
+	handler := rp.handler()
+	if !rp.table.Load().proxiesGRPC() {
+		return handler
+	}
+	h2cHandler := h2c.NewHandler(handler, &http2.Server{})
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// only the connections with prior knowledge of HTTP/2 are taken over: the Upgrade requests to h2c
+		// are proxied like the other Upgrade requests
+		if req.Method == "PRI" && req.Proto == "HTTP/2.0" {
+			h2cHandler.ServeHTTP(w, req)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// apply bounds a request with the limits of its route, failing when its header or its declared body is too large.
+// The returned request must be proxied, after calling the returned cancel function once done.
+func (l *Limits) apply(w http.ResponseWriter, req *http.Request) (*http.Request, context.CancelFunc, error) {
+	if l.MaxRequestHeader > 0 && headerSize(req) > l.MaxRequestHeader {
+		return nil, nil, &RequestHeaderTooLargeError{Limit: l.MaxRequestHeader}
+	}
+	if l.MaxRequestBody > 0 {
+		if req.ContentLength > l.MaxRequestBody {
+			return nil, nil, &http.MaxBytesError{Limit: l.MaxRequestBody}
+		}
+		if req.Body != nil && req.Body != http.NoBody {
+			// bodies without a declared length fail while they are read
+			req.Body = http.MaxBytesReader(w, req.Body, l.MaxRequestBody)
+		}
+	}
+	if l.RequestTimeout <= 0 {
+		return req, func() {}, nil
+	}
+	ctx, cancel := context.WithTimeoutCause(req.Context(), l.RequestTimeout,
+		fmt.Errorf("%w: the request didn't complete within %s", ErrRequestTimeout, l.RequestTimeout))
+	return req.WithContext(ctx), cancel, nil
+}
+
+// headerSize is the size of the header of a request as sent by HTTP/1.1, Host included, each field
+// being followed by CRLF
+func headerSize(req *http.Request) int64 {
+	size := int64(len("Host: \r\n") + len(req.Host))
+	for name, values := range req.Header {
+		for _, value := range values {
+			size += int64(len(name) + len(": \r\n") + len(value))
+		}
+	}
+	return size
+}
+
+// responseTimeout bounds the wait for the response headers of a request with the ResponseTimeout of its route
+func responseTimeout(req *http.Request, timeout time.Duration, roundTrip func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	// the cause tells the attempts canceled by the timeout from the ones canceled by the client
+	timeoutErr := fmt.Errorf("%w: the targets didn't answer within %s", ErrResponseTimeout, timeout)
+	ctx, cancelCause := context.WithCancelCause(req.Context())
+	cancel := func() { cancelCause(context.Canceled) }
+	timer := time.AfterFunc(timeout, func() { cancelCause(timeoutErr) })
+	resp, err := roundTrip(req.WithContext(ctx))
+	if timedOut := !timer.Stop(); timedOut && req.Context().Err() == nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, timeoutErr
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
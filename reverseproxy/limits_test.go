@@ -0,0 +1,165 @@
+package reverseproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveProblem serves the request and decodes the problem document of the response
+func serveProblem(t *testing.T, handler http.Handler, req *http.Request) (int, problem) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var p problem
+	if rec.Code >= 400 {
+		if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Fatalf("status %d with Content-Type %q, want a problem document", rec.Code, ct)
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+			t.Fatalf("invalid problem document %q: %v", rec.Body.String(), err)
+		}
+	}
+	return rec.Code, p
+}
+
+func TestLimitsRequestSize(t *testing.T) {
+	var upstreamCalls atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer upstream.Close()
+
+	rp := New(PathPrefixRoutesMap{"/upload/": TargetHost(upstream.URL)}).
+		WithAccessLogger(nil).
+		WithRouteConfig("/upload/", RouteConfig{Limits: &Limits{MaxRequestBody: 10, MaxRequestHeader: 200}})
+
+	tests := []struct {
+		name       string
+		body       io.Reader
+		streamed   bool
+		header     http.Header
+		wantStatus int
+		wantKind   ErrorKind
+		wantDetail string
+	}{
+		{name: "small body", body: strings.NewReader("0123456789"), wantStatus: http.StatusOK},
+		{
+			name:       "declared body too large",
+			body:       strings.NewReader("0123456789x"),
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantKind:   ErrorKindBodyTooLarge,
+			wantDetail: "the request body exceeds the limit of 10 bytes",
+		},
+		{
+			name:       "streamed body too large",
+			body:       strings.NewReader("0123456789x"),
+			streamed:   true,
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantKind:   ErrorKindBodyTooLarge,
+			wantDetail: "the request body exceeds the limit of 10 bytes",
+		},
+		{name: "small header", header: http.Header{"X-Data": {strings.Repeat("x", 100)}}, wantStatus: http.StatusOK},
+		{
+			name:       "header too large",
+			header:     http.Header{"X-Data": {strings.Repeat("x", 100), strings.Repeat("y", 100)}},
+			wantStatus: http.StatusRequestHeaderFieldsTooLarge,
+			wantKind:   ErrorKindHeaderTooLarge,
+			wantDetail: "the request header exceeds the limit of 200 bytes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamCalls.Store(0)
+			req := httptest.NewRequest(http.MethodPost, "/upload/file", tt.body)
+			if tt.streamed {
+				req.ContentLength = -1
+			}
+			for name, values := range tt.header {
+				req.Header[name] = values
+			}
+			status, p := serveProblem(t, rp.handler(), req)
+			if status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", status, tt.wantStatus)
+			}
+			if tt.wantKind == "" {
+				return
+			}
+			if p.Kind != string(tt.wantKind) || p.Detail != tt.wantDetail || p.Status != tt.wantStatus {
+				t.Errorf("problem = %+v, want kind %s and detail %q", p, tt.wantKind, tt.wantDetail)
+			}
+			// a streamed body is refused while it's sent to the target
+			if !tt.streamed && upstreamCalls.Load() != 0 {
+				t.Error("the request reached the target")
+			}
+		})
+	}
+}
+
+func TestLimitsTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	var deadline atomic.Bool
+	rp := New(PathPrefixRoutesMap{"/response/": TargetHost(upstream.URL), "/request/": TargetHost(upstream.URL)}).
+		WithAccessLogger(nil).
+		WithRouteConfig("/response/", RouteConfig{Limits: &Limits{ResponseTimeout: 50 * time.Millisecond}}).
+		WithRouteConfig("/request/", RouteConfig{Limits: &Limits{RequestTimeout: 50 * time.Millisecond}}).
+		WithRouteRequestModifier("/request/", func(req *http.Request) *http.Response {
+			_, found := req.Context().Deadline()
+			deadline.Store(found)
+			return nil
+		})
+
+	tests := map[string]string{
+		"/response/": "the service didn't answer within the response timeout of 50ms",
+		"/request/":  "the request didn't complete within the request timeout of 50ms",
+	}
+	for path, wantDetail := range tests {
+		start := time.Now()
+		status, p := serveProblem(t, rp.handler(), httptest.NewRequest(http.MethodGet, path, nil))
+		if status != http.StatusGatewayTimeout || p.Kind != string(ErrorKindTimeout) || p.Detail != wantDetail {
+			t.Errorf("%s: status %d, problem %+v, want 504 %q", path, status, p, wantDetail)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: answered after %s", path, elapsed)
+		}
+	}
+	if !deadline.Load() {
+		t.Error("the request timeout isn't the deadline of the context of the request")
+	}
+}
+
+func TestResponseTimeoutKeepsBodyReadable(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// the body is sent after the response timeout, which only bounds the wait for the headers
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, "late body")
+	}))
+	defer upstream.Close()
+
+	rp := New(PathPrefixRoutesMap{"/": TargetHost(upstream.URL)}).
+		WithAccessLogger(nil).
+		WithRouteConfig("/", RouteConfig{Limits: &Limits{ResponseTimeout: 50 * time.Millisecond}})
+	rec := serve(rp.handler(), http.MethodGet, "/")
+	if rec.Code != http.StatusOK || rec.Body.String() != "late body" {
+		t.Errorf("response = %d %q, want 200 with the whole body", rec.Code, rec.Body.String())
+	}
+}
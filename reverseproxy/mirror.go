@@ -0,0 +1,225 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultMirrorTimeout bounds the mirrored requests when MirrorConfig.Timeout is 0
+	defaultMirrorTimeout = 10 * time.Second
+	// maxMirrorsInFlight caps the mirrored requests in progress for a route: beyond it requests aren't mirrored,
+	// so that a slow shadow target can't pile up goroutines
+	maxMirrorsInFlight = 256
+)
+
+// MirrorConfig sends a copy of a share of the requests of a route to a shadow target. The responses of the
+// shadow target are discarded: they never affect the latency or the result of the requests of the clients.
+type MirrorConfig struct {
+	// Target is the shadow target receiving the mirrored requests
+	Target TargetHost
+	// Percentage is the share of requests mirrored, from 0 to 100
+	Percentage float64
+	// MaxBody is the maximum size of a request body which can be mirrored (1MB when 0): requests
+	// with larger bodies aren't mirrored
+	MaxBody int64
+	// Timeout bounds each mirrored request (10s when 0)
+	Timeout time.Duration
+	// Compare, when set, receives the response of the target and the one of the shadow target of every
+	// mirrored request, with their bodies up to MaxBody
+	Compare func(primary, shadow *MirroredResponse)
+}
+
+// MirroredResponse is a response of a mirrored request, as passed to MirrorConfig.Compare
+type MirroredResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Truncated tells if the body was larger than MaxBody
+	Truncated bool
+	Latency   time.Duration
+	// Err is the error of the request, if it failed
+	Err error
+}
+
+func (c *MirrorConfig) maxBody() int64 {
+	if c.MaxBody <= 0 {
+		return defaultMaxBufferedBody
+	}
+	return c.MaxBody
+}
+
+func (c *MirrorConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultMirrorTimeout
+	}
+	return c.Timeout
+}
+
+// mirror is the shadow target of a route
+type mirror struct {
+	config   *MirrorConfig
+	target   *target
+	inFlight atomic.Int64
+}
+
+func newMirror(cfg *MirrorConfig) (*mirror, error) {
+	host := normalizeTargetHost(cfg.Target)
+	targetURL, err := url.Parse(string(host))
+	if err != nil || targetURL.Host == "" {
+		return nil, fmt.Errorf("invalid mirror target %q", cfg.Target)
+	}
+	return &mirror{config: cfg, target: newTarget(host, targetURL)}, nil
+}
+
+// sampled tells if a request must be mirrored, reserving a slot for it
+func (m *mirror) sampled() bool {
+	if m.config.Percentage <= 0 || (m.config.Percentage < 100 && rand.Float64()*100 >= m.config.Percentage) {
+		return false
+	}
+	if m.inFlight.Add(1) > maxMirrorsInFlight {
+		m.inFlight.Add(-1)
+		return false
+	}
+	return true
+}
+
+// mirroringTransport sends the requests of a route to the next transport, mirroring a share of them
+// to the shadow target of the route
+type mirroringTransport struct {
+	mirror *mirror
+	next   http.RoundTripper
+	// base is the transport of the route, used to reach the shadow target
+	base http.RoundTripper
+}
+
+func (mt *mirroringTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m := mt.mirror
+	if pr := proxyRequestFrom(req); pr != nil && pr.response != nil {
+		// the request was answered by a request modifier: it never reaches the targets, nor the shadow one
+		return mt.next.RoundTrip(req)
+	}
+	if !m.sampled() {
+		return mt.next.RoundTrip(req)
+	}
+	body, buffered := bufferBody(req, m.config.maxBody())
+	if !buffered {
+		m.inFlight.Add(-1)
+		return mt.next.RoundTrip(req)
+	}
+
+	// the shadow request is detached from the client request, so that it survives its completion
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), m.config.timeout())
+	shadow := req.Clone(ctx)
+	if body != nil {
+		shadow.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	m.target.applyTarget(shadow.URL)
+	shadow.Host = m.target.url.Host
+
+	shadowDone := make(chan *MirroredResponse, 1)
+	go func() {
+		defer m.inFlight.Add(-1)
+		defer cancel()
+		shadowDone <- mt.send(shadow)
+	}()
+
+	start := time.Now()
+	resp, err := mt.next.RoundTrip(req)
+	if m.config.Compare == nil {
+		return resp, err
+	}
+	if err != nil {
+		go mt.compare(req, &MirroredResponse{Err: err, Latency: time.Since(start)}, shadowDone)
+		return resp, err
+	}
+	primary := &MirroredResponse{StatusCode: resp.StatusCode, Header: resp.Header.Clone(), Latency: time.Since(start)}
+	resp.Body = &teeBody{ReadCloser: resp.Body, limit: m.config.maxBody(), done: func(body []byte, truncated bool, err error) {
+		primary.Body, primary.Truncated, primary.Err = body, truncated, err
+		go mt.compare(req, primary, shadowDone)
+	}}
+	return resp, nil
+}
+
+// send performs the shadow request, reading its response only when it has to be compared
+func (mt *mirroringTransport) send(req *http.Request) *MirroredResponse {
+	start := time.Now()
+	resp, err := mt.base.RoundTrip(req)
+	if err != nil {
+		logRequestf(req, "Error mirroring request to %s%s: %v", mt.mirror.target.host, req.URL.Path, err)
+		return &MirroredResponse{Err: err, Latency: time.Since(start)}
+	}
+	defer resp.Body.Close()
+	shadow := &MirroredResponse{StatusCode: resp.StatusCode, Header: resp.Header}
+	if mt.mirror.config.Compare == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+	} else {
+		limit := mt.mirror.config.maxBody()
+		shadow.Body, shadow.Err = io.ReadAll(io.LimitReader(resp.Body, limit+1))
+		if int64(len(shadow.Body)) > limit {
+			shadow.Body, shadow.Truncated = shadow.Body[:limit], true
+			_, _ = io.Copy(io.Discard, resp.Body)
+		}
+	}
+	shadow.Latency = time.Since(start)
+	return shadow
+}
+
+// compare passes both responses of a mirrored request to the comparison hook, once the shadow one is complete
+func (mt *mirroringTransport) compare(req *http.Request, primary *MirroredResponse, shadowDone <-chan *MirroredResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			logRequestf(req, "Panic in mirror comparison: %v", r)
+		}
+	}()
+	mt.mirror.config.Compare(primary, <-shadowDone)
+}
+
+// teeBody collects a response body up to limit while the client reads it, reporting it once read or closed
+type teeBody struct {
+	io.ReadCloser
+	buf       bytes.Buffer
+	limit     int64
+	truncated bool
+	err       error
+	once      sync.Once
+	done      func(body []byte, truncated bool, err error)
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if room := b.limit - int64(b.buf.Len()); int64(n) > room {
+			b.buf.Write(p[:room])
+			b.truncated = true
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	if err != nil {
+		b.report()
+	}
+	return n, err
+}
+
+func (b *teeBody) Close() error {
+	// a body closed before the end is incomplete: this has no effect when it was already reported
+	b.truncated = true
+	b.report()
+	return b.ReadCloser.Close()
+}
+
+func (b *teeBody) report() {
+	b.once.Do(func() { b.done(b.buf.Bytes(), b.truncated, b.err) })
+}
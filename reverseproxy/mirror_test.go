@@ -0,0 +1,50 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMirrorSkipsAnsweredRequests(t *testing.T) {
+	mirrored := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.URL.Path
+	}))
+	defer shadow.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	rp := New(PathPrefixRoutesMap{"/api/": TargetHost(upstream.URL)}).
+		WithRouteConfig("/api/", RouteConfig{Mirror: &MirrorConfig{Target: TargetHost(shadow.URL), Percentage: 100}}).
+		WithRequestModifier(func(req *http.Request) *http.Response {
+			if req.URL.Path == "/api/secret" {
+				return &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{}, Body: http.NoBody}
+			}
+			return nil
+		}).
+		WithAccessLogger(nil)
+	handler := rp.handler()
+
+	if rec := serve(handler, http.MethodGet, "/api/secret"); rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if rec := serve(handler, http.MethodGet, "/api/public"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	select {
+	case path := <-mirrored:
+		if path != "/public" {
+			t.Errorf("mirrored path = %q, want /public", path)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the allowed request wasn't mirrored")
+	}
+	select {
+	case path := <-mirrored:
+		t.Errorf("unexpected mirrored request %q", path)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
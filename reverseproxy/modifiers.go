@@ -0,0 +1,238 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestModifier changes a request before it's sent to the target. Returning a response short-circuits the
+// request: the following modifiers aren't run, the target isn't contacted and the response, after going through
+// the response modifiers, is sent to the client.
+type RequestModifier func(req *http.Request) *http.Response
+
+// modifierChain is a sequence of modifiers registered for the requests whose path starts with prefix
+// (an empty prefix matches every request), whatever their virtual host
+type modifierChain struct {
+	prefix   PathPrefix
+	request  []RequestModifier
+	response []ModifyResponse
+}
+
+func (c *modifierChain) matches(path string) bool {
+	prefix := string(c.prefix)
+	return prefix == "" || strings.HasPrefix(path, prefix) || path == strings.TrimSuffix(prefix, "/")
+}
+
+// chain returns the chain of the given prefix, creating it when missing
+func (rp *ReverseProxy) chain(prefix PathPrefix) *modifierChain {
+	if prefix != "" {
+		prefix = normalizePathPrefix(prefix)
+	}
+	for _, c := range rp.modifiers {
+		if c.prefix == prefix {
+			return c
+		}
+	}
+	c := &modifierChain{prefix: prefix}
+	rp.modifiers = append(rp.modifiers, c)
+	return c
+}
+
+// WithRequestModifier adds a request modifier run for every route, after the ones added before
+func (rp *ReverseProxy) WithRequestModifier(m RequestModifier) *ReverseProxy {
+	c := rp.chain("")
+	c.request = append(c.request, m)
+	return rp
+}
+
+// WithRouteRequestModifier adds a request modifier run for the requests whose path starts with the given prefix,
+// after the modifiers of every route. The prefix is matched on every virtual host.
+func (rp *ReverseProxy) WithRouteRequestModifier(prefix PathPrefix, m RequestModifier) *ReverseProxy {
+	c := rp.chain(prefix)
+	c.request = append(c.request, m)
+	return rp
+}
+
+// WithRouteModifyResponse adds a response modifier run for the requests whose path starts with the given prefix,
+// before the modifiers of every route. The prefix is matched on every virtual host.
+func (rp *ReverseProxy) WithRouteModifyResponse(prefix PathPrefix, m ModifyResponse) *ReverseProxy {
+	c := rp.chain(prefix)
+	c.response = append(c.response, m)
+	return rp
+}
+
+// modifyRequest runs the request modifiers matching the path of the request, the global ones first,
+// and returns the response of the modifier short-circuiting the request, if any
+func (rp *ReverseProxy) modifyRequest(req *http.Request, path string) *http.Response {
+	for _, global := range []bool{true, false} {
+		for _, c := range rp.modifiers {
+			if (c.prefix == "") != global || !c.matches(path) {
+				continue
+			}
+			for _, m := range c.request {
+				if resp := m(req); resp != nil {
+					return resp
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// modifyResponse runs the response modifiers matching the path of the request, the global ones last
+func (rp *ReverseProxy) modifyResponse(resp *http.Response, path string) error {
+	for _, global := range []bool{false, true} {
+		for _, c := range rp.modifiers {
+			if (c.prefix == "") != global || !c.matches(path) {
+				continue
+			}
+			for _, m := range c.response {
+				if err := m(resp); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// proxyRequest is the state of a request shared by the handler, the director and the upstream transport
+type proxyRequest struct {
+	// inbound is the request received from the client, and header the header of the response to the client
+	inbound *http.Request
+	header  http.Header
+	// response is the response of the request modifier which short-circuited the request
+	response *http.Response
+	// canary tells if the request is sent to the canary targets of the route, and stickyCookie if the
+	// response must set the cookie keeping the client on that variant
+	canary       bool
+	stickyCookie bool
+	// grpcWeb is the gRPC-Web protocol of the request translated to gRPC, notGRPC when it isn't translated
+	grpcWeb grpcProtocol
+
+	// mu guards the outcome of the request kept for its access log, which the background revalidations
+	// of the cache can update too
+	mu              sync.Mutex
+	target          TargetHost
+	upstreamStatus  int
+	upstreamLatency time.Duration
+	retries         int
+	cache           string
+	errorKind       ErrorKind
+}
+
+type proxyRequestKey struct{}
+
+func withProxyRequest(w http.ResponseWriter, req *http.Request) *http.Request {
+	pr := &proxyRequest{inbound: req, header: w.Header()}
+	return req.WithContext(context.WithValue(req.Context(), proxyRequestKey{}, pr))
+}
+
+func proxyRequestFrom(req *http.Request) *proxyRequest {
+	pr, _ := req.Context().Value(proxyRequestKey{}).(*proxyRequest)
+	return pr
+}
+
+// NewResponse creates a plain text response to the given request, which a RequestModifier can return to
+// short-circuit the request
+func NewResponse(req *http.Request, status int, body string) *http.Response {
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Request:    req,
+	}
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	SetBody(resp, []byte(body))
+	return resp
+}
+
+// ReadBody reads the whole body of a response, decompressing it when gzip encoded, and replaces it with
+// the read content, so that it can be read again
+func ReadBody(resp *http.Response) ([]byte, error) {
+	body, err := decodedBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	content, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	SetBody(resp, content)
+	return content, nil
+}
+
+// SetBody replaces the body of a response, fixing its Content-Length
+func SetBody(resp *http.Response, content []byte) {
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(content))
+	resp.ContentLength = int64(len(content))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(content)))
+	resp.TransferEncoding = nil
+}
+
+// RewriteBody replaces the body of a response with the output of rewrite, which reads the original body,
+// decompressed when gzip encoded, while the new body is sent to the client: the body is never held in memory
+// as a whole, and the response is sent without Content-Length. An error of rewrite aborts the response.
+func RewriteBody(resp *http.Response, rewrite func(dst io.Writer, src io.Reader) error) error {
+	if !hasBody(resp) {
+		return nil
+	}
+	src, err := decodedBody(resp)
+	if err != nil {
+		return err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		defer src.Close()
+		err := rewrite(writer, src)
+		if err != nil {
+			logRequestf(resp.Request, "Error rewriting response body: %v", err)
+		}
+		writer.CloseWithError(err)
+	}()
+	resp.Body = reader
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	return nil
+}
+
+// hasBody tells if a response can have a body
+func hasBody(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return false
+	}
+	return resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified &&
+		resp.StatusCode >= http.StatusOK && resp.Body != nil && resp.Body != http.NoBody
+}
+
+// decodedBody returns the body of a response, decompressing it when gzip encoded: the Content-Encoding
+// header is then removed, since the new body is sent as it is
+func decodedBody(resp *http.Response) (io.ReadCloser, error) {
+	if resp.Body == nil {
+		return http.NoBody, nil
+	}
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return resp.Body, nil
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing response body: %w", err)
+	}
+	resp.Header.Del("Content-Encoding")
+	return &readCloser{Reader: gz, Closer: resp.Body}, nil
+}
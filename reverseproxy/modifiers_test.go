@@ -0,0 +1,200 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// appendHeader returns a request modifier appending value to the X-Order header of the request
+func appendHeader(value string) RequestModifier {
+	return func(req *http.Request) *http.Response {
+		req.Header.Add("X-Order", value)
+		return nil
+	}
+}
+
+// appendResponseHeader returns a response modifier appending value to the X-Order header of the response
+func appendResponseHeader(value string) ModifyResponse {
+	return func(resp *http.Response) error {
+		resp.Header.Add("X-Order", value)
+		return nil
+	}
+}
+
+func TestModifierChainsOrder(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Join(r.Header.Values("X-Order"), ","))
+	}))
+	defer upstream.Close()
+
+	rp := New(PathPrefixRoutesMap{"/a/": TargetHost(upstream.URL)}).
+		WithVirtualHost("example.com", PathPrefixRoutesMap{"/a/": TargetHost(upstream.URL)}).
+		WithAccessLogger(nil).
+		// the prefix chains are registered first, to check that the global ones run before them anyway
+		WithRouteRequestModifier("/a/", appendHeader("a1")).
+		WithRouteRequestModifier("/a/b/", appendHeader("ab1")).
+		WithRouteRequestModifier("/other/", appendHeader("other")).
+		WithRouteModifyResponse("/a/", appendResponseHeader("a1")).
+		WithRouteModifyResponse("/a/b/", appendResponseHeader("ab1")).
+		WithRequestModifier(appendHeader("g1")).
+		WithModifyRequest(func(req *http.Request) { req.Header.Add("X-Order", "g2") }).
+		WithModifyResponse(appendResponseHeader("g1")).
+		WithRouteRequestModifier("/a", appendHeader("a2"))
+
+	tests := map[string]struct {
+		request  string
+		response string
+	}{
+		"/a/b/c": {request: "g1,g2,a1,a2,ab1", response: "a1,ab1,g1"},
+		"/a/c":   {request: "g1,g2,a1,a2", response: "a1,g1"},
+		"/a":     {request: "g1,g2,a1,a2", response: "a1,g1"},
+	}
+	for _, host := range []string{"proxy", "example.com"} {
+		for path, want := range tests {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Host = host
+			rec := httptest.NewRecorder()
+			rp.handler().ServeHTTP(rec, req)
+			if got := rec.Body.String(); got != want.request {
+				t.Errorf("%s%s: request modifiers %q, want %q", host, path, got, want.request)
+			}
+			if got := strings.Join(rec.Header().Values("X-Order"), ","); got != want.response {
+				t.Errorf("%s%s: response modifiers %q, want %q", host, path, got, want.response)
+			}
+		}
+	}
+}
+
+func TestRequestModifierShortCircuit(t *testing.T) {
+	var upstreamCalls atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+	}))
+	defer upstream.Close()
+
+	var laterCalls atomic.Int64
+	rp := New(PathPrefixRoutesMap{"/admin/": TargetHost(upstream.URL)}).
+		WithAccessLogger(nil).
+		WithRouteRequestModifier("/admin/", func(req *http.Request) *http.Response {
+			if req.Header.Get("X-Admin-Key") != "secret" {
+				return NewResponse(req, http.StatusForbidden, "Forbidden")
+			}
+			return nil
+		}).
+		WithRouteRequestModifier("/admin/", func(req *http.Request) *http.Response {
+			laterCalls.Add(1)
+			return nil
+		}).
+		WithModifyResponse(appendResponseHeader("response"))
+
+	rec := serve(rp.handler(), http.MethodGet, "/admin/users")
+	if rec.Code != http.StatusForbidden || rec.Body.String() != "Forbidden" {
+		t.Errorf("response = %d %q, want 403 Forbidden", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Length"); got != "9" {
+		t.Errorf("Content-Length = %q, want 9", got)
+	}
+	if rec.Header().Get("X-Order") != "response" {
+		t.Error("the short-circuited response didn't go through the response modifiers")
+	}
+	if upstreamCalls.Load() != 0 || laterCalls.Load() != 0 {
+		t.Errorf("upstream calls = %d, later modifier calls = %d, want none", upstreamCalls.Load(), laterCalls.Load())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+	req.Header.Set("X-Admin-Key", "secret")
+	rec = httptest.NewRecorder()
+	rp.handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || upstreamCalls.Load() != 1 || laterCalls.Load() != 1 {
+		t.Errorf("status = %d, upstream calls = %d, later modifier calls = %d", rec.Code, upstreamCalls.Load(), laterCalls.Load())
+	}
+}
+
+func TestResponseBodyModifiers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			io.WriteString(gz, "hello gzip")
+			gz.Close()
+			return
+		}
+		w.Header().Set("Content-Length", "5")
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	rp := New(PathPrefixRoutesMap{"/set/": TargetHost(upstream.URL), "/rewrite/": TargetHost(upstream.URL)}).
+		WithAccessLogger(nil).
+		WithRouteModifyResponse("/set/", func(resp *http.Response) error {
+			body, err := ReadBody(resp)
+			if err != nil {
+				return err
+			}
+			SetBody(resp, append(body, " world"...))
+			return nil
+		}).
+		WithRouteModifyResponse("/rewrite/", func(resp *http.Response) error {
+			return RewriteBody(resp, func(dst io.Writer, src io.Reader) error {
+				body, err := io.ReadAll(src)
+				if err != nil {
+					return err
+				}
+				_, err = dst.Write(bytes.ToUpper(body))
+				return err
+			})
+		})
+
+	tests := []struct {
+		path          string
+		body          string
+		contentLength string
+	}{
+		{path: "/set/", body: "hello world", contentLength: "11"},
+		{path: "/set/gzip", body: "hello gzip world", contentLength: "16"},
+		{path: "/rewrite/", body: "HELLO"},
+		{path: "/rewrite/gzip", body: "HELLO GZIP"},
+	}
+	for _, tt := range tests {
+		rec := serve(rp.handler(), http.MethodGet, tt.path)
+		if rec.Body.String() != tt.body {
+			t.Errorf("%s: body = %q, want %q", tt.path, rec.Body.String(), tt.body)
+		}
+		if got := rec.Header().Get("Content-Length"); got != tt.contentLength {
+			t.Errorf("%s: Content-Length = %q, want %q", tt.path, got, tt.contentLength)
+		}
+		if got := rec.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s: Content-Encoding = %q, want the body sent decompressed", tt.path, got)
+		}
+	}
+}
+
+func TestSetBody(t *testing.T) {
+	resp := &http.Response{
+		StatusCode:       http.StatusOK,
+		Header:           http.Header{"Content-Length": {"3"}},
+		Body:             io.NopCloser(strings.NewReader("old")),
+		ContentLength:    3,
+		TransferEncoding: []string{"chunked"},
+	}
+	SetBody(resp, []byte("new body"))
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "new body" || resp.ContentLength != 8 || resp.Header.Get("Content-Length") != "8" {
+		t.Errorf("body %q, ContentLength %d, header %q", body, resp.ContentLength, resp.Header.Get("Content-Length"))
+	}
+	if resp.TransferEncoding != nil {
+		t.Errorf("TransferEncoding = %v, want none", resp.TransferEncoding)
+	}
+
+	// a response without body isn't rewritten
+	head := &http.Response{StatusCode: http.StatusNoContent, Header: http.Header{}, Body: http.NoBody}
+	if err := RewriteBody(head, func(dst io.Writer, src io.Reader) error { t.Error("rewrite called"); return nil }); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,160 @@
+package reverseproxy
+
+import (
+	"log"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// failTimeout is how long a target which failed a request is considered unhealthy
+const failTimeout = 10 * time.Second
+
+// target is a single upstream of a route
+type target struct {
+	host      TargetHost
+	url       *url.URL
+	breaker   *CircuitBreaker
+	mu        sync.Mutex
+	downUntil time.Time
+
+	// weight and disabled can be changed at runtime: a target with weight 0 or disabled receives no requests
+	weight   atomic.Int64
+	disabled atomic.Bool
+	// current is the running weight of the smooth weighted round robin, guarded by the mutex of the pool
+	current int64
+
+	requests  atomic.Int64
+	failures  atomic.Int64
+	inFlight  atomic.Int64
+	latencyNs atomic.Int64
+}
+
+func newTarget(host TargetHost, targetURL *url.URL) *target {
+	t := &target{host: host, url: targetURL}
+	t.weight.Store(1)
+	return t
+}
+
+// healthy tells if the target didn't fail recently and its circuit isn't open
+func (t *target) healthy() bool {
+	if t.breaker != nil && t.breaker.State() == CircuitOpen {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Now().After(t.downUntil)
+}
+
+// active tells if the target takes part to the balancing
+func (t *target) active() bool {
+	return !t.disabled.Load() && t.weight.Load() > 0
+}
+
+// markFailed takes the target out of the rotation for the failTimeout
+func (t *target) markFailed() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.downUntil = time.Now().Add(failTimeout)
+}
+
+// record updates the stats of the target with the outcome of a request
+func (t *target) record(failed bool, latency time.Duration) {
+	t.requests.Add(1)
+	t.latencyNs.Add(int64(latency))
+	if failed {
+		t.failures.Add(1)
+	}
+}
+
+// targetPool balances the requests of a route among its targets with a smooth weighted round robin
+type targetPool struct {
+	targets []*target
+	mu      sync.Mutex
+}
+
+// newTargetPool creates the pool of the given hosts. The targets of the previous pool of the route, if any,
+// are reused for the hosts still present, so that their weight, state and stats survive the change.
+func newTargetPool(hosts []TargetHost, cb *CircuitBreakerConfig, prev *targetPool) *targetPool {
+	existing := map[TargetHost]*target{}
+	if prev != nil {
+		for _, t := range prev.targets {
+			existing[t.host] = t
+		}
+	}
+
+	pool := &targetPool{}
+	for _, host := range hosts {
+		if t, found := existing[host]; found {
+			pool.targets = append(pool.targets, t)
+			continue
+		}
+		targetURL, err := url.Parse(string(host))
+		if err != nil {
+			log.Printf("Error parsing target URL %s: %v", host, err)
+			continue
+		}
+		t := newTarget(host, targetURL)
+		if cb != nil {
+			t.breaker = NewCircuitBreaker(*cb)
+		}
+		pool.targets = append(pool.targets, t)
+	}
+	return pool
+}
+
+// find returns the target with the given host, or nil
+func (p *targetPool) find(host TargetHost) *target {
+	for _, t := range p.targets {
+		if t.host == host {
+			return t
+		}
+	}
+	return nil
+}
+
+// candidates returns the active targets in the order they should be tried: the ones not contained in tried
+// come first, and within each group healthy targets precede unhealthy ones. The first target is chosen by
+// weight among the healthy untried ones.
+func (p *targetPool) candidates(tried map[*target]bool) []*target {
+	var groups [4][]*target
+	for _, t := range p.targets {
+		if !t.active() {
+			continue
+		}
+		group := 0
+		if tried[t] {
+			group += 2
+		}
+		if !t.healthy() {
+			group++
+		}
+		groups[group] = append(groups[group], t)
+	}
+	if first := p.weighted(groups[0]); first > 0 {
+		groups[0][0], groups[0][first] = groups[0][first], groups[0][0]
+	}
+	return append(append(append(groups[0], groups[1]...), groups[2]...), groups[3]...)
+}
+
+// weighted returns the index of the target chosen by the smooth weighted round robin, as done by nginx
+func (p *targetPool) weighted(targets []*target) int {
+	if len(targets) < 2 {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var total int64
+	best := 0
+	for i, t := range targets {
+		w := t.weight.Load()
+		t.current += w
+		total += w
+		if t.current > targets[best].current {
+			best = i
+		}
+	}
+	targets[best].current -= total
+	return best
+}
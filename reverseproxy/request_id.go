@@ -0,0 +1,34 @@
+package reverseproxy
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gyozatech/temaki"
+)
+
+// withRequestID gives the request its ID: the one set by the RequestID middleware of temaki if any, otherwise
+// the one of the client in temaki.RequestIDHeader when valid, or a new ULID. The ID is forwarded to the targets
+// and echoed to the client in the header of the middleware, temaki.RequestIDHeader by default.
+func withRequestID(w http.ResponseWriter, req *http.Request) *http.Request {
+	header := temaki.RequestIDHeaderOf(req)
+	id := temaki.RequestID(req)
+	if id == "" {
+		if id = req.Header.Get(header); !temaki.ValidRequestID(id) {
+			id = temaki.NewULID()
+		}
+		req = temaki.SetRequestID(req, id)
+	}
+	req.Header.Set(header, id)
+	w.Header().Set(header, id)
+	return req
+}
+
+// logRequestf logs a message about a request, prefixed with its ID
+func logRequestf(req *http.Request, format string, v ...interface{}) {
+	if id := temaki.RequestID(req); id != "" {
+		log.Printf("[%s] "+format, append([]interface{}{id}, v...)...)
+		return
+	}
+	log.Printf(format, v...)
+}
@@ -0,0 +1,70 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gyozatech/temaki"
+	"github.com/gyozatech/temaki/middlewares"
+)
+
+func TestRequestIDHeaderOfMiddleware(t *testing.T) {
+	received := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("X-Correlation-ID")
+	}))
+	defer upstream.Close()
+
+	handler := New(PathPrefixRoutesMap{"/api/": TargetHost(upstream.URL)}).
+		WithMiddlewares(middlewares.RequestIDWithConfig(middlewares.RequestIDConfig{Header: "X-Correlation-ID"})).
+		WithAccessLogger(nil).
+		handler()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api/", nil)
+	req.Header.Set("X-Correlation-ID", "client-id")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := <-received; got != "client-id" {
+		t.Errorf("forwarded ID = %q, want client-id", got)
+	}
+	if got := rec.Header().Values("X-Correlation-ID"); len(got) != 1 || got[0] != "client-id" {
+		t.Errorf("echoed IDs = %v, want [client-id]", got)
+	}
+	if got := rec.Header().Get(temaki.RequestIDHeader); got != "" {
+		t.Errorf("the default header was set to %q", got)
+	}
+}
+
+func TestRequestIDOfTarget(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/own" {
+			w.Header().Set(temaki.RequestIDHeader, "target-id")
+		}
+	}))
+	defer upstream.Close()
+	handler := New(PathPrefixRoutesMap{"/api/": TargetHost(upstream.URL)}).WithAccessLogger(nil).handler()
+
+	if got := serve(handler, http.MethodGet, "/api/own").Header().Values(temaki.RequestIDHeader); len(got) != 1 || got[0] != "target-id" {
+		t.Errorf("IDs = %v, want the one of the target", got)
+	}
+	if got := serve(handler, http.MethodGet, "/api/other").Header().Values(temaki.RequestIDHeader); len(got) != 1 || !temaki.ValidRequestID(got[0]) {
+		t.Errorf("IDs = %v, want the one of the proxy", got)
+	}
+}
+
+func TestCachedResponseKeepsRequestID(t *testing.T) {
+	handler := newCachingProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set(temaki.RequestIDHeader, r.Header.Get(temaki.RequestIDHeader))
+	}))
+
+	first := serve(handler, http.MethodGet, "/api/item").Header().Get(temaki.RequestIDHeader)
+	hit := serve(handler, http.MethodGet, "/api/item")
+	if hit.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("X-Cache = %q, want HIT", hit.Header().Get("X-Cache"))
+	}
+	if got := hit.Header().Values(temaki.RequestIDHeader); len(got) != 1 || got[0] == first {
+		t.Errorf("IDs = %v, want a single one other than the one of the request filling the cache %q", got, first)
+	}
+}
@@ -0,0 +1,322 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// RetryCondition is a condition under which a failed attempt to reach an upstream is retried
+type RetryCondition string
+
+const (
+	// RetryOnConnectError retries when the upstream can't be dialed or drops the connection
+	RetryOnConnectError RetryCondition = "connect-error"
+	// RetryOnTimeout retries when the upstream doesn't answer within the PerTryTimeout
+	RetryOnTimeout RetryCondition = "timeout"
+	// RetryOn502 retries when the upstream answers 502 Bad Gateway
+	RetryOn502 RetryCondition = "502"
+	// RetryOn503 retries when the upstream answers 503 Service Unavailable
+	RetryOn503 RetryCondition = "503"
+	// RetryOn504 retries when the upstream answers 504 Gateway Timeout
+	RetryOn504 RetryCondition = "504"
+)
+
+// ErrNoTargetAvailable is returned when a route has no enabled target
+var ErrNoTargetAvailable = errors.New("no target available")
+
+// defaultMaxBufferedBody is the default size limit of a request body kept in memory to be replayed
+const defaultMaxBufferedBody = 1 << 20
+
+// RetryPolicy configures how the requests of a route are retried.
+// Idempotent methods are always retried, provided their body (if any) could be buffered.
+// Non-idempotent methods are retried only if RetryNonIdempotent is set and their body could be buffered.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts, the first one included
+	Attempts int
+	// PerTryTimeout bounds the wait for the response headers of each attempt (0 means no bound)
+	PerTryTimeout time.Duration
+	// BackoffBase is the wait before the first retry, doubled at each further retry
+	BackoffBase time.Duration
+	// BackoffMax caps the wait between two attempts (0 means no cap)
+	BackoffMax time.Duration
+	// RetryOn lists the conditions triggering a retry: RetryOnConnectError when empty
+	RetryOn []RetryCondition
+	// RetryNonIdempotent allows retrying methods like POST and PATCH
+	RetryNonIdempotent bool
+	// MaxBufferedBody is the maximum size of a request body which can be replayed (1MB when 0)
+	MaxBufferedBody int64
+}
+
+func (p *RetryPolicy) retriesOn(cond RetryCondition) bool {
+	if len(p.RetryOn) == 0 {
+		return cond == RetryOnConnectError
+	}
+	for _, c := range p.RetryOn {
+		if c == cond {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the wait before the given retry (starting from 1), with full jitter
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	if p.BackoffBase <= 0 {
+		return 0
+	}
+	d := p.BackoffBase << (retry - 1)
+	if d <= 0 || (p.BackoffMax > 0 && d > p.BackoffMax) {
+		d = p.BackoffMax
+	}
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d + 1)
+}
+
+func (p *RetryPolicy) maxBufferedBody() int64 {
+	if p.MaxBufferedBody <= 0 {
+		return defaultMaxBufferedBody
+	}
+	return p.MaxBufferedBody
+}
+
+// upstreamTransport sends the requests of a route to the targets of its pool, retrying them according to
+// the retry policy of the route
+type upstreamTransport struct {
+	rp    *ReverseProxy
+	route *route
+	base  http.RoundTripper
+}
+
+func (ut *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if limits := ut.route.config.Limits; limits != nil && limits.ResponseTimeout > 0 {
+		return responseTimeout(req, limits.ResponseTimeout, ut.roundTrip)
+	}
+	return ut.roundTrip(req)
+}
+
+func (ut *upstreamTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if pr := proxyRequestFrom(req); pr != nil && pr.response != nil {
+		// a request modifier short-circuited the request
+		resp := pr.response
+		resp.Request = req
+		if resp.Body == nil {
+			resp.Body = http.NoBody
+		}
+		return resp, nil
+	}
+	policy := ut.route.config.Retry
+	attempts := 1
+	var body []byte
+	if policy != nil && policy.Attempts > 1 && (isIdempotent(req.Method) || policy.RetryNonIdempotent) {
+		var buffered bool
+		body, buffered = bufferBody(req, policy.maxBufferedBody())
+		if buffered {
+			attempts = policy.Attempts
+		}
+	}
+
+	pool := ut.route.pool
+	if pr := proxyRequestFrom(req); pr != nil && pr.canary && ut.route.canaryPool != nil {
+		pool = ut.route.canaryPool
+	}
+	tried := map[*target]bool{}
+	for attempt := 1; ; attempt++ {
+		t, err := ut.acquire(pool, tried)
+		if err != nil {
+			return nil, err
+		}
+		tried[t] = true
+
+		outreq := req
+		if attempts > 1 {
+			outreq = req.Clone(req.Context())
+			if body != nil {
+				outreq.Body = io.NopCloser(bytes.NewReader(body))
+			}
+		}
+		t.applyTarget(outreq.URL)
+		outreq.Host = t.url.Host
+		outreq, span := startAttemptSpan(outreq, ut.route, t)
+
+		start := time.Now()
+		t.inFlight.Add(1)
+		resp, cond, err := ut.try(outreq, policy)
+		t.inFlight.Add(-1)
+		latency := time.Since(start)
+		endAttemptSpan(span, resp, err)
+		if failed, known := attemptOutcome(req, err, cond); known {
+			t.record(failed, latency)
+			if failed {
+				t.markFailed()
+			}
+			if t.breaker != nil {
+				t.breaker.Record(failed, latency)
+			}
+		} else if t.breaker != nil {
+			t.breaker.Release()
+		}
+		ut.rp.metrics.Load().observeAttempt(ut.route, t, resp, latency)
+		if pr := proxyRequestFrom(req); pr != nil {
+			pr.recordAttempt(t, resp, latency)
+		}
+		if attempt >= attempts || cond == "" || !policy.retriesOn(cond) {
+			return resp, err
+		}
+		if resp != nil {
+			// the response is discarded: draining it allows reusing the connection
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		wait := policy.backoff(attempt)
+		logRequestf(req, "Retrying request to %s%s (%s): attempt %d of %d in %s", t.host, req.URL.Path, cond, attempt+1, attempts, wait)
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// acquire returns the first target of the pool the request can be sent to, skipping the ones with an open circuit
+func (ut *upstreamTransport) acquire(pool *targetPool, tried map[*target]bool) (*target, error) {
+	candidates := pool.candidates(tried)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("route %s: %w", ut.route.name(), ErrNoTargetAvailable)
+	}
+	for _, t := range candidates {
+		if t.breaker == nil || t.breaker.Allow() {
+			return t, nil
+		}
+	}
+	return nil, ErrCircuitOpen
+}
+
+// try performs a single attempt, returning the failure condition of the attempt if it failed
+func (ut *upstreamTransport) try(req *http.Request, policy *RetryPolicy) (*http.Response, RetryCondition, error) {
+	if policy == nil || policy.PerTryTimeout <= 0 {
+		resp, err := ut.base.RoundTrip(req)
+		return resp, failureCondition(req, resp, err), err
+	}
+
+	// the timer only bounds the wait for the response headers, not the reading of the body
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(policy.PerTryTimeout, cancel)
+	resp, err := ut.base.RoundTrip(req.WithContext(ctx))
+	if timedOut := !timer.Stop(); timedOut && req.Context().Err() == nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, RetryOnTimeout, fmt.Errorf("upstream did not answer within %s: %w", policy.PerTryTimeout, context.DeadlineExceeded)
+	}
+	if err != nil {
+		cancel()
+		return nil, failureCondition(req, nil, err), err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, failureCondition(req, resp, nil), nil
+}
+
+// failureCondition classifies the outcome of an attempt: an empty condition means success,
+// or a failure which must never be retried like a request canceled by the client
+func failureCondition(req *http.Request, resp *http.Response, err error) RetryCondition {
+	switch {
+	case err != nil:
+		if req.Context().Err() != nil || !isConnectError(err) {
+			return ""
+		}
+		return RetryOnConnectError
+	case resp.StatusCode == http.StatusBadGateway:
+		return RetryOn502
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		return RetryOn503
+	case resp.StatusCode == http.StatusGatewayTimeout:
+		return RetryOn504
+	}
+	return ""
+}
+
+// attemptOutcome tells if an attempt failed for the health of its target: the timeouts and any other
+// error of the transport are failures, while the outcome of the attempts canceled by their clients is unknown
+func attemptOutcome(req *http.Request, err error, cond RetryCondition) (failed, known bool) {
+	if err == nil {
+		return cond != "", true
+	}
+	if clientCanceled(req) {
+		return false, false
+	}
+	return true, true
+}
+
+// clientCanceled tells if the context of a request was canceled by the client going away, rather than
+// by a timeout of the proxy, which cancels it with its own cause
+func clientCanceled(req *http.Request) bool {
+	ctx := req.Context()
+	return ctx.Err() != nil && context.Cause(ctx) == context.Canceled
+}
+
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// bufferBody reads the request body in memory up to the given limit, so that it can be sent again.
+// When the body is larger than the limit it's left readable as a stream and false is returned.
+func bufferBody(req *http.Request, limit int64) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	if req.ContentLength > limit {
+		return nil, false
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil || int64(len(buf)) > limit {
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return nil, false
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(buf))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	return buf, true
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// cancelOnClose releases the context of an attempt once its response body has been consumed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
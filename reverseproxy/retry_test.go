@@ -0,0 +1,160 @@
+package reverseproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := &RetryPolicy{BackoffBase: 100 * time.Millisecond, BackoffMax: time.Second}
+	bounds := map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		4: 800 * time.Millisecond,
+		5: time.Second,
+		// the shift overflows without breaking the cap
+		80: time.Second,
+	}
+	for retry, bound := range bounds {
+		for i := 0; i < 100; i++ {
+			if wait := policy.backoff(retry); wait < 0 || wait > bound {
+				t.Fatalf("backoff(%d) = %s, want between 0 and %s", retry, wait, bound)
+			}
+		}
+	}
+	if wait := (&RetryPolicy{}).backoff(3); wait != 0 {
+		t.Errorf("backoff without BackoffBase = %s, want 0", wait)
+	}
+}
+
+func TestRetryPolicyRetriesOn(t *testing.T) {
+	defaults := &RetryPolicy{}
+	if !defaults.retriesOn(RetryOnConnectError) || defaults.retriesOn(RetryOn503) {
+		t.Error("the default policy must retry only on connect errors")
+	}
+	policy := &RetryPolicy{RetryOn: []RetryCondition{RetryOn503, RetryOnTimeout}}
+	for cond, want := range map[RetryCondition]bool{
+		RetryOn503: true, RetryOnTimeout: true, RetryOnConnectError: false, RetryOn502: false,
+	} {
+		if got := policy.retriesOn(cond); got != want {
+			t.Errorf("retriesOn(%s) = %v, want %v", cond, got, want)
+		}
+	}
+}
+
+// failingUpstream answers 503 to the first failures requests, then 200
+func failingUpstream(t *testing.T, failures int32, calls *atomic.Int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if calls.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func serve(handler http.Handler, method, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(method, "http://example.com"+path, nil))
+	return rec
+}
+
+func TestRetryOnStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		policy    RetryPolicy
+		wantCode  int
+		wantCalls int32
+	}{
+		{name: "retried", method: http.MethodGet, policy: RetryPolicy{Attempts: 3, RetryOn: []RetryCondition{RetryOn503}},
+			wantCode: http.StatusOK, wantCalls: 3},
+		{name: "attempts exhausted", method: http.MethodGet, policy: RetryPolicy{Attempts: 2, RetryOn: []RetryCondition{RetryOn503}},
+			wantCode: http.StatusServiceUnavailable, wantCalls: 2},
+		{name: "condition not listed", method: http.MethodGet, policy: RetryPolicy{Attempts: 3},
+			wantCode: http.StatusServiceUnavailable, wantCalls: 1},
+		{name: "non-idempotent", method: http.MethodPost, policy: RetryPolicy{Attempts: 3, RetryOn: []RetryCondition{RetryOn503}},
+			wantCode: http.StatusServiceUnavailable, wantCalls: 1},
+		{name: "non-idempotent allowed", method: http.MethodPost, policy: RetryPolicy{Attempts: 3,
+			RetryOn: []RetryCondition{RetryOn503}, RetryNonIdempotent: true}, wantCode: http.StatusOK, wantCalls: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			upstream := failingUpstream(t, 2, &calls)
+			policy := tt.policy
+			handler := http.HandlerFunc(New(PathPrefixRoutesMap{"/api/": TargetHost(upstream.URL)}).
+				WithRouteConfig("/api/", RouteConfig{Retry: &policy}).
+				handleFunc)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(tt.method, "http://example.com/api/", strings.NewReader("payload")))
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusOK && rec.Body.String() != "payload" {
+				t.Errorf("body = %q, want the replayed request body", rec.Body.String())
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("upstream calls = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryOnConnectErrorUsesAnotherTarget(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	var calls atomic.Int32
+	live := failingUpstream(t, 0, &calls)
+
+	handler := http.HandlerFunc(New(PathPrefixRoutesMap{"/api/": TargetHost(dead.URL)}).
+		WithRouteConfig("/api/", RouteConfig{Targets: []TargetHost{TargetHost(live.URL)}, Retry: &RetryPolicy{Attempts: 2}}).
+		handleFunc)
+
+	for i := 0; i < 4; i++ {
+		if rec := serve(handler, http.MethodGet, "/api/"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want %d", i, rec.Code, http.StatusOK)
+		}
+	}
+	if got := calls.Load(); got != 4 {
+		t.Errorf("live target calls = %d, want 4", got)
+	}
+}
+
+func TestRetryPerTryTimeout(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	handler := http.HandlerFunc(New(PathPrefixRoutesMap{"/api/": TargetHost(upstream.URL)}).
+		WithRouteConfig("/api/", RouteConfig{Retry: &RetryPolicy{Attempts: 2, PerTryTimeout: 50 * time.Millisecond,
+			RetryOn: []RetryCondition{RetryOnTimeout}}}).
+		handleFunc)
+
+	rec := serve(handler, http.MethodGet, "/api/")
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Errorf("got %d %q, want 200 ok after the timed out attempt", rec.Code, rec.Body.String())
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("upstream calls = %d, want 2", got)
+	}
+}
@@ -8,6 +8,12 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gyozatech/temaki"
+	"github.com/gyozatech/temaki/metrics"
 )
 
 // Middleware represent a HTTP middleware for all incoming requests
@@ -30,10 +36,21 @@ type PathPrefixRoutesMap map[PathPrefix]TargetHost
 
 // ReverseProxy is the instance of the reverse proxy server
 type ReverseProxy struct {
-	middlewares         []Middleware
-	pathPrefixRoutesMap PathPrefixRoutesMap
-	modifyRequest       ModifyRequest
-	modifyResponse      ModifyResponse
+	middlewares []Middleware
+	table       atomic.Pointer[routingTable]
+	// mu serializes the changes of the routing table made at runtime
+	mu        sync.Mutex
+	forwarder atomic.Pointer[forwarder]
+	modifiers []*modifierChain
+	cache     atomic.Pointer[responseCache]
+	// serverTimeouts bounds the client connections of the servers started by Start and StartTLS
+	serverTimeouts ServerTimeouts
+	errorHandler   ErrorHandler
+	// connect enables the CONNECT forward proxy mode when not nil
+	connect      atomic.Pointer[ConnectConfig]
+	accessLogger AccessLogger
+	metrics      atomic.Pointer[proxyMetrics]
+	configErr    error
 }
 
 // WithMiddlewares allows specifying the http middleware to be applied to all routes
@@ -45,15 +62,18 @@ func (rp *ReverseProxy) WithMiddlewares(middlewares ...Middleware) *ReverseProxy
 	return rp
 }
 
-// WithModifyRequest adds a request modifier to the reverse proxy
+// WithModifyRequest adds a request modifier run for every route, after the ones added before
 func (rp *ReverseProxy) WithModifyRequest(mreq ModifyRequest) *ReverseProxy {
-	rp.modifyRequest = mreq
-	return rp
+	return rp.WithRequestModifier(func(req *http.Request) *http.Response {
+		mreq(req)
+		return nil
+	})
 }
 
-// WithModifyResponse adds a response modifier to the reverse proxy
+// WithModifyResponse adds a response modifier run for every route, after the ones added before
 func (rp *ReverseProxy) WithModifyResponse(mresp ModifyResponse) *ReverseProxy {
-	rp.modifyResponse = mresp
+	c := rp.chain("")
+	c.response = append(c.response, mresp)
 	return rp
 }
 
@@ -72,12 +92,16 @@ func CollectPathPrefixRoutesFromEnvVar() PathPrefixRoutesMap {
 	var envVars []string = os.Environ()
 	for _, envVar := range envVars {
 
-		envVarName := strings.Split(envVar, "=")[0]
-		envVarValue := strings.Split(envVar, "=")[1]
+		// only the first "=" separates the name, as the value can contain more of them (e.g. in the query)
+		envVarName, envVarValue, _ := strings.Cut(envVar, "=")
 
 		if strings.HasPrefix(envVarName, "PROXY_RULE_") {
-			proxyRule := strings.Split(envVarValue, ">")
-			routesMap[PathPrefix(proxyRule[0])] = TargetHost(proxyRule[1])
+			prefix, target, found := strings.Cut(envVarValue, ">")
+			if !found {
+				log.Printf("Ignoring malformed proxy rule %s: expected <pathprefix>><target>", envVarName)
+				continue
+			}
+			routesMap[PathPrefix(prefix)] = TargetHost(target)
 		}
 	}
 	return routesMap
@@ -92,96 +116,218 @@ func (rp *ReverseProxy) applyMiddlewares(handler http.Handler) http.Handler {
 
 // New is used to create a new instance of a reverse proxy
 func New(routes PathPrefixRoutesMap) *ReverseProxy {
-	return &ReverseProxy{
-		middlewares:         []Middleware{},
-		pathPrefixRoutesMap: adaptRoutesMap(routes),
+	// the default transport can't fail as it doesn't load any certificate
+	transport, _ := NewTransport(TransportConfig{})
+	rp := &ReverseProxy{
+		middlewares:  []Middleware{},
+		accessLogger: JSONAccessLogger,
+	}
+	rp.metrics.Store(newProxyMetrics(metrics.Default))
+	rp.table.Store(newRoutingTable(transport, TransportConfig{}))
+	rp.forwarder.Store(&forwarder{})
+	rp.cache.Store(newResponseCache(NewMemoryCacheStore(defaultCacheSize)))
+	if err := rp.addRoutes(rp.table.Load(), "", routes); err != nil {
+		rp.setConfigError(err)
+	}
+	return rp
+}
+
+// setConfigError keeps the first configuration error, to be returned by Start
+func (rp *ReverseProxy) setConfigError(err error) {
+	log.Printf("Reverse proxy configuration error: %v", err)
+	if rp.configErr == nil {
+		rp.configErr = err
 	}
 }
 
 func adaptRoutesMap(routes PathPrefixRoutesMap) PathPrefixRoutesMap {
 	adaptedRoutesMap := make(PathPrefixRoutesMap, 0)
 	for prefix, host := range routes {
-		prefixStr := strings.ReplaceAll(string(prefix), " ", "")
-		hostStr := strings.ReplaceAll(string(host), " ", "")
-		if !strings.HasPrefix(prefixStr, "/") {
-			prefixStr = "/" + prefixStr
-		}
-		if !strings.HasSuffix(prefixStr, "/") {
-			prefixStr = prefixStr + "/"
-		}
-		if !strings.HasPrefix(hostStr, "http") && !strings.HasPrefix(hostStr, "ws") {
-			// setting http as default protocol if no https/http or wss/ws protocol is specified
-			hostStr = "http://" + hostStr
-		}
-		adaptedRoutesMap[PathPrefix(prefixStr)] = TargetHost(strings.TrimSuffix(hostStr, "/"))
+		adaptedRoutesMap[normalizePathPrefix(prefix)] = normalizeTargetHost(host)
 	}
 	return adaptedRoutesMap
 }
 
 // Start starts the reverse proxy on the specified port
 func (rp *ReverseProxy) Start(port int) error {
-	// we manage every prefix from a single / root path to avoid inconvenient HTTP statuses 302
-	http.Handle("/", rp.applyMiddlewares(toHTTPHandler(rp.handleFunc)))
-
+	if rp.configErr != nil {
+		return rp.configErr
+	}
 	log.Printf("Starting reverse proxy server on port %d", port)
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	return rp.newServer(port).ListenAndServe()
+}
+
+func (rp *ReverseProxy) handler() http.Handler {
+	// we manage every prefix from a single / root path to avoid inconvenient HTTP statuses 302
+	mux := http.NewServeMux()
+	mux.Handle("/", rp.applyMiddlewares(toHTTPHandler(rp.handleFunc)))
+	// the CONNECT requests have no path to be routed by the mux
+	connect := rp.applyMiddlewares(toHTTPHandler(func(w http.ResponseWriter, req *http.Request) {
+		rp.serveConnect(w, withRequestID(w, req), rp.connect.Load())
+	}))
+	return toHTTPHandler(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodConnect && rp.connect.Load() != nil {
+			connect.ServeHTTP(w, req)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
 }
 
 func (rp *ReverseProxy) handleFunc(w http.ResponseWriter, req *http.Request) {
-	for pathPrefix, targetHost := range rp.pathPrefixRoutesMap {
-		if strings.HasPrefix(req.URL.Path, strings.TrimSuffix(string(pathPrefix), "/")) {
-			targetURL, err := url.Parse(string(targetHost))
-			if err != nil {
-				log.Printf("Error parsing target URL: %v", err)
-				http.Error(w, fmt.Sprintf("Error parsing target URL: %s", err), http.StatusInternalServerError)
-				return
-			}
+	req = withRequestID(w, req)
+	route := rp.table.Load().match(req)
+	if route != nil {
+		req = temaki.SetRoutePattern(req, route.name())
+	}
+	if route != nil && !route.disabled && route.proxy != nil {
+		// Upgrade request tunneled *******
+		if protocol := upgradeProtocol(req); protocol != "" && route.config.Tunnel.tunnels(protocol) {
+			rp.serveTunnel(w, req, route, protocol)
+			return
+		}
 
-			proxy := httputil.NewSingleHostReverseProxy(targetURL)
+		// WebSocket request *******
+		if isWebSocketRequest(req) {
+			rp.serveWebSocket(w, req, route)
+			return
+		}
+	}
 
-			originalDirector := proxy.Director
-			proxy.Director = func(req *http.Request) {
-				originalDirector(req)
-				if rp.modifyRequest != nil {
-					rp.modifyRequest(req)
-				}
-				req.Header.Set("X-Forwarded-Host", req.Host)
-				req.Header.Set("X-Real-IP", req.RemoteAddr)
-
-				rewritePath := string(pathPrefix)
-				if rewritePath != "" && strings.HasPrefix(req.URL.Path, rewritePath) {
-					newPath := strings.TrimPrefix(req.URL.Path, rewritePath)
-					if !strings.HasPrefix(newPath, "/") {
-						newPath = "/" + newPath
-					}
-					req.URL.Path = newPath
-				}
-				req.Host = targetURL.Host
-			}
+	// HTTP/HTTPS request ******
+	start := time.Now()
+	aw := &accessWriter{ResponseWriter: w}
+	req = withProxyRequest(w, req)
+	var body *countingBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &countingBody{ReadCloser: req.Body}
+		req.Body = body
+	}
+	defer rp.logAccess(req, route, aw, body, start)
 
-			// WebSocket request *******
-			if isWebSocketRequest(req) {
-				log.Println("Handling WebSocket Upgrade...")
-				handleWebSocket(w, req, string(targetHost))
-				return
-			}
+	if route == nil {
+		rp.handleError(aw, req, &ProxyError{Kind: ErrorKindNoRoute, Status: http.StatusNotFound,
+			Detail: "no route matches the request"})
+		return
+	}
+	if route.disabled {
+		rp.handleError(aw, req, &ProxyError{Kind: ErrorKindRouteDisabled, Status: http.StatusServiceUnavailable,
+			Route: route.name(), Detail: "the service is temporarily unavailable"})
+		return
+	}
+	if route.proxy == nil {
+		rp.handleError(aw, req, &ProxyError{Kind: ErrorKindInternal, Status: http.StatusInternalServerError,
+			Route: route.name(), Detail: "the route is misconfigured", Err: fmt.Errorf("error parsing target URL: %s", route.target)})
+		return
+	}
+	if limits := route.config.Limits; limits != nil {
+		// the limits get the writer of the server, which closes the connection after a body too large
+		limited, cancel, err := limits.apply(w, req)
+		if err != nil {
+			perr := classifyError(req, err, limits)
+			perr.Route = route.name()
+			rp.handleError(aw, req, perr)
+			return
+		}
+		defer cancel()
+		req = limited
+	}
+	route.proxy.ServeHTTP(aw, req)
+}
 
-			// HTTP/HTTPS request ******
-			// Modify response before sending to client (only for http/https not ws/wss)
-			if rp.modifyResponse != nil {
-				proxy.ModifyResponse = rp.modifyResponse
+// newProxy creates the long-lived proxy of a route: the modifiers of the reverse proxy are read at
+// every request, so that they can be set after the creation of the route
+func (rp *ReverseProxy) newProxy(route *route, transport http.RoundTripper) (*httputil.ReverseProxy, error) {
+	targetURL, err := url.Parse(string(route.target))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing target URL: %w", err)
+	}
+
+	proxy := &httputil.ReverseProxy{FlushInterval: route.config.FlushInterval}
+	// the upstream transport balances among the targets of the route and retries failed attempts
+	proxy.Transport = &upstreamTransport{rp: rp, route: route, base: transport}
+	if route.mirror != nil {
+		proxy.Transport = &mirroringTransport{mirror: route.mirror, next: proxy.Transport, base: transport}
+	}
+	if route.config.Cache != nil {
+		proxy.Transport = &cachingTransport{rp: rp, route: route, next: proxy.Transport}
+	}
+
+	proxy.Director = func(req *http.Request) {
+		if pr := proxyRequestFrom(req); pr != nil && route.config.Canary != nil {
+			pr.canary, pr.stickyCookie = route.config.Canary.variant(pr.inbound)
+		}
+		req.URL.Scheme = targetURL.Scheme
+		req.URL.Host = targetURL.Host
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// explicitly disable User-Agent so it's not set to default value
+			req.Header.Set("User-Agent", "")
+		}
+		rp.forwarder.Load().apply(req)
+		if resp := rp.modifyRequest(req, req.URL.Path); resp != nil {
+			// the upstream transport returns the response without contacting the targets
+			if pr := proxyRequestFrom(req); pr != nil {
+				pr.response = resp
 			}
+			return
+		}
+		if route.config.Headers != nil {
+			route.config.Headers.applyRequest(rp, req)
+		}
 
-			// Handle errors (optional)
-			proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-				http.Error(w, "Proxy Error: "+err.Error(), http.StatusBadGateway)
+		// the path is rewritten here, while the base path of the target is added by the upstream transport
+		route.rewritePath(req.URL)
+		req.Host = targetURL.Host
+
+		if route.config.GRPC != nil && route.config.GRPC.Web {
+			if protocol := protocolOf(req.Header); protocol == grpcWeb || protocol == grpcWebText {
+				translateGRPCWebRequest(req, protocol)
+				if pr := proxyRequestFrom(req); pr != nil {
+					pr.grpcWeb = protocol
+				}
 			}
-			log.Printf("Proxying request to target: %s%s", targetHost, req.URL.Path)
-			proxy.ServeHTTP(w, req)
+		}
+	}
+
+	// Modify response before sending to client (only for http/https not ws/wss)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		pr := proxyRequestFrom(resp.Request)
+		// the ID of the request is already echoed by the proxy, unless the target answers with its own
+		if header := temaki.RequestIDHeaderOf(resp.Request); pr != nil && len(resp.Header.Values(header)) > 0 {
+			pr.header.Del(header)
+		}
+		if pr != nil && route.config.Cache != nil {
+			pr.mu.Lock()
+			pr.cache = resp.Header.Get("X-Cache")
+			pr.mu.Unlock()
+		}
+		if pr != nil && pr.stickyCookie && route.config.Canary != nil {
+			resp.Header.Add("Set-Cookie", route.config.Canary.stickyCookie(pr.canary).String())
+		}
+		if route.config.Headers != nil {
+			route.config.Headers.applyResponse(rp, resp)
+		}
+		if err := rp.modifyResponse(resp, inboundRequest(resp.Request).URL.Path); err != nil {
+			return err
+		}
+		if pr != nil && pr.grpcWeb != notGRPC {
+			translateGRPCWebResponse(resp, pr.grpcWeb)
+		}
+		return nil
+	}
+
+	// Handle errors (optional)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		perr := classifyError(r, err, route.config.Limits)
+		perr.Route = route.name()
+		if perr.Kind == ErrorKindCircuitOpen && route.config.CircuitBreaker != nil && route.config.CircuitBreaker.OpenResponse != nil {
+			logRequestf(r, "Proxy error %s %s (route %q): %v", r.Method, r.URL.Path, perr.Route, perr)
+			route.config.CircuitBreaker.OpenResponse(w, r)
 			return
 		}
+		rp.handleError(w, r, perr)
 	}
-	http.Error(w, "Not Found", http.StatusNotFound)
+	return proxy, nil
 }
 
 // convert a func(http.ResponseWriter, *http.Request) into an http.Handler to adapt http.HandleFunc to http.Handle
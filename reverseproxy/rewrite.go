@@ -0,0 +1,86 @@
+package reverseproxy
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// PathRewrite configures how the path of a request is rewritten before being proxied.
+// By default the PathPrefix is removed from the path. The rewritten path is then appended to the
+// path of the target URL, so that a target like https://api.weather.com/v2 acts as upstream base path.
+// The rewriting works on the escaped form of the path, so that encoded characters like %2F are preserved.
+type PathRewrite struct {
+	// KeepPrefix forwards the path with its PathPrefix: ReplacePrefix is ignored when set
+	KeepPrefix bool `json:"keepPrefix,omitempty"`
+	// ReplacePrefix replaces the PathPrefix with the given path instead of removing it
+	ReplacePrefix string `json:"replacePrefix,omitempty"`
+	// Regex is matched against the path after the prefix handling, and its matches are replaced with
+	// Replacement, which can reference the capture groups like $1 or ${name}
+	Regex       string `json:"regex,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// rewritePath applies the path rewriting of the route to the given URL
+func (r *route) rewritePath(u *url.URL) {
+	escaped := u.EscapedPath()
+	rewrite := r.config.PathRewrite
+	if rewrite == nil {
+		rewrite = &PathRewrite{}
+	}
+
+	if !rewrite.KeepPrefix {
+		rest := strings.TrimPrefix(escaped, strings.TrimSuffix(string(r.prefix), "/"))
+		escaped = strings.TrimSuffix(rewrite.ReplacePrefix, "/") + rest
+		if !strings.HasPrefix(escaped, "/") {
+			escaped = "/" + escaped
+		}
+	}
+	if r.rewriteRegex != nil {
+		escaped = r.rewriteRegex.ReplaceAllString(escaped, rewrite.Replacement)
+	}
+	setEscapedPath(u, escaped)
+}
+
+// compileRewrite compiles the regular expression of the path rewriting of the route, if any
+func (r *route) compileRewrite() error {
+	r.rewriteRegex = nil
+	if r.config.PathRewrite == nil || r.config.PathRewrite.Regex == "" {
+		return nil
+	}
+	rgx, err := regexp.Compile(r.config.PathRewrite.Regex)
+	if err != nil {
+		return err
+	}
+	r.rewriteRegex = rgx
+	return nil
+}
+
+// applyTarget points the given URL to the target, prepending the path of the target URL as base path
+// and merging its query
+func (t *target) applyTarget(u *url.URL) {
+	u.Scheme = t.url.Scheme
+	u.Host = t.url.Host
+	if base := strings.TrimSuffix(t.url.EscapedPath(), "/"); base != "" {
+		setEscapedPath(u, base+u.EscapedPath())
+	}
+	if t.url.RawQuery != "" {
+		if u.RawQuery == "" {
+			u.RawQuery = t.url.RawQuery
+		} else {
+			u.RawQuery = t.url.RawQuery + "&" + u.RawQuery
+		}
+	}
+}
+
+// setEscapedPath sets both Path and RawPath of the URL from the escaped form of a path
+func setEscapedPath(u *url.URL, escaped string) {
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		u.Path = escaped
+		u.RawPath = ""
+		return
+	}
+	u.Path = path
+	u.RawPath = escaped
+}
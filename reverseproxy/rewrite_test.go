@@ -0,0 +1,97 @@
+package reverseproxy
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRewritePath(t *testing.T) {
+	tests := []struct {
+		name     string
+		rewrite  *PathRewrite
+		path     string
+		wantPath string
+		// wantEscaped is the escaped path forwarded to the target, wantPath when empty
+		wantEscaped string
+	}{
+		{name: "prefix stripped", path: "/api/users", wantPath: "/users"},
+		{name: "prefix only", path: "/api/", wantPath: "/"},
+		{name: "trailing slash kept", path: "/api/users/", wantPath: "/users/"},
+		{name: "prefix kept", rewrite: &PathRewrite{KeepPrefix: true, ReplacePrefix: "/v2/"}, path: "/api/users", wantPath: "/api/users"},
+		{name: "prefix replaced", rewrite: &PathRewrite{ReplacePrefix: "/v2/"}, path: "/api/users/", wantPath: "/v2/users/"},
+		{name: "relative replacement", rewrite: &PathRewrite{ReplacePrefix: "v2"}, path: "/api/users", wantPath: "/v2/users"},
+		{
+			name:     "regex with capture groups",
+			rewrite:  &PathRewrite{Regex: `^/users/(\d+)/(\w+)$`, Replacement: "/people/$2/$1"},
+			path:     "/api/users/42/orders",
+			wantPath: "/people/orders/42",
+		},
+		{
+			name:     "regex with named groups",
+			rewrite:  &PathRewrite{KeepPrefix: true, Regex: `^/api/(?P<version>v\d)/`, Replacement: "/${version}/api/"},
+			path:     "/api/v1/users",
+			wantPath: "/v1/api/users",
+		},
+		{name: "regex not matching", rewrite: &PathRewrite{Regex: `^/orders`, Replacement: "/o"}, path: "/api/users", wantPath: "/users"},
+		{name: "escaped path", path: "/api/files/a%2Fb%20c", wantPath: "/files/a/b c", wantEscaped: "/files/a%2Fb%20c"},
+		{
+			name:        "regex on the escaped path",
+			rewrite:     &PathRewrite{Regex: `%2F`, Replacement: "%252F"},
+			path:        "/api/a%2Fb",
+			wantPath:    "/a%2Fb",
+			wantEscaped: "/a%252Fb",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &route{prefix: normalizePathPrefix("/api"), config: RouteConfig{PathRewrite: tt.rewrite}}
+			if err := r.compileRewrite(); err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(tt.path + "?q=a%20b&q=c")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.rewritePath(u)
+			wantEscaped := tt.wantEscaped
+			if wantEscaped == "" {
+				wantEscaped = tt.wantPath
+			}
+			if u.Path != tt.wantPath || u.EscapedPath() != wantEscaped {
+				t.Errorf("path = %q (escaped %q), want %q (escaped %q)", u.Path, u.EscapedPath(), tt.wantPath, wantEscaped)
+			}
+			if u.RawQuery != "q=a%20b&q=c" {
+				t.Errorf("query = %q, want it unchanged", u.RawQuery)
+			}
+		})
+	}
+}
+
+func TestApplyTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		path   string
+		want   string
+	}{
+		{target: "http://up:8080", path: "/users?q=1", want: "http://up:8080/users?q=1"},
+		{target: "https://up/v2", path: "/users/", want: "https://up/v2/users/"},
+		{target: "http://up/v2/", path: "/users", want: "http://up/v2/users"},
+		{target: "http://up/v2?key=k", path: "/users?q=1", want: "http://up/v2/users?key=k&q=1"},
+		{target: "http://up/v2?key=k", path: "/users", want: "http://up/v2/users?key=k"},
+		{target: "http://up/base%20dir", path: "/a%2Fb", want: "http://up/base%20dir/a%2Fb"},
+	}
+	for _, tt := range tests {
+		targetURL, err := url.Parse(tt.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newTarget(TargetHost(tt.target), targetURL).applyTarget(u)
+		if got := u.String(); got != tt.want {
+			t.Errorf("target %s, path %s: URL = %s, want %s", tt.target, tt.path, got, tt.want)
+		}
+	}
+}
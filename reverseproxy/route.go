@@ -0,0 +1,199 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// RouteConfig holds the optional settings of a single route of the reverse proxy
+type RouteConfig struct {
+	// Targets lists further hosts serving the same PathPrefix: together with the TargetHost
+	// of the PathPrefixRoutesMap they form the pool of upstreams of the route
+	Targets []TargetHost
+	// Retry is the retry policy of the route: when nil every request is attempted only once
+	Retry *RetryPolicy
+	// CircuitBreaker enables a circuit breaker for each target of the route when not nil
+	CircuitBreaker *CircuitBreakerConfig
+	// Transport configures the connections to the targets of the route: when nil the route uses
+	// the transport shared by the whole reverse proxy
+	Transport *TransportConfig
+	// PathRewrite configures the rewriting of the request path: when nil the PathPrefix is removed
+	PathRewrite *PathRewrite
+	// Limits bounds the time and the body size of the requests when not nil
+	Limits *Limits
+	// Canary sends a share of the requests to a canary group of targets when not nil
+	Canary *CanaryConfig
+	// Mirror sends a copy of a share of the requests to a shadow target when not nil
+	Mirror *MirrorConfig
+	// Cache enables the caching of the responses of the route when not nil
+	Cache *CacheConfig
+	// Headers changes the headers of the requests sent to the targets and of their responses
+	Headers *HeaderRules
+	// WebSocket configures the proxying of the WebSocket connections: when nil the defaults apply
+	WebSocket *WebSocketConfig
+	// Tunnel tunnels the Upgrade requests of the listed protocols byte by byte when not nil
+	Tunnel *TunnelConfig
+	// FlushInterval is the interval between the flushes to the client of the response bodies of known length:
+	// when 0 they're written as the buffer fills, while a negative value flushes every write. The Server-Sent
+	// Events and the bodies of unknown length, like chunked streams, are always flushed at every write.
+	FlushInterval time.Duration
+	// GRPC sends the gRPC requests over HTTP/2 to the targets, translating the gRPC-Web ones if enabled
+	GRPC *GRPCConfig
+}
+
+// route is a PathPrefix of a virtual host with its configuration and upstream pool
+type route struct {
+	host   VirtualHost
+	prefix PathPrefix
+	target TargetHost
+	config RouteConfig
+	pool   *targetPool
+	proxy  *httputil.ReverseProxy
+	// canaryPool balances the canary targets, nil when the route has no canary
+	canaryPool *targetPool
+	// transport is the transport of the route when it has its own, nil when it uses the shared one
+	transport *http.Transport
+	// cache is the cache of the route when it has its own store, nil when it uses the one of the reverse proxy
+	cache *responseCache
+	// mirror is the shadow target of the route, nil when the requests aren't mirrored
+	mirror *mirror
+	// upstream is the transport whose dialing and TLS configuration open the upgraded connections
+	upstream *http.Transport
+	// wsDialer opens the WebSocket connections to the targets, wsUpgrader the ones of the clients
+	wsDialer   *websocket.Dialer
+	wsUpgrader *websocket.Upgrader
+	// wsConns counts the open WebSocket connections, kept across the updates of the route
+	wsConns *atomic.Int64
+	// grpc is the HTTP/2 transport of the gRPC requests, nil when the route has no GRPCConfig
+	grpc *h2Transport
+	// disabled routes answer 503 without reaching their targets
+	disabled bool
+
+	rewriteRegex *regexp.Regexp
+}
+
+// targets returns the TargetHost of the route followed by the additional ones of its config
+func (r *route) targets() []TargetHost {
+	targets := []TargetHost{r.target}
+	for _, target := range r.config.Targets {
+		targets = append(targets, normalizeTargetHost(target))
+	}
+	return targets
+}
+
+// WithRouteConfig sets the configuration of the route registered in New with the given PathPrefix
+func (rp *ReverseProxy) WithRouteConfig(prefix PathPrefix, cfg RouteConfig) *ReverseProxy {
+	return rp.WithVirtualHostRouteConfig("", prefix, cfg)
+}
+
+// name identifies the route in logs and stats, prefixing the PathPrefix with the virtual host if any
+func (r *route) name() string {
+	return string(r.host) + string(r.prefix)
+}
+
+// setupRoute builds the upstream pool and the proxy of a route of the given routing table from its configuration.
+// When the route replaces a previous version of itself, the targets and the transport of prev are reused.
+func (rp *ReverseProxy) setupRoute(table *routingTable, r *route, prev *route) error {
+	var prevPool, prevCanaryPool *targetPool
+	// the targets are reused only with the same circuit breakers
+	if prev != nil && prev.config.CircuitBreaker.equal(r.config.CircuitBreaker) {
+		prevPool, prevCanaryPool = prev.pool, prev.canaryPool
+	}
+	r.pool = newTargetPool(r.targets(), r.config.CircuitBreaker, prevPool)
+	r.canaryPool = nil
+	if r.config.Canary != nil {
+		r.canaryPool = newTargetPool(r.canaryTargets(), r.config.CircuitBreaker, prevCanaryPool)
+	}
+	if err := r.compileRewrite(); err != nil {
+		return fmt.Errorf("invalid path rewrite regex for route %s: %w", r.name(), err)
+	}
+
+	var transport http.RoundTripper = table.transport
+	r.upstream = table.transport
+	r.transport = nil
+	if r.config.Transport != nil {
+		if prev != nil && prev.transport != nil && prev.config.Transport != nil && *prev.config.Transport == *r.config.Transport {
+			r.transport = prev.transport
+		} else {
+			routeTransport, err := NewTransport(*r.config.Transport)
+			if err != nil {
+				return fmt.Errorf("invalid transport configuration for route %s: %w", r.name(), err)
+			}
+			r.transport = routeTransport
+		}
+		transport = r.transport
+		r.upstream = r.transport
+	}
+	r.grpc = nil
+	if r.config.GRPC != nil {
+		if prev != nil && prev.grpc != nil && prev.upstream == r.upstream {
+			r.grpc = prev.grpc
+		} else {
+			r.grpc = newGRPCTransport(r.upstream)
+		}
+		transport = &grpcTransport{next: transport, h2: r.grpc}
+	}
+	r.wsDialer = newWebSocketDialer(r.upstream, r.config.WebSocket)
+	r.wsUpgrader = newWebSocketUpgrader(r.config.WebSocket)
+	r.wsConns = &atomic.Int64{}
+	if prev != nil && prev.wsConns != nil {
+		r.wsConns = prev.wsConns
+	}
+
+	r.mirror = nil
+	if r.config.Mirror != nil {
+		m, err := newMirror(r.config.Mirror)
+		if err != nil {
+			return fmt.Errorf("invalid mirror for route %s: %w", r.name(), err)
+		}
+		r.mirror = m
+	}
+
+	r.cache = nil
+	if r.config.Cache != nil && r.config.Cache.Store != nil {
+		if prev != nil && prev.cache != nil && prev.cache.store == r.config.Cache.Store {
+			r.cache = prev.cache
+		} else {
+			r.cache = newResponseCache(r.config.Cache.Store)
+		}
+	}
+
+	proxy, err := rp.newProxy(r, transport)
+	if err != nil {
+		return fmt.Errorf("invalid route %s: %w", r.name(), err)
+	}
+	r.proxy = proxy
+	return nil
+}
+
+// clone copies the route definition, without the pool and the proxy which must be set up again
+func (r *route) clone() *route {
+	return &route{host: r.host, prefix: r.prefix, target: r.target, config: r.config, disabled: r.disabled}
+}
+
+func normalizePathPrefix(prefix PathPrefix) PathPrefix {
+	prefixStr := strings.ReplaceAll(string(prefix), " ", "")
+	if !strings.HasPrefix(prefixStr, "/") {
+		prefixStr = "/" + prefixStr
+	}
+	if !strings.HasSuffix(prefixStr, "/") {
+		prefixStr = prefixStr + "/"
+	}
+	return PathPrefix(prefixStr)
+}
+
+func normalizeTargetHost(host TargetHost) TargetHost {
+	hostStr := strings.ReplaceAll(string(host), " ", "")
+	if !strings.HasPrefix(hostStr, "http") && !strings.HasPrefix(hostStr, "ws") {
+		// setting http as default protocol if no https/http or wss/ws protocol is specified
+		hostStr = "http://" + hostStr
+	}
+	return TargetHost(strings.TrimSuffix(hostStr, "/"))
+}
@@ -0,0 +1,271 @@
+package reverseproxy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrRouteNotFound is returned by the runtime changes addressing a route which doesn't exist
+	ErrRouteNotFound = errors.New("route not found")
+	// ErrTargetNotFound is returned by the runtime changes addressing a target which doesn't exist
+	ErrTargetNotFound = errors.New("target not found")
+	// ErrAlreadyExists is returned when adding a route or a target which already exists
+	ErrAlreadyExists = errors.New("already exists")
+)
+
+// RouteStatus describes a route with the state of its targets
+type RouteStatus struct {
+	Host    VirtualHost    `json:"host,omitempty"`
+	Prefix  PathPrefix     `json:"prefix"`
+	Enabled bool           `json:"enabled"`
+	Targets []TargetStatus `json:"targets"`
+	// CanaryWeight and Canary describe the canary targets of the route, if any
+	CanaryWeight float64        `json:"canaryWeight,omitempty"`
+	Canary       []TargetStatus `json:"canary,omitempty"`
+}
+
+// TargetStatus describes a target of a route with its stats
+type TargetStatus struct {
+	Target     TargetHost `json:"target"`
+	Weight     int64      `json:"weight"`
+	Enabled    bool       `json:"enabled"`
+	Healthy    bool       `json:"healthy"`
+	Circuit    string     `json:"circuit,omitempty"`
+	Requests   int64      `json:"requests"`
+	Failures   int64      `json:"failures"`
+	InFlight   int64      `json:"inFlight"`
+	AvgLatency Duration   `json:"avgLatency"`
+}
+
+// Status returns the routes of all the virtual hosts with the state and the stats of their targets
+func (rp *ReverseProxy) Status() []RouteStatus {
+	routes := rp.table.Load().routes()
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].name() < routes[j].name()
+	})
+
+	statuses := []RouteStatus{}
+	for _, r := range routes {
+		status := RouteStatus{Host: r.host, Prefix: r.prefix, Enabled: !r.disabled, Targets: targetStatuses(r.pool)}
+		if r.canaryPool != nil {
+			status.CanaryWeight = r.config.Canary.Weight
+			status.Canary = targetStatuses(r.canaryPool)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func targetStatuses(pool *targetPool) []TargetStatus {
+	statuses := []TargetStatus{}
+	for _, t := range pool.targets {
+		ts := TargetStatus{
+			Target:   t.host,
+			Weight:   t.weight.Load(),
+			Enabled:  !t.disabled.Load(),
+			Healthy:  t.healthy(),
+			Requests: t.requests.Load(),
+			Failures: t.failures.Load(),
+			InFlight: t.inFlight.Load(),
+		}
+		if ts.Requests > 0 {
+			ts.AvgLatency = Duration(time.Duration(t.latencyNs.Load() / ts.Requests))
+		}
+		if t.breaker != nil {
+			ts.Circuit = t.breaker.State().String()
+		}
+		statuses = append(statuses, ts)
+	}
+	return statuses
+}
+
+// updateTable applies a change to a copy of the routing table, which replaces the one in use only if
+// the change succeeds: the in-flight requests complete on the previous table
+func (rp *ReverseProxy) updateTable(change func(table *routingTable) error) error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	old := rp.table.Load()
+	table := old.clone()
+	if err := change(table); err != nil {
+		return err
+	}
+	rp.table.Store(table)
+	closeReplacedTransports(old, table)
+	return nil
+}
+
+// findRoute returns the route of the table with the given virtual host and PathPrefix
+func findRoute(table *routingTable, host VirtualHost, prefix PathPrefix) (*virtualHost, *route, error) {
+	vh, found := table.hosts[normalizeVirtualHost(host)]
+	if !found {
+		return nil, nil, fmt.Errorf("%s%s: %w", host, prefix, ErrRouteNotFound)
+	}
+	r, found := vh.routes[normalizePathPrefix(prefix)]
+	if !found {
+		return nil, nil, fmt.Errorf("%s%s: %w", host, prefix, ErrRouteNotFound)
+	}
+	return vh, r, nil
+}
+
+// replaceRoute changes a copy of the given route, which replaces it in the virtual host
+func (rp *ReverseProxy) replaceRoute(table *routingTable, vh *virtualHost, r *route, change func(c *route) error) error {
+	c := r.clone()
+	if err := change(c); err != nil {
+		return err
+	}
+	if err := rp.setupRoute(table, c, r); err != nil {
+		return err
+	}
+	vh.addRoute(c)
+	return nil
+}
+
+// AddRoute adds a route to the given virtual host (the empty one for the routes served for any host)
+func (rp *ReverseProxy) AddRoute(host VirtualHost, spec RouteSpec) error {
+	var errs []error
+	validateRoutes("route", []RouteSpec{spec}, func(field, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	})
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	host = normalizeVirtualHost(host)
+	return rp.updateTable(func(table *routingTable) error {
+		vh := table.virtualHost(host)
+		if _, found := vh.routes[normalizePathPrefix(spec.Prefix)]; found {
+			return fmt.Errorf("route %s%s: %w", host, spec.Prefix, ErrAlreadyExists)
+		}
+		r, err := rp.buildRoute(table, host, spec, nil)
+		if err != nil {
+			return err
+		}
+		vh.addRoute(r)
+		return nil
+	})
+}
+
+// RemoveRoute removes a route: its in-flight requests are completed
+func (rp *ReverseProxy) RemoveRoute(host VirtualHost, prefix PathPrefix) error {
+	return rp.updateTable(func(table *routingTable) error {
+		vh, r, err := findRoute(table, host, prefix)
+		if err != nil {
+			return err
+		}
+		vh.removeRoute(r.prefix)
+		if len(vh.routes) == 0 && vh.certificate == nil && vh.name != "" {
+			delete(table.hosts, vh.name)
+		}
+		return nil
+	})
+}
+
+// SetRouteEnabled enables or disables a route: a disabled route answers 503 Service Unavailable
+func (rp *ReverseProxy) SetRouteEnabled(host VirtualHost, prefix PathPrefix, enabled bool) error {
+	return rp.updateTable(func(table *routingTable) error {
+		vh, r, err := findRoute(table, host, prefix)
+		if err != nil {
+			return err
+		}
+		return rp.replaceRoute(table, vh, r, func(c *route) error {
+			c.disabled = !enabled
+			return nil
+		})
+	})
+}
+
+// AddTarget adds a target with the given weight to a route
+func (rp *ReverseProxy) AddTarget(host VirtualHost, prefix PathPrefix, target TargetHost, weight int64) error {
+	if weight < 0 {
+		return fmt.Errorf("invalid weight %d", weight)
+	}
+	target = normalizeTargetHost(target)
+	return rp.updateTable(func(table *routingTable) error {
+		vh, r, err := findRoute(table, host, prefix)
+		if err != nil {
+			return err
+		}
+		if r.pool.find(target) != nil {
+			return fmt.Errorf("target %s: %w", target, ErrAlreadyExists)
+		}
+		err = rp.replaceRoute(table, vh, r, func(c *route) error {
+			c.config.Targets = append(slices.Clone(c.config.Targets), target)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if t := vh.routes[r.prefix].pool.find(target); t != nil {
+			t.weight.Store(weight)
+			return nil
+		}
+		return fmt.Errorf("invalid target %s", target)
+	})
+}
+
+// RemoveTarget removes a target from a route: the last target of a route can't be removed
+func (rp *ReverseProxy) RemoveTarget(host VirtualHost, prefix PathPrefix, target TargetHost) error {
+	target = normalizeTargetHost(target)
+	return rp.updateTable(func(table *routingTable) error {
+		vh, r, err := findRoute(table, host, prefix)
+		if err != nil {
+			return err
+		}
+		if r.pool.find(target) == nil {
+			return fmt.Errorf("%s: %w", target, ErrTargetNotFound)
+		}
+		return rp.replaceRoute(table, vh, r, func(c *route) error {
+			targets := slices.DeleteFunc(c.targets(), func(t TargetHost) bool { return t == target })
+			if len(targets) == 0 {
+				return fmt.Errorf("can't remove the last target of route %s", r.name())
+			}
+			c.target = targets[0]
+			c.config.Targets = targets[1:]
+			return nil
+		})
+	})
+}
+
+// SetTargetEnabled enables or disables a target of a route, canary targets included: a disabled target is drained,
+// receiving no new requests
+func (rp *ReverseProxy) SetTargetEnabled(host VirtualHost, prefix PathPrefix, target TargetHost, enabled bool) error {
+	t, err := rp.findTarget(host, prefix, target)
+	if err != nil {
+		return err
+	}
+	t.disabled.Store(!enabled)
+	return nil
+}
+
+// SetTargetWeight changes the share of requests of a target of a route, canary targets included: a target with
+// weight 0 receives no requests
+func (rp *ReverseProxy) SetTargetWeight(host VirtualHost, prefix PathPrefix, target TargetHost, weight int64) error {
+	if weight < 0 {
+		return fmt.Errorf("invalid weight %d", weight)
+	}
+	t, err := rp.findTarget(host, prefix, target)
+	if err != nil {
+		return err
+	}
+	t.weight.Store(weight)
+	return nil
+}
+
+func (rp *ReverseProxy) findTarget(host VirtualHost, prefix PathPrefix, target TargetHost) (*target, error) {
+	_, r, err := findRoute(rp.table.Load(), host, prefix)
+	if err != nil {
+		return nil, err
+	}
+	name := normalizeTargetHost(target)
+	t := r.pool.find(name)
+	if t == nil && r.canaryPool != nil {
+		t = r.canaryPool.find(name)
+	}
+	if t == nil {
+		return nil, fmt.Errorf("%s: %w", target, ErrTargetNotFound)
+	}
+	return t, nil
+}
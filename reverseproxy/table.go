@@ -0,0 +1,128 @@
+package reverseproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// routingTable holds the virtual hosts of the reverse proxy with their routes. A configuration reload
+// builds a new table and swaps it atomically, so that the in-flight requests complete on the old one.
+type routingTable struct {
+	hosts map[VirtualHost]*virtualHost
+	// transport is shared by all the routes without a transport of their own
+	transport *http.Transport
+	// transportConfig is the configuration of the shared transport, to reuse it when it doesn't change
+	transportConfig TransportConfig
+}
+
+func newRoutingTable(transport *http.Transport, transportConfig TransportConfig) *routingTable {
+	return &routingTable{hosts: map[VirtualHost]*virtualHost{}, transport: transport, transportConfig: transportConfig}
+}
+
+// clone copies the table and its virtual hosts, sharing the routes: it allows changing the routing
+// at runtime on a copy, which then replaces the table in use
+func (t *routingTable) clone() *routingTable {
+	c := newRoutingTable(t.transport, t.transportConfig)
+	for name, vh := range t.hosts {
+		c.hosts[name] = vh.clone()
+	}
+	return c
+}
+
+// idleConnCloser is a transport whose idle connections can be closed
+type idleConnCloser interface {
+	CloseIdleConnections()
+}
+
+// transports returns the transports of the table and of its routes
+func (t *routingTable) transports() map[idleConnCloser]bool {
+	transports := map[idleConnCloser]bool{t.transport: true}
+	for _, r := range t.routes() {
+		if r.transport != nil {
+			transports[r.transport] = true
+		}
+		if r.grpc != nil {
+			transports[r.grpc] = true
+		}
+	}
+	return transports
+}
+
+// proxiesGRPC tells if a route of the table has a GRPCConfig
+func (t *routingTable) proxiesGRPC() bool {
+	for _, r := range t.routes() {
+		if r.config.GRPC != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// closeReplacedTransports closes the idle connections of the transports of the old table which the new one
+// doesn't use anymore: the connections of the in-flight requests are closed by the IdleConnTimeout once released
+func closeReplacedTransports(old, table *routingTable) {
+	used := table.transports()
+	for transport := range old.transports() {
+		if !used[transport] {
+			transport.CloseIdleConnections()
+		}
+	}
+}
+
+// virtualHost returns the virtual host with the given name, adding it to the table if missing
+func (t *routingTable) virtualHost(name VirtualHost) *virtualHost {
+	vh, found := t.hosts[name]
+	if !found {
+		vh = newVirtualHost(name)
+		t.hosts[name] = vh
+	}
+	return vh
+}
+
+// routes returns the routes of all the virtual hosts
+func (t *routingTable) routes() []*route {
+	var routes []*route
+	for _, vh := range t.hosts {
+		routes = append(routes, vh.sorted...)
+	}
+	return routes
+}
+
+// lookupHost returns the virtual host serving the given host name: an exact match is preferred to the
+// wildcard with the longest domain, and the default virtual host is returned when nothing matches
+func (t *routingTable) lookupHost(hostname string) *virtualHost {
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	if vh, found := t.hosts[VirtualHost(hostname)]; found {
+		return vh
+	}
+	var best *virtualHost
+	for name, vh := range t.hosts {
+		domain, isWildcard := strings.CutPrefix(string(name), "*")
+		if isWildcard && strings.HasSuffix(hostname, domain) && len(hostname) > len(domain) {
+			if best == nil || len(name) > len(best.name) {
+				best = vh
+			}
+		}
+	}
+	if best != nil {
+		return best
+	}
+	return t.hosts[""]
+}
+
+// match returns the route serving the given request, or nil. A virtual host with a certificate but
+// without routes of its own is served by the routes of the default virtual host.
+func (t *routingTable) match(req *http.Request) *route {
+	vh := t.lookupHost(req.Host)
+	if vh != nil && len(vh.sorted) == 0 {
+		vh = t.hosts[""]
+	}
+	if vh == nil {
+		return nil
+	}
+	return vh.match(req.URL.Path)
+}
@@ -0,0 +1,54 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gyozatech/temaki/tracing"
+)
+
+// startAttemptSpan starts the client span of an attempt when the request is traced, like by the Tracing
+// middleware, and propagates it to the target. The traceparent header of the other requests is forwarded
+// as received.
+func startAttemptSpan(req *http.Request, route *route, t *target) (*http.Request, *tracing.Span) {
+	parent := tracing.SpanFromContext(req.Context())
+	if parent == nil {
+		return req, nil
+	}
+	ctx, span := parent.Tracer().Start(req.Context(), req.Method, tracing.SpanKindClient)
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("server.address", t.url.Hostname())
+	if port := t.url.Port(); port != "" {
+		if p, err := strconv.Atoi(port); err == nil {
+			span.SetAttribute("server.port", p)
+		}
+	}
+	span.SetAttribute("url.full", req.URL.String())
+	span.SetAttribute("temaki.proxy.route", route.name())
+	tracing.Inject(span.SpanContext(), req.Header)
+	return req.WithContext(ctx), span
+}
+
+// endAttemptSpan ends the span of an attempt with its outcome, once the response headers are received
+func endAttemptSpan(span *tracing.Span, resp *http.Response, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+	} else {
+		span.SetAttribute("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= http.StatusInternalServerError {
+			span.SetStatus(tracing.StatusError, resp.Status)
+		}
+	}
+	span.End()
+}
+
+// injectSpan propagates the span of a traced request to a target without a span of its own, like for
+// the upgraded connections
+func injectSpan(req *http.Request) {
+	if span := tracing.SpanFromContext(req.Context()); span != nil {
+		tracing.Inject(span.SpanContext(), req.Header)
+	}
+}
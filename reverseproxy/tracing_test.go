@@ -0,0 +1,54 @@
+package reverseproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gyozatech/temaki/middlewares"
+	"github.com/gyozatech/temaki/tracing"
+)
+
+func TestProxySpans(t *testing.T) {
+	received := make(chan tracing.SpanContext, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sc, _ := tracing.Extract(r.Header)
+		received <- sc
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer upstream.Close()
+
+	exporter := tracing.NewInMemoryExporter()
+	tracer := tracing.NewTracer("gateway", exporter)
+	handler := New(PathPrefixRoutesMap{"/api/": TargetHost(upstream.URL)}).
+		WithMiddlewares(middlewares.Tracing(tracer)).
+		WithAccessLogger(nil).
+		handler()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api/orders", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want the server and the client ones", len(spans))
+	}
+	client, server := spans[0], spans[1]
+	if server.Kind != tracing.SpanKindServer || server.Parent.SpanID.String() != "00f067aa0ba902b7" {
+		t.Errorf("server span = %+v, want a child of the traceparent", server)
+	}
+	if client.Kind != tracing.SpanKindClient || client.Parent.SpanID != server.SpanContext.SpanID ||
+		client.SpanContext.TraceID != server.SpanContext.TraceID {
+		t.Errorf("client span = %+v, want a child of the server span", client)
+	}
+	if client.Status != tracing.StatusError {
+		t.Errorf("client span status = %d, want an error for the 502 of the target", client.Status)
+	}
+	if got := <-received; got.SpanID != client.SpanContext.SpanID {
+		t.Errorf("the target got the parent span %s, want the client span %s", got.SpanID, client.SpanContext.SpanID)
+	}
+}
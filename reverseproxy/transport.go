@@ -0,0 +1,125 @@
+package reverseproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// TransportConfig configures the connections from the reverse proxy to the upstreams.
+// The zero value of each field keeps the default of the transport.
+type TransportConfig struct {
+	// MaxIdleConns is the maximum number of idle connections across all the upstreams (100 when 0)
+	MaxIdleConns int
+	// MaxIdleConnsPerHost is the maximum number of idle connections kept for each upstream (32 when 0)
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits the connections to each upstream, idle or not (no limit when 0)
+	MaxConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept open (90s when 0)
+	IdleConnTimeout time.Duration
+	// DialTimeout bounds the time to open a connection to an upstream (30s when 0)
+	DialTimeout time.Duration
+	// KeepAlive is the interval of the TCP keep-alive probes (30s when 0, disabled when negative)
+	KeepAlive time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake with an upstream (10s when 0)
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout bounds the wait for the response headers once the request is sent (no bound when 0)
+	ResponseHeaderTimeout time.Duration
+	// DisableHTTP2 prevents negotiating HTTP/2 with the TLS upstreams
+	DisableHTTP2 bool
+	// RootCAFile is a PEM file with the certificate authorities trusted for the upstreams (the system ones when empty)
+	RootCAFile string
+	// ClientCertFile and ClientKeyFile are the PEM files of the client certificate presented to the upstreams (mTLS)
+	ClientCertFile string
+	ClientKeyFile  string
+	// InsecureSkipVerify disables the verification of the upstream certificates: use it only for testing
+	InsecureSkipVerify bool
+}
+
+// NewTransport creates an http.Transport for the upstreams of the reverse proxy from the given configuration
+func NewTransport(cfg TransportConfig) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   durationOr(cfg.DialTimeout, 30*time.Second),
+		KeepAlive: durationOr(cfg.KeepAlive, 30*time.Second),
+	}
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     !cfg.DisableHTTP2,
+		MaxIdleConns:          intOr(cfg.MaxIdleConns, 100),
+		MaxIdleConnsPerHost:   intOr(cfg.MaxIdleConnsPerHost, 32),
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       durationOr(cfg.IdleConnTimeout, 90*time.Second),
+		TLSHandshakeTimeout:   durationOr(cfg.TLSHandshakeTimeout, 10*time.Second),
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}, nil
+}
+
+func (cfg TransportConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.DisableHTTP2 {
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	}
+	if cfg.RootCAFile != "" {
+		pem, err := os.ReadFile(cfg.RootCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading root CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificate found in root CA file %s", cfg.RootCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.ClientCertFile != "" || cfg.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// WithTransport sets the transport shared by all the routes without a transport of their own.
+// A configuration error is returned by Start.
+func (rp *ReverseProxy) WithTransport(cfg TransportConfig) *ReverseProxy {
+	transport, err := NewTransport(cfg)
+	if err != nil {
+		rp.setConfigError(fmt.Errorf("invalid transport configuration: %w", err))
+		return rp
+	}
+	table := rp.table.Load()
+	table.transport = transport
+	table.transportConfig = cfg
+	for _, r := range table.routes() {
+		if err := rp.setupRoute(table, r, r); err != nil {
+			rp.setConfigError(err)
+		}
+	}
+	return rp
+}
+
+func durationOr(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+func intOr(i, def int) int {
+	if i == 0 {
+		return def
+	}
+	return i
+}
@@ -0,0 +1,336 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gyozatech/temaki"
+)
+
+// TunnelConfig tunnels the Upgrade requests of a route byte by byte to its targets
+type TunnelConfig struct {
+	// Protocols lists the protocols of the Upgrade header tunneled, like h2c: "*" tunnels any protocol.
+	// Listing websocket tunnels the WebSockets too, without the framing, the limits and the hooks of
+	// WebSocketConfig.
+	Protocols []string `json:"protocols"`
+}
+
+// tunnels tells if the upgrade to the given protocol is tunneled
+func (c *TunnelConfig) tunnels(protocol string) bool {
+	if c == nil {
+		return false
+	}
+	for _, p := range c.Protocols {
+		if p == "*" || strings.EqualFold(p, protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnectConfig enables the HTTP CONNECT forward proxy mode
+type ConnectConfig struct {
+	// AllowedDestinations lists the host:port the clients can open a tunnel to. The host can start with
+	// a wildcard, like *.example.com:443, and the port can be *: a destination without port allows any port.
+	AllowedDestinations []string
+	// DialTimeout bounds the connection to the destination (10s when 0)
+	DialTimeout time.Duration
+}
+
+const (
+	defaultConnectDialTimeout = 10 * time.Second
+	// tunnelHandshakeTimeout bounds the connection to the target and its answer to an Upgrade request
+	tunnelHandshakeTimeout = 10 * time.Second
+)
+
+// WithConnectProxy accepts the CONNECT requests for the allowed destinations, tunneling the bytes between
+// the client and the destination
+func (rp *ReverseProxy) WithConnectProxy(cfg ConnectConfig) *ReverseProxy {
+	rp.connect.Store(&cfg)
+	return rp
+}
+
+// allows tells if a tunnel can be opened to the given host:port
+func (c *ConnectConfig) allows(destination string) bool {
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range c.AllowedDestinations {
+		allowedHost, allowedPort, err := net.SplitHostPort(allowed)
+		if err != nil {
+			allowedHost, allowedPort = allowed, "*"
+		}
+		if allowedPort != "*" && allowedPort != port {
+			continue
+		}
+		if strings.EqualFold(allowedHost, host) {
+			return true
+		}
+		if domain, found := strings.CutPrefix(allowedHost, "*."); found && strings.HasSuffix(strings.ToLower(host), "."+strings.ToLower(domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// upgradeProtocol returns the protocol asked by an Upgrade request, empty for the other requests
+func upgradeProtocol(req *http.Request) string {
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				protocol, _, _ := strings.Cut(req.Header.Get("Upgrade"), ",")
+				return strings.TrimSpace(protocol)
+			}
+		}
+	}
+	return ""
+}
+
+// prepareUpgrade prepares an Upgrade request like the HTTP requests of the route, so that the modifiers, the header
+// rules and the path rewriting apply, and points it to a target of the route. The client is answered when the
+// request can't be proxied, otherwise the returned request carries the context of the proxied request.
+func (rp *ReverseProxy) prepareUpgrade(w http.ResponseWriter, req *http.Request, route *route) (*http.Request, *target, bool) {
+	req = withProxyRequest(w, req)
+	pr := proxyRequestFrom(req)
+	outreq := req.Clone(req.Context())
+	route.proxy.Director(outreq)
+	if pr.response != nil {
+		writeResponse(w, pr.response)
+		return nil, nil, false
+	}
+
+	pool := route.pool
+	if pr.canary && route.canaryPool != nil {
+		pool = route.canaryPool
+	}
+	t, err := (&upstreamTransport{route: route}).acquire(pool, map[*target]bool{})
+	if err != nil {
+		perr := classifyError(req, err, route.config.Limits)
+		perr.Route = route.name()
+		rp.handleError(w, req, perr)
+		return nil, nil, false
+	}
+	t.applyTarget(outreq.URL)
+	outreq.Host = t.url.Host
+	injectSpan(outreq)
+
+	if peer, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		// the HTTP requests get the peer appended by httputil.ReverseProxy
+		if prior := outreq.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			peer = strings.Join(prior, ", ") + ", " + peer
+		}
+		outreq.Header.Set("X-Forwarded-For", peer)
+	}
+	return outreq, t, true
+}
+
+// upgradeResponse applies the sticky cookie of the canary and the header rules of the route to the response
+// of an Upgrade request
+func (rp *ReverseProxy) upgradeResponse(route *route, pr *proxyRequest, resp *http.Response) {
+	// the ID of the request is echoed unless the target answers with its own
+	if header, id := temaki.RequestIDHeaderOf(pr.inbound), temaki.RequestID(pr.inbound); id != "" && resp.Header.Get(header) == "" {
+		resp.Header.Set(header, id)
+	}
+	if pr.stickyCookie && route.config.Canary != nil {
+		resp.Header.Add("Set-Cookie", route.config.Canary.stickyCookie(pr.canary).String())
+	}
+	if route.config.Headers != nil {
+		route.config.Headers.applyResponse(rp, resp)
+	}
+}
+
+// recordUpgrade records the outcome of the opening of an upgraded connection to the target
+func (t *target) recordUpgrade(failed bool, start time.Time) {
+	latency := time.Since(start)
+	t.record(failed, latency)
+	if t.breaker != nil {
+		t.breaker.Record(failed, latency)
+	}
+	if failed {
+		t.markFailed()
+	}
+}
+
+// tunnelRequestHeaders are the hop-by-hop headers not forwarded with a tunneled Upgrade request
+var tunnelRequestHeaders = []string{"Keep-Alive", "Proxy-Connection", "Proxy-Authorization", "Te", "Trailer"}
+
+// serveTunnel proxies an Upgrade request and, once the target switched protocol, tunnels the bytes
+// between the client and the target
+func (rp *ReverseProxy) serveTunnel(w http.ResponseWriter, req *http.Request, route *route, protocol string) {
+	outreq, t, ok := rp.prepareUpgrade(w, req, route)
+	if !ok {
+		return
+	}
+	pr := proxyRequestFrom(outreq)
+	for _, name := range tunnelRequestHeaders {
+		outreq.Header.Del(name)
+	}
+	outreq.RequestURI = ""
+
+	start := time.Now()
+	t.inFlight.Add(1)
+	upstream, err := dialTarget(req.Context(), route.upstream, t, tunnelHandshakeTimeout)
+	if err == nil {
+		_ = upstream.SetDeadline(time.Now().Add(tunnelHandshakeTimeout))
+		err = outreq.Write(upstream)
+	}
+	var resp *http.Response
+	var upstreamReader *bufio.Reader
+	if err == nil {
+		upstreamReader = bufio.NewReader(upstream)
+		resp, err = http.ReadResponse(upstreamReader, outreq)
+	}
+	t.inFlight.Add(-1)
+	t.recordUpgrade(err != nil || resp.StatusCode >= http.StatusInternalServerError, start)
+	if err != nil {
+		if upstream != nil {
+			upstream.Close()
+		}
+		perr := classifyError(req, err, route.config.Limits)
+		perr.Route = route.name()
+		rp.handleError(w, req, perr)
+		return
+	}
+	defer upstream.Close()
+	rp.upgradeResponse(route, pr, resp)
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// the target refused the upgrade: its response is relayed to the client
+		resp.Header.Del("Connection")
+		resp.Header.Del("Upgrade")
+		writeResponse(w, resp)
+		return
+	}
+	_ = upstream.SetDeadline(time.Time{})
+
+	client, clientBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		logRequestf(req, "Tunnel of %s failed: can't take over the client connection: %v", req.URL.Path, err)
+		return
+	}
+	defer client.Close()
+	// the deadlines of the server don't apply to the tunnel
+	_ = client.SetDeadline(time.Time{})
+	clientBuf.Writer.WriteString("HTTP/1.1 " + resp.Status + "\r\n")
+	_ = resp.Header.Write(clientBuf.Writer)
+	clientBuf.Writer.WriteString("\r\n")
+	if err := clientBuf.Writer.Flush(); err != nil {
+		return
+	}
+
+	logRequestf(req, "Tunneling %s connection to target: %s%s", protocol, t.host, outreq.URL.Path)
+	sent, received := tunnel(client, clientBuf.Reader, upstream, upstreamReader)
+	logRequestf(req, "Tunnel of %s connection to %s closed: %d bytes sent, %d bytes received", protocol, t.host, sent, received)
+}
+
+// serveConnect opens a tunnel to the destination of a CONNECT request
+func (rp *ReverseProxy) serveConnect(w http.ResponseWriter, req *http.Request, cfg *ConnectConfig) {
+	destination := req.URL.Host
+	if !cfg.allows(destination) {
+		rp.handleError(w, req, &ProxyError{Kind: ErrorKindDestinationNotAllowed, Status: http.StatusForbidden,
+			Detail: "the destination is not allowed", Err: fmt.Errorf("CONNECT to %q not allowed", destination)})
+		return
+	}
+
+	dialer := &net.Dialer{Timeout: durationOr(cfg.DialTimeout, defaultConnectDialTimeout)}
+	upstream, err := dialer.DialContext(req.Context(), "tcp", destination)
+	if err != nil {
+		rp.handleError(w, req, classifyError(req, err, nil))
+		return
+	}
+	defer upstream.Close()
+
+	client, clientBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		rp.handleError(w, req, &ProxyError{Kind: ErrorKindInternal, Status: http.StatusInternalServerError,
+			Detail: "the connection can't be tunneled", Err: err})
+		return
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Time{})
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	logRequestf(req, "Tunneling CONNECT to %s", destination)
+	sent, received := tunnel(client, clientBuf.Reader, upstream, upstream)
+	logRequestf(req, "Tunnel to %s closed: %d bytes sent, %d bytes received", destination, sent, received)
+}
+
+// dialTarget opens a connection to a target with the dialing and the TLS configuration of the given transport
+func dialTarget(ctx context.Context, transport *http.Transport, t *target, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	secure := t.url.Scheme == "https" || t.url.Scheme == "wss"
+	addr := t.url.Host
+	if t.url.Port() == "" {
+		port := "80"
+		if secure {
+			port = "443"
+		}
+		addr = net.JoinHostPort(t.url.Hostname(), port)
+	}
+	conn, err := transport.DialContext(ctx, "tcp", addr)
+	if err != nil || !secure {
+		return conn, err
+	}
+
+	tlsConfig := &tls.Config{}
+	if transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+	// the upgrade is an HTTP/1.1 request, which must not negotiate HTTP/2 through ALPN
+	tlsConfig.NextProtos = nil
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = t.url.Hostname()
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// tunnel copies the bytes between the client and the upstream in both directions, reading through the given
+// readers which can hold bytes already buffered. When a side stops sending, the write side of the other
+// connection is closed, so that it can still send the rest of its data.
+func tunnel(client net.Conn, clientReader io.Reader, upstream net.Conn, upstreamReader io.Reader) (sent, received int64) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst net.Conn, src io.Reader, n *int64) {
+		defer wg.Done()
+		var err error
+		*n, err = io.Copy(dst, src)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			// a broken side stops the whole tunnel
+			client.Close()
+			upstream.Close()
+			return
+		}
+		closeWrite(dst)
+	}
+	go pipe(upstream, clientReader, &sent)
+	go pipe(client, upstreamReader, &received)
+	wg.Wait()
+	return sent, received
+}
+
+// closeWrite half-closes a connection, closing it entirely when it doesn't support it
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
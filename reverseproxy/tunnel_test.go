@@ -0,0 +1,221 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectConfigAllows(t *testing.T) {
+	cfg := &ConnectConfig{AllowedDestinations: []string{
+		"api.example.com:443",
+		"*.internal.example.com:8443",
+		"db.example.com:*",
+		"cache.example.com",
+		"[2001:db8::1]:22",
+	}}
+	tests := map[string]bool{
+		"api.example.com:443":           true,
+		"API.Example.com:443":           true,
+		"api.example.com:80":            false,
+		"other.example.com:443":         false,
+		"a.internal.example.com:8443":   true,
+		"a.b.internal.example.com:8443": true,
+		"internal.example.com:8443":     false,
+		"a.internal.example.com:443":    false,
+		"db.example.com:5432":           true,
+		"db.example.com:1":              true,
+		"cache.example.com:6379":        true,
+		"[2001:db8::1]:22":              true,
+		"[2001:db8::1]:23":              false,
+		"api.example.com":               false,
+		"evil.com:443":                  false,
+		"api.example.com.evil.com:443":  false,
+	}
+	for destination, want := range tests {
+		if got := cfg.allows(destination); got != want {
+			t.Errorf("allows(%q) = %v, want %v", destination, got, want)
+		}
+	}
+}
+
+func TestUpgradeProtocol(t *testing.T) {
+	tests := []struct {
+		connection []string
+		upgrade    string
+		want       string
+	}{
+		{connection: []string{"Upgrade"}, upgrade: "websocket", want: "websocket"},
+		{connection: []string{"keep-alive, upgrade"}, upgrade: "h2c", want: "h2c"},
+		{connection: []string{"keep-alive", "Upgrade"}, upgrade: "foo/2, bar", want: "foo/2"},
+		{connection: []string{"keep-alive"}, upgrade: "websocket", want: ""},
+		{upgrade: "websocket", want: ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header["Connection"] = tt.connection
+		req.Header.Set("Upgrade", tt.upgrade)
+		if got := upgradeProtocol(req); got != tt.want {
+			t.Errorf("Connection %q, Upgrade %q: protocol %q, want %q", tt.connection, tt.upgrade, got, tt.want)
+		}
+	}
+}
+
+// echoListener accepts connections answering each line with its upper case, then "bye" once the client stops sending
+func echoListener(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go echo(conn, bufio.NewReader(conn))
+		}
+	}()
+	return ln
+}
+
+func echo(conn net.Conn, r *bufio.Reader) {
+	defer conn.Close()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			io.WriteString(conn, "bye\n")
+			return
+		}
+		io.WriteString(conn, strings.ToUpper(line))
+	}
+}
+
+// assertEcho checks that the bytes go both ways through the tunnel, and that the half-close of the client
+// reaches the other end, which can still answer
+func assertEcho(t *testing.T, conn net.Conn, r *bufio.Reader) {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, msg := range []string{"hello\n", "tunnel\n"} {
+		if _, err := io.WriteString(conn, msg); err != nil {
+			t.Fatal(err)
+		}
+		if line, err := r.ReadString('\n'); err != nil || line != strings.ToUpper(msg) {
+			t.Fatalf("echo = %q, %v, want %q", line, err, strings.ToUpper(msg))
+		}
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if rest, err := io.ReadAll(r); err != nil || string(rest) != "bye\n" {
+		t.Errorf("after the half-close: %q, %v, want bye", rest, err)
+	}
+}
+
+func TestConnectProxy(t *testing.T) {
+	destination := echoListener(t)
+	defer destination.Close()
+
+	rp := New(PathPrefixRoutesMap{}).
+		WithAccessLogger(nil).
+		WithConnectProxy(ConnectConfig{AllowedDestinations: []string{"127.0.0.1:" + portOf(destination.Addr())}})
+	proxy := httptest.NewServer(rp.handler())
+	defer proxy.Close()
+
+	connect := func(target string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, r, resp
+	}
+
+	conn, r, resp := connect(destination.Addr().String())
+	defer conn.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d", resp.StatusCode)
+	}
+	assertEcho(t, conn, r)
+
+	// the same host on another port isn't allowed
+	other := echoListener(t)
+	defer other.Close()
+	conn, _, resp = connect(other.Addr().String())
+	defer conn.Close()
+	var p problem
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden || p.Kind != string(ErrorKindDestinationNotAllowed) {
+		t.Errorf("unlisted destination: status %d, problem %+v, want 403 %s", resp.StatusCode, p, ErrorKindDestinationNotAllowed)
+	}
+}
+
+func portOf(addr net.Addr) string {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port
+}
+
+func TestUpgradeTunnel(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upgradeProtocol(r) != "echo" || r.URL.Path != "/stream" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		echo(conn, buf.Reader)
+	}))
+	defer upstream.Close()
+
+	rp := New(PathPrefixRoutesMap{"/echo/": TargetHost(upstream.URL)}).
+		WithAccessLogger(nil).
+		WithRouteConfig("/echo/", RouteConfig{Tunnel: &TunnelConfig{Protocols: []string{"echo"}}})
+	proxy := httptest.NewServer(rp.handler())
+	defer proxy.Close()
+
+	upgrade := func(path, protocol string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: proxy\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", path, protocol)
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, r, resp
+	}
+
+	conn, r, resp := upgrade("/echo/stream", "echo")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("upgrade response = %d, Upgrade %q", resp.StatusCode, resp.Header.Get("Upgrade"))
+	}
+	assertEcho(t, conn, r)
+
+	// the refusal of the target is relayed to the client
+	refused, _, resp := upgrade("/echo/other", "echo")
+	defer refused.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("refused upgrade status = %d, want %d", resp.StatusCode, http.StatusUpgradeRequired)
+	}
+}
@@ -0,0 +1,156 @@
+package reverseproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// VirtualHost is the host name a group of routes is served for.
+// A leading wildcard, like *.tenant.example.com, matches any subdomain of the given domain.
+// The empty VirtualHost holds the routes passed to New, served when no other VirtualHost matches.
+type VirtualHost string
+
+// virtualHost is a VirtualHost with its routes, sorted to match the longest PathPrefix first
+type virtualHost struct {
+	name        VirtualHost
+	routes      map[PathPrefix]*route
+	sorted      []*route
+	certificate *tls.Certificate
+}
+
+func newVirtualHost(name VirtualHost) *virtualHost {
+	return &virtualHost{name: name, routes: map[PathPrefix]*route{}}
+}
+
+func (vh *virtualHost) clone() *virtualHost {
+	c := newVirtualHost(vh.name)
+	c.certificate = vh.certificate
+	for prefix, r := range vh.routes {
+		c.routes[prefix] = r
+	}
+	c.sortRoutes()
+	return c
+}
+
+// addRoute adds the route, replacing the one with the same PathPrefix if any
+func (vh *virtualHost) addRoute(r *route) {
+	vh.routes[r.prefix] = r
+	vh.sortRoutes()
+}
+
+func (vh *virtualHost) removeRoute(prefix PathPrefix) {
+	delete(vh.routes, prefix)
+	vh.sortRoutes()
+}
+
+func (vh *virtualHost) sortRoutes() {
+	// a new slice is allocated, as the old one can be in use by a previous version of the virtual host
+	vh.sorted = make([]*route, 0, len(vh.routes))
+	for _, r := range vh.routes {
+		vh.sorted = append(vh.sorted, r)
+	}
+	sort.Slice(vh.sorted, func(i, j int) bool {
+		return len(vh.sorted[i].prefix) > len(vh.sorted[j].prefix)
+	})
+}
+
+// match returns the route with the longest PathPrefix matching the given path, or nil
+func (vh *virtualHost) match(path string) *route {
+	for _, r := range vh.sorted {
+		prefix := string(r.prefix)
+		if strings.HasPrefix(path, prefix) || path == strings.TrimSuffix(prefix, "/") {
+			return r
+		}
+	}
+	return nil
+}
+
+func normalizeVirtualHost(host VirtualHost) VirtualHost {
+	return VirtualHost(strings.ToLower(strings.TrimSpace(string(host))))
+}
+
+// WithVirtualHost registers routes served only for requests to the given host
+func (rp *ReverseProxy) WithVirtualHost(host VirtualHost, routes PathPrefixRoutesMap) *ReverseProxy {
+	if err := rp.addRoutes(rp.table.Load(), normalizeVirtualHost(host), routes); err != nil {
+		rp.setConfigError(err)
+	}
+	return rp
+}
+
+// WithVirtualHostRouteConfig sets the configuration of a route registered with WithVirtualHost
+func (rp *ReverseProxy) WithVirtualHostRouteConfig(host VirtualHost, prefix PathPrefix, cfg RouteConfig) *ReverseProxy {
+	table := rp.table.Load()
+	vh, found := table.hosts[normalizeVirtualHost(host)]
+	if !found {
+		log.Printf("Ignoring configuration for unknown virtual host %s", host)
+		return rp
+	}
+	r, found := vh.routes[normalizePathPrefix(prefix)]
+	if !found {
+		log.Printf("Ignoring configuration for unknown route %s%s", host, prefix)
+		return rp
+	}
+	r.config = cfg
+	if err := rp.setupRoute(table, r, nil); err != nil {
+		rp.setConfigError(err)
+	}
+	return rp
+}
+
+// WithVirtualHostCertificate sets the TLS certificate presented to the clients asking for the given host
+// through SNI. A configuration error is returned by StartTLS.
+func (rp *ReverseProxy) WithVirtualHostCertificate(host VirtualHost, certFile, keyFile string) *ReverseProxy {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		rp.setConfigError(fmt.Errorf("error loading certificate of virtual host %s: %w", host, err))
+		return rp
+	}
+	rp.table.Load().virtualHost(normalizeVirtualHost(host)).certificate = &cert
+	return rp
+}
+
+// addRoutes builds the given routes and adds them to a virtual host of the routing table
+func (rp *ReverseProxy) addRoutes(table *routingTable, host VirtualHost, routes PathPrefixRoutesMap) error {
+	vh := table.virtualHost(host)
+	var errs []error
+	for prefix, target := range adaptRoutesMap(routes) {
+		r := &route{host: host, prefix: prefix, target: target}
+		if err := rp.setupRoute(table, r, nil); err != nil {
+			errs = append(errs, err)
+		}
+		vh.addRoute(r)
+	}
+	return errors.Join(errs...)
+}
+
+// getCertificate selects the certificate of the virtual host asked through SNI, falling back to the
+// certificate of the default virtual host
+func (rp *ReverseProxy) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	table := rp.table.Load()
+	if vh := table.lookupHost(hello.ServerName); vh != nil && vh.certificate != nil {
+		return vh.certificate, nil
+	}
+	if vh := table.hosts[""]; vh != nil && vh.certificate != nil {
+		return vh.certificate, nil
+	}
+	return nil, fmt.Errorf("no certificate available for %q", hello.ServerName)
+}
+
+// StartTLS starts the reverse proxy on the specified port serving HTTPS. The given certificate, which can be
+// omitted if every virtual host has its own, is used when the virtual host asked by the client has none.
+func (rp *ReverseProxy) StartTLS(port int, certFile, keyFile string) error {
+	if certFile != "" || keyFile != "" {
+		rp.WithVirtualHostCertificate("", certFile, keyFile)
+	}
+	if rp.configErr != nil {
+		return rp.configErr
+	}
+	server := rp.newServer(port)
+	server.TLSConfig = &tls.Config{GetCertificate: rp.getCertificate}
+	log.Printf("Starting reverse proxy server with TLS on port %d", port)
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,94 @@
+package reverseproxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newVirtualHostsProxy() *ReverseProxy {
+	return New(PathPrefixRoutesMap{"/": "http://default"}).
+		WithVirtualHost("API.example.com", PathPrefixRoutesMap{"/": "http://api"}).
+		WithVirtualHost("*.example.com", PathPrefixRoutesMap{"/": "http://tenant"}).
+		WithVirtualHost("*.eu.example.com", PathPrefixRoutesMap{"/": "http://eu"})
+}
+
+func TestLookupHost(t *testing.T) {
+	table := newVirtualHostsProxy().table.Load()
+	tests := map[string]VirtualHost{
+		"api.example.com":       "api.example.com",
+		"API.Example.COM":       "api.example.com",
+		"api.example.com:8443":  "api.example.com",
+		"api.example.com.":      "api.example.com",
+		"shop.example.com":      "*.example.com",
+		"a.b.example.com":       "*.example.com",
+		"shop.eu.example.com":   "*.eu.example.com",
+		"eu.example.com":        "*.example.com",
+		"example.com":           "",
+		"notexample.com":        "",
+		"other.org:80":          "",
+		"127.0.0.1:8080":        "",
+		"[::1]:8080":            "",
+		"SHOP.EU.example.com:1": "*.eu.example.com",
+	}
+	for host, want := range tests {
+		if got := table.lookupHost(host); got == nil || got.name != want {
+			t.Errorf("lookupHost(%q) = %v, want %q", host, got, want)
+		}
+	}
+}
+
+func TestVirtualHostMatch(t *testing.T) {
+	rp := newVirtualHostsProxy()
+	tests := map[string]TargetHost{
+		"api.example.com":  "http://api",
+		"shop.example.com": "http://tenant",
+		"example.com":      "http://default",
+	}
+	for host, want := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/path", nil)
+		req.Host = host
+		if r := rp.table.Load().match(req); r == nil || r.target != want {
+			t.Errorf("host %s: route %v, want target %s", host, r, want)
+		}
+	}
+
+	// a virtual host with only a certificate is served by the default routes
+	rp.table.Load().virtualHost("cert.example.org").certificate = &tls.Certificate{}
+	req := httptest.NewRequest(http.MethodGet, "/path", nil)
+	req.Host = "cert.example.org"
+	if r := rp.table.Load().match(req); r == nil || r.target != "http://default" {
+		t.Errorf("virtual host without routes: route %v, want the default one", r)
+	}
+}
+
+func TestGetCertificate(t *testing.T) {
+	rp := newVirtualHostsProxy()
+	table := rp.table.Load()
+	api, wildcard := &tls.Certificate{}, &tls.Certificate{}
+	table.hosts["api.example.com"].certificate = api
+	table.hosts["*.example.com"].certificate = wildcard
+
+	// without a default certificate, the hosts without one have none
+	if _, err := rp.getCertificate(&tls.ClientHelloInfo{ServerName: "other.org"}); err == nil {
+		t.Error("a certificate was returned for a host without one")
+	}
+
+	fallback := &tls.Certificate{}
+	table.hosts[""].certificate = fallback
+	tests := map[string]*tls.Certificate{
+		"api.example.com":     api,
+		"API.EXAMPLE.COM":     api,
+		"shop.example.com":    wildcard,
+		"shop.eu.example.com": fallback,
+		"other.org":           fallback,
+		"":                    fallback,
+	}
+	for serverName, want := range tests {
+		got, err := rp.getCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil || got != want {
+			t.Errorf("getCertificate(%q) = %p, %v, want %p", serverName, got, err, want)
+		}
+	}
+}
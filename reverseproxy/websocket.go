@@ -1,17 +1,118 @@
 package reverseproxy
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 // functions to manage websockets and upgrade the http/https connection to ws/wss
 
+const (
+	defaultWebSocketHandshakeTimeout = 10 * time.Second
+	defaultWebSocketWriteTimeout     = 10 * time.Second
+	// webSocketCloseTimeout is how long the second side of a connection has to answer a close frame
+	webSocketCloseTimeout = 5 * time.Second
+)
+
+// WebSocketConfig configures the proxying of the WebSocket connections of a route
+type WebSocketConfig struct {
+	// HandshakeTimeout bounds the opening handshake with the target (10s when 0)
+	HandshakeTimeout time.Duration
+	// WriteTimeout bounds the writing of each message to a side of the connection (10s when 0)
+	WriteTimeout time.Duration
+	// AllowedOrigins lists the origins allowed to open connections, like https://app.example.com:
+	// "*" allows any origin and https://*.example.com any subdomain. When both AllowedOrigins and
+	// CheckOrigin are empty, only the origin with the host of the request is allowed. The requests
+	// without Origin, which don't come from browsers, are always allowed.
+	AllowedOrigins []string
+	// CheckOrigin, when not nil, decides which requests are allowed instead of AllowedOrigins
+	CheckOrigin func(req *http.Request) bool
+	// MaxMessageSize is the maximum size in bytes of a message, in both directions: the side sending
+	// a larger message gets the connection closed with 1009 (0 means no limit)
+	MaxMessageSize int64
+	// IdleTimeout closes the connections without any frame in both directions for the given time
+	// (0 means no timeout)
+	IdleTimeout time.Duration
+	// ReadBufferSize and WriteBufferSize are the sizes of the I/O buffers of each side (4KB when 0)
+	ReadBufferSize  int
+	WriteBufferSize int
+	// EnableCompression negotiates the per-message compression with both sides
+	EnableCompression bool
+	// MaxConnections bounds the connections open at the same time on the route: the handshakes beyond
+	// it are answered 503 Service Unavailable (0 means no bound)
+	MaxConnections int
+	// ClientMessageHooks and ServerMessageHooks inspect, in order, the messages sent by the clients
+	// and by the targets before they're forwarded
+	ClientMessageHooks []WebSocketHook
+	ServerMessageHooks []WebSocketHook
+	// OnClose receives the statistics of every connection once it's closed
+	OnClose func(req *http.Request, stats WebSocketStats)
+}
+
+// allowsOrigin tells if a handshake comes from an allowed origin
+func (c *WebSocketConfig) allowsOrigin(req *http.Request) bool {
+	if c != nil && c.CheckOrigin != nil {
+		return c.CheckOrigin(req)
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if c == nil || len(c.AllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, req.Host)
+	}
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		// https://*.example.com matches the subdomains of example.com with the same scheme
+		if scheme, domain, found := strings.Cut(allowed, "://*."); found {
+			prefix := scheme + "://"
+			if len(origin) > len(prefix) && strings.EqualFold(origin[:len(prefix)], prefix) &&
+				strings.HasSuffix(strings.ToLower(origin), "."+strings.ToLower(domain)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newWebSocketUpgrader creates the upgrader of the client connections of a route: the origin is checked
+// before contacting the target, so that the upgrader doesn't check it again
+func newWebSocketUpgrader(cfg *WebSocketConfig) *websocket.Upgrader {
+	upgrader := &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	if cfg != nil {
+		upgrader.ReadBufferSize = cfg.ReadBufferSize
+		upgrader.WriteBufferSize = cfg.WriteBufferSize
+		upgrader.EnableCompression = cfg.EnableCompression
+	}
+	return upgrader
+}
+
+// webSocketHandshakeHeaders are the request headers set by the dialer of the target connection
+var webSocketHandshakeHeaders = []string{
+	"Connection", "Upgrade", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions",
+	"Keep-Alive", "Proxy-Connection", "Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding",
+}
+
+// webSocketResponseHeaders are the headers of the handshake response of the target set again by the
+// upgrader of the client connection
+var webSocketResponseHeaders = []string{
+	"Connection", "Upgrade", "Sec-Websocket-Accept", "Sec-Websocket-Extensions", "Keep-Alive",
+	"Transfer-Encoding", "Content-Length",
+}
+
 func isWebSocketRequest(r *http.Request) bool {
 	connectionHeader := strings.ToLower(r.Header.Get("Connection"))
 	upgradeHeader := strings.ToLower(r.Header.Get("Upgrade"))
@@ -19,68 +120,255 @@ func isWebSocketRequest(r *http.Request) bool {
 	return strings.Contains(connectionHeader, "upgrade") && upgradeHeader == "websocket"
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request, targetURL string) {
-	remote, err := url.Parse(targetURL)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error parsing URL %s", err), http.StatusBadGateway)
+// newWebSocketDialer creates the dialer of the WebSocket connections to the targets of a route, sharing the
+// proxy, the TLS configuration and the dialing of the transport of the route
+func newWebSocketDialer(transport *http.Transport, cfg *WebSocketConfig) *websocket.Dialer {
+	dialer := &websocket.Dialer{
+		Proxy:            transport.Proxy,
+		NetDialContext:   transport.DialContext,
+		HandshakeTimeout: defaultWebSocketHandshakeTimeout,
+	}
+	if transport.TLSClientConfig != nil {
+		// the handshake is an HTTP/1.1 request, which must not negotiate HTTP/2 through ALPN
+		dialer.TLSClientConfig = transport.TLSClientConfig.Clone()
+		dialer.TLSClientConfig.NextProtos = nil
+	}
+	if cfg != nil {
+		if cfg.HandshakeTimeout > 0 {
+			dialer.HandshakeTimeout = cfg.HandshakeTimeout
+		}
+		dialer.ReadBufferSize = cfg.ReadBufferSize
+		dialer.WriteBufferSize = cfg.WriteBufferSize
+		dialer.EnableCompression = cfg.EnableCompression
+	}
+	return dialer
+}
+
+// serveWebSocket proxies a WebSocket connection: the handshake is prepared like the HTTP requests of the route,
+// so that the modifiers, the header rules and the path rewriting apply, and sent to a target of the route.
+// The client connection is upgraded only once the target accepted it, with its subprotocol and cookies.
+func (rp *ReverseProxy) serveWebSocket(w http.ResponseWriter, req *http.Request, route *route) {
+	cfg := route.config.WebSocket
+	if !cfg.allowsOrigin(req) {
+		rp.handleError(w, req, &ProxyError{Kind: ErrorKindOriginNotAllowed, Status: http.StatusForbidden,
+			Route: route.name(), Detail: "the origin of the request is not allowed",
+			Err: fmt.Errorf("origin %q not allowed", req.Header.Get("Origin"))})
 		return
 	}
+	if cfg != nil && cfg.MaxConnections > 0 {
+		if route.wsConns.Add(1) > int64(cfg.MaxConnections) {
+			route.wsConns.Add(-1)
+			rp.handleError(w, req, &ProxyError{Kind: ErrorKindTooManyConnections, Status: http.StatusServiceUnavailable,
+				Route: route.name(), Detail: "too many connections are open on the service",
+				Err: fmt.Errorf("%d WebSocket connections already open", cfg.MaxConnections)})
+			return
+		}
+		defer route.wsConns.Add(-1)
+	}
 
-	// Ensure correct WebSocket scheme: fundamental to substitute http/https scheme with ws/wss scheme
-	if strings.HasPrefix(remote.Scheme, "http") {
-		remote.Scheme = strings.Replace(remote.Scheme, "http", "ws", 1)
+	outreq, t, ok := rp.prepareUpgrade(w, req, route)
+	if !ok {
+		return
+	}
+	pr := proxyRequestFrom(outreq)
+	outreq.URL.Scheme = strings.Replace(outreq.URL.Scheme, "http", "ws", 1)
+	header := outreq.Header.Clone()
+	for _, name := range webSocketHandshakeHeaders {
+		header.Del(name)
 	}
+	header.Set("Host", outreq.Host)
 
-	// Upgrade client connection to WebSocket
-	clientConn, err := wsUpgrader.Upgrade(w, r, nil)
+	start := time.Now()
+	t.inFlight.Add(1)
+	serverConn, resp, err := route.wsDialer.DialContext(req.Context(), outreq.URL.String(), header)
+	t.inFlight.Add(-1)
+	t.recordUpgrade(err != nil && (resp == nil || resp.StatusCode >= http.StatusInternalServerError), start)
 	if err != nil {
-		log.Println("WebSocket upgrade failed:", err)
+		if resp != nil {
+			// the target refused the upgrade: its response is relayed to the client
+			for _, name := range webSocketResponseHeaders {
+				resp.Header.Del(name)
+			}
+			writeResponse(w, resp)
+			return
+		}
+		perr := classifyError(req, err, route.config.Limits)
+		perr.Route = route.name()
+		rp.handleError(w, req, perr)
 		return
 	}
-	defer clientConn.Close()
+	defer serverConn.Close()
 
-	// Dial WebSocket server
-	serverConn, _, err := websocket.DefaultDialer.Dial(remote.String(), nil)
+	rp.upgradeResponse(route, pr, resp)
+	responseHeader := resp.Header.Clone()
+	for _, name := range webSocketResponseHeaders {
+		responseHeader.Del(name)
+	}
+	clientConn, err := route.wsUpgrader.Upgrade(w, req, responseHeader)
 	if err != nil {
-		log.Println("Failed to connect to WebSocket server:", err)
-		log.Printf("Error details: TargetURL %s, Remote %s, Host %s, scheme %s", targetURL, remote.String(), remote.Host, remote.Scheme)
+		// the upgrader already answered the client
+		logRequestf(req, "WebSocket upgrade of %s failed: %v", req.URL.Path, err)
 		return
 	}
-	defer serverConn.Close()
+	defer clientConn.Close()
 
-	// Start bidirectional message forwarding
-	errCh := make(chan error, 2)
+	logRequestf(req, "Proxying WebSocket connection to target: %s%s", t.host, outreq.URL.Path)
+	relay := &webSocketRelay{client: clientConn, server: serverConn, cfg: cfg, req: pr.inbound, stats: WebSocketStats{
+		Route: route.name(), Target: t.host, Subprotocol: serverConn.Subprotocol(), Start: start,
+	}}
+	relay.run()
+}
+
+// webSocketRelay forwards the messages between the two sides of a connection until one of them closes it.
+// The close frame, with its code, is forwarded to the other side, whose answer is awaited for the closing
+// handshake to complete end to end.
+type webSocketRelay struct {
+	client, server *websocket.Conn
+	cfg            *WebSocketConfig
+	// req is the handshake request of the client, given to the hooks
+	req          *http.Request
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+	// closing stops the renewal of the idle deadlines once a side closed the connection
+	closing atomic.Bool
+
+	stats WebSocketStats
+	// received counts the messages received from the client and from the target
+	received [2]webSocketCounters
+	dropped  atomic.Int64
+}
+
+func (r *webSocketRelay) run() {
+	r.writeTimeout = defaultWebSocketWriteTimeout
+	if r.cfg != nil {
+		if r.cfg.WriteTimeout > 0 {
+			r.writeTimeout = r.cfg.WriteTimeout
+		}
+		if r.cfg.MaxMessageSize > 0 {
+			r.client.SetReadLimit(r.cfg.MaxMessageSize)
+			r.server.SetReadLimit(r.cfg.MaxMessageSize)
+		}
+		r.idleTimeout = r.cfg.IdleTimeout
+	}
+	r.touch()
 
-	// Client -> Server
+	errCh := make(chan error, 2)
 	go func() {
-		errCh <- copyWebSocketMessages(clientConn, serverConn)
+		errCh <- r.copyMessages(r.client, r.server, ClientToServer)
 	}()
-
-	// Server -> Client
 	go func() {
-		errCh <- copyWebSocketMessages(serverConn, clientConn)
+		errCh <- r.copyMessages(r.server, r.client, ServerToClient)
 	}()
 
-	// Wait for errors
+	err := <-errCh
+	// the side still open has a bounded time to answer the close frame forwarded to it
+	r.closing.Store(true)
+	deadline := time.Now().Add(webSocketCloseTimeout)
+	_ = r.client.SetReadDeadline(deadline)
+	_ = r.server.SetReadDeadline(deadline)
 	<-errCh
+	r.report(err)
 }
 
-func copyWebSocketMessages(src, dest *websocket.Conn) error {
+// touch renews the idle deadline of both sides, as a connection is idle only without frames in both directions
+func (r *webSocketRelay) touch() {
+	if r.idleTimeout <= 0 || r.closing.Load() {
+		return
+	}
+	deadline := time.Now().Add(r.idleTimeout)
+	_ = r.client.SetReadDeadline(deadline)
+	_ = r.server.SetReadDeadline(deadline)
+}
+
+// copyMessages forwards the messages and the control frames read from src to dest, running the hooks of
+// the direction on the messages
+func (r *webSocketRelay) copyMessages(src, dest *websocket.Conn, dir WebSocketDirection) error {
+	hooks := r.cfg.hooks(dir)
+	counters := &r.received[0]
+	if dir == ServerToClient {
+		counters = &r.received[1]
+	}
+
+	src.SetPingHandler(func(data string) error {
+		r.touch()
+		return forwardControl(dest, websocket.PingMessage, []byte(data), r.writeTimeout)
+	})
+	src.SetPongHandler(func(data string) error {
+		r.touch()
+		return forwardControl(dest, websocket.PongMessage, []byte(data), r.writeTimeout)
+	})
+	// the close frame is forwarded when ReadMessage returns, instead of being answered here
+	src.SetCloseHandler(func(code int, text string) error { return nil })
+
 	for {
 		messageType, message, err := src.ReadMessage()
 		if err != nil {
+			msg := closeMessage(err)
+			if !isCloseFrame(err) {
+				// src didn't send a close frame, as it's idle or its message is too large: it gets one too
+				_ = forwardControl(src, websocket.CloseMessage, msg, r.writeTimeout)
+			}
+			_ = forwardControl(dest, websocket.CloseMessage, msg, r.writeTimeout)
 			return err
 		}
+		r.touch()
+		counters.messages.Add(1)
+		counters.bytes.Add(int64(len(message)))
 
-		err = dest.WriteMessage(messageType, message)
+		msg := &WebSocketMessage{Direction: dir, Type: messageType, Data: message}
+		dropped, err := applyHooks(hooks, r.req, msg)
+		if err != nil {
+			// the connection is closed on both sides by the hook
+			closeMsg := closeMessage(err)
+			_ = forwardControl(src, websocket.CloseMessage, closeMsg, r.writeTimeout)
+			_ = forwardControl(dest, websocket.CloseMessage, closeMsg, r.writeTimeout)
+			return err
+		}
+		if dropped {
+			r.dropped.Add(1)
+			continue
+		}
+
+		_ = dest.SetWriteDeadline(time.Now().Add(r.writeTimeout))
+		err = dest.WriteMessage(msg.Type, msg.Data)
 		if err != nil {
 			return err
 		}
 	}
 }
 
-var wsUpgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins (adjust for security)
-	},
+func forwardControl(dest *websocket.Conn, messageType int, data []byte, writeTimeout time.Duration) error {
+	err := dest.WriteControl(messageType, data, time.Now().Add(writeTimeout))
+	if errors.Is(err, websocket.ErrCloseSent) {
+		return nil
+	}
+	return err
+}
+
+// closeMessage is the close frame forwarded after a read error: the code and the reason of a close frame are
+// kept, while the connections lost without one are reported as going away
+func closeMessage(err error) []byte {
+	code, reason := closeCode(err)
+	if code == websocket.CloseAbnormalClosure {
+		code = websocket.CloseGoingAway
+	}
+	return websocket.FormatCloseMessage(code, reason)
+}
+
+// isCloseFrame tells if a read error is a close frame sent by the other side
+func isCloseFrame(err error) bool {
+	var closeErr *websocket.CloseError
+	return errors.As(err, &closeErr) && closeErr.Code != websocket.CloseAbnormalClosure && closeErr.Code != websocket.CloseTLSHandshake
+}
+
+// writeResponse sends a response obtained without proxying the request to the client
+func writeResponse(w http.ResponseWriter, resp *http.Response) {
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	if resp.Body != nil {
+		_, _ = io.Copy(w, resp.Body)
+		resp.Body.Close()
+	}
 }
@@ -0,0 +1,137 @@
+package reverseproxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrDropMessage is returned by a WebSocketHook to drop a message instead of forwarding it
+var ErrDropMessage = errors.New("websocket message dropped")
+
+// maxCloseReason is the maximum length of the reason of a close frame, whose payload is limited to 125 bytes
+const maxCloseReason = 123
+
+// WebSocketDirection tells which side of a WebSocket connection sent a message
+type WebSocketDirection string
+
+const (
+	// ClientToServer are the messages sent by the client to the target
+	ClientToServer WebSocketDirection = "client-to-server"
+	// ServerToClient are the messages pushed by the target to the client
+	ServerToClient WebSocketDirection = "server-to-client"
+)
+
+// WebSocketMessage is a data message relayed by the proxy
+type WebSocketMessage struct {
+	Direction WebSocketDirection
+	// Type is websocket.TextMessage or websocket.BinaryMessage
+	Type int
+	Data []byte
+}
+
+// WebSocketHook inspects a message before it's forwarded, given the handshake request of the client.
+// It can change the Type and the Data of the message, or return ErrDropMessage to drop it. Any other error
+// closes the connection with 1008 Policy Violation, or with the code of a *websocket.CloseError.
+type WebSocketHook func(req *http.Request, msg *WebSocketMessage) error
+
+// WebSocketStats are the statistics of a WebSocket connection, reported when it's closed
+type WebSocketStats struct {
+	Route       string
+	Target      TargetHost
+	Subprotocol string
+	Start       time.Time
+	Duration    time.Duration
+	// ClientMessages and ClientBytes count the data messages received from the client
+	ClientMessages int64
+	ClientBytes    int64
+	// ServerMessages and ServerBytes count the data messages received from the target
+	ServerMessages int64
+	ServerBytes    int64
+	// DroppedMessages counts the messages dropped by the hooks
+	DroppedMessages int64
+	// CloseCode and CloseReason are the ones of the close frame which ended the connection,
+	// 1006 Abnormal Closure when the connection was lost without one
+	CloseCode   int
+	CloseReason string
+}
+
+// webSocketCounters are the counters of a direction of a connection
+type webSocketCounters struct {
+	messages atomic.Int64
+	bytes    atomic.Int64
+}
+
+// hooks returns the hooks of the messages of the given direction
+func (c *WebSocketConfig) hooks(dir WebSocketDirection) []WebSocketHook {
+	if c == nil {
+		return nil
+	}
+	if dir == ClientToServer {
+		return c.ClientMessageHooks
+	}
+	return c.ServerMessageHooks
+}
+
+// applyHooks runs the hooks of a message in order, returning the error closing the connection if any.
+// A dropped message is reported by dropped, without error.
+func applyHooks(hooks []WebSocketHook, req *http.Request, msg *WebSocketMessage) (dropped bool, err error) {
+	for _, hook := range hooks {
+		if err := hook(req, msg); err != nil {
+			if errors.Is(err, ErrDropMessage) {
+				return true, nil
+			}
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) {
+				closeErr = &websocket.CloseError{Code: websocket.ClosePolicyViolation, Text: err.Error()}
+			}
+			if len(closeErr.Text) > maxCloseReason {
+				closeErr = &websocket.CloseError{Code: closeErr.Code, Text: closeErr.Text[:maxCloseReason]}
+			}
+			return false, closeErr
+		}
+	}
+	return false, nil
+}
+
+// closeCode returns the code and the reason ending a connection after an error: 1006 Abnormal Closure
+// means that the connection was lost
+func closeCode(err error) (int, string) {
+	var closeErr *websocket.CloseError
+	switch {
+	case isCloseFrame(err):
+		errors.As(err, &closeErr)
+		return closeErr.Code, closeErr.Text
+	case errors.Is(err, websocket.ErrReadLimit):
+		return websocket.CloseMessageTooBig, "message too large"
+	case isTimeout(err):
+		return websocket.CloseGoingAway, "idle timeout"
+	}
+	return websocket.CloseAbnormalClosure, ""
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// report logs the statistics of a closed connection and passes them to the OnClose function of the route
+func (r *webSocketRelay) report(err error) {
+	stats := r.stats
+	stats.Duration = time.Since(stats.Start)
+	stats.ClientMessages, stats.ClientBytes = r.received[0].messages.Load(), r.received[0].bytes.Load()
+	stats.ServerMessages, stats.ServerBytes = r.received[1].messages.Load(), r.received[1].bytes.Load()
+	stats.DroppedMessages = r.dropped.Load()
+	stats.CloseCode, stats.CloseReason = closeCode(err)
+
+	logRequestf(r.req, "WebSocket connection to %s closed with %d after %s: %d/%d messages and %d/%d bytes from client/target, %d dropped",
+		stats.Target, stats.CloseCode, stats.Duration.Round(time.Millisecond), stats.ClientMessages, stats.ServerMessages,
+		stats.ClientBytes, stats.ServerBytes, stats.DroppedMessages)
+	if r.cfg != nil && r.cfg.OnClose != nil {
+		r.cfg.OnClose(r.req, stats)
+	}
+}
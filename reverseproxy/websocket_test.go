@@ -0,0 +1,131 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newWebSocketEcho starts a target sending the path of the handshake, then answering each message with
+// "echo:" and the message
+func newWebSocketEcho(t *testing.T) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(r.URL.Path)); err != nil {
+			return
+		}
+		for {
+			msgType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(msgType, append([]byte("echo:"), data...)); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	upstream := newWebSocketEcho(t)
+	defer upstream.Close()
+
+	closed := make(chan WebSocketStats, 1)
+	rp := New(PathPrefixRoutesMap{"/ws/": TargetHost(upstream.URL)}).
+		WithAccessLogger(nil).
+		WithRouteConfig("/ws/", RouteConfig{
+			PathRewrite: &PathRewrite{ReplacePrefix: "/socket"},
+			WebSocket: &WebSocketConfig{
+				AllowedOrigins: []string{"https://app.example.com"},
+				MaxConnections: 1,
+				ClientMessageHooks: []WebSocketHook{func(req *http.Request, msg *WebSocketMessage) error {
+					if string(msg.Data) == "drop" {
+						return ErrDropMessage
+					}
+					msg.Data = append(msg.Data, '!')
+					return nil
+				}},
+				ServerMessageHooks: []WebSocketHook{func(req *http.Request, msg *WebSocketMessage) error {
+					if bytes.HasPrefix(msg.Data, []byte("echo:hidden")) {
+						return ErrDropMessage
+					}
+					msg.Data = bytes.ToUpper(msg.Data)
+					return nil
+				}},
+				OnClose: func(req *http.Request, stats WebSocketStats) { closed <- stats },
+			},
+		})
+	proxy := httptest.NewServer(rp.handler())
+	defer proxy.Close()
+
+	url := "ws" + strings.TrimPrefix(proxy.URL, "http") + "/ws/chat"
+	dial := func(origin string) (*websocket.Conn, *http.Response, error) {
+		return websocket.DefaultDialer.Dial(url, http.Header{"Origin": {origin}})
+	}
+	refused := func(resp *http.Response, err error, wantStatus int, wantKind ErrorKind) {
+		t.Helper()
+		if resp == nil {
+			t.Fatalf("dial error %v without response, want %d", err, wantStatus)
+		}
+		var p problem
+		if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != wantStatus || p.Kind != string(wantKind) {
+			t.Errorf("handshake answered %d %+v, want %d %s", resp.StatusCode, p, wantStatus, wantKind)
+		}
+	}
+
+	conn, _, err := dial("https://app.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	read := func(want string) {
+		t.Helper()
+		if _, data, err := conn.ReadMessage(); err != nil || string(data) != want {
+			t.Fatalf("message = %q, %v, want %q", data, err, want)
+		}
+	}
+	// the target got the rewritten path, sent back through the server hook
+	read("/SOCKET/CHAT")
+
+	// the second connection exceeds MaxConnections while the first one is open
+	_, resp, err := dial("https://app.example.com")
+	refused(resp, err, http.StatusServiceUnavailable, ErrorKindTooManyConnections)
+	// the origin is checked first
+	_, resp, err = dial("https://evil.example.com")
+	refused(resp, err, http.StatusForbidden, ErrorKindOriginNotAllowed)
+
+	for _, msg := range []string{"drop", "hi", "hidden", "last"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "drop" is dropped by the client hook, the echo of "hidden" by the server hook
+	read("ECHO:HI!")
+	read("ECHO:LAST!")
+
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "done"))
+	select {
+	case stats := <-closed:
+		if stats.DroppedMessages != 2 || stats.CloseCode != websocket.CloseNormalClosure {
+			t.Errorf("stats = %+v, want 2 dropped messages and a normal closure", stats)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection wasn't reported closed")
+	}
+}
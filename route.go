@@ -12,6 +12,7 @@ var rgxIn = regexp.MustCompile(`\((.*?)\)`)
 
 type Route struct {
 	method     string
+	pattern    string
 	regex      *regexp.Regexp
 	pathParams map[string]int
 	handler    http.HandlerFunc
@@ -22,7 +23,10 @@ func NewRoute(method, pattern string, handler http.HandlerFunc) Route {
 	if regexPath[0] != '/' {
 		regexPath = fmt.Sprintf("/%s", regexPath)
 	}
-	return Route{method, regexp.MustCompile("^" + regexPath + "$"), pathParamsMap, handler}
+	if pattern == "" || pattern[0] != '/' {
+		pattern = "/" + pattern
+	}
+	return Route{method, pattern, regexp.MustCompile("^" + regexPath + "$"), pathParamsMap, handler}
 }
 
 func parseURL(path string) (map[string]int, string) {
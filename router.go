@@ -66,6 +66,7 @@ func (router *Router) DispatcherHandler() http.HandlerFunc {
 		for _, route := range *router.Routes {
 			matches := route.regex.FindStringSubmatch(r.URL.Path)
 			if len(matches) > 0 {
+				r = SetRoutePattern(r, route.pattern)
 				if r.Method != route.method {
 					allow = append(allow, route.method)
 					continue
@@ -100,6 +101,16 @@ func (router *Router) Start(port int) error {
 	return http.ListenAndServe(fmt.Sprintf(":%d", port), router.Serve())
 }
 
+// SetRoutePattern records the pattern of the route matching the request, for RoutePattern: the Router does it
+// for its routes, while the other dispatchers, like the reverse proxy, call it so that the middlewares see their routes
+func SetRoutePattern(r *http.Request, pattern string) *http.Request {
+	if m, ok := r.Context().Value(routeKey{}).(*matchedRoute); ok {
+		m.pattern = pattern
+		return r
+	}
+	return enrichRequestContext(r, routeKey{}, &matchedRoute{pattern: pattern})
+}
+
 func enrichRequestContext(r *http.Request, key, val interface{}) *http.Request {
 	ctx := context.WithValue(r.Context(), key, val)
 	return r.WithContext(ctx)
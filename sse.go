@@ -0,0 +1,92 @@
+package temaki
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Event is a Server-Sent Event: only Data is required
+type Event struct {
+	ID    string
+	Event string
+	// Data is sent on multiple data lines when it contains new lines
+	Data string
+	// Retry tells the client how long to wait before reconnecting, when not 0
+	Retry time.Duration
+}
+
+// SSE writes a stream of Server-Sent Events to the client of a handler
+type SSE struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+	r  *http.Request
+}
+
+// NewSSE starts an event stream: it sends the headers of the stream and lifts the write deadline of the
+// server, as the stream lasts until the client goes away. It fails when the response can't be flushed.
+func NewSSE(w http.ResponseWriter, r *http.Request) (*SSE, error) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// disables the buffering of the proxies like nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil, fmt.Errorf("event stream not supported: %w", err)
+	}
+	_ = rc.SetWriteDeadline(time.Time{})
+	return &SSE{w: w, rc: rc, r: r}, nil
+}
+
+// Send writes an event and flushes it to the client
+func (s *SSE) Send(e Event) error {
+	var b strings.Builder
+	if e.ID != "" {
+		b.WriteString("id: " + singleLine(e.ID) + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + singleLine(e.Event) + "\n")
+	}
+	if e.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", e.Retry.Milliseconds())
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(e.Data, "\r\n", "\n"), "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// SendJSON sends an event with the given name and the JSON encoding of v as data
+func (s *SSE) SendJSON(event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Send(Event{Event: event, Data: string(data)})
+}
+
+// Comment writes a comment, ignored by the clients: it keeps the connection alive through the proxies
+func (s *SSE) Comment(text string) error {
+	return s.write(": " + singleLine(text) + "\n\n")
+}
+
+// Done is closed when the client goes away
+func (s *SSE) Done() <-chan struct{} {
+	return s.r.Context().Done()
+}
+
+func (s *SSE) write(msg string) error {
+	if _, err := s.w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// singleLine removes the new lines from the fields of an event, which would break the stream
+func singleLine(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
@@ -0,0 +1,239 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+// SpanID identifies a span of a trace
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid tells if the ID isn't all zeros, which is invalid
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// IsValid tells if the ID isn't all zeros, which is invalid
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// flagSampled is the trace flag telling that the trace is recorded
+const flagSampled = 0x01
+
+// SpanContext is the part of a span propagated to the other services
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Flags are the trace flags, whose lowest bit tells if the trace is sampled
+	Flags byte
+	// TraceState is the vendor specific state of the tracestate header, propagated as is
+	TraceState string
+	// Remote tells if the span context was received from another service
+	Remote bool
+}
+
+// IsValid tells if both the IDs are valid
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// IsSampled tells if the trace is recorded
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&flagSampled != 0
+}
+
+// Extract reads the span context of the W3C traceparent and tracestate headers: ok is false when the
+// traceparent is missing or invalid
+func Extract(header http.Header) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header.Get("traceparent")), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, false
+	}
+	var flags [1]byte
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) || !decodeHex(flags[:], parts[3]) || !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	sc.Flags = flags[0]
+	sc.TraceState = strings.Join(header.Values("tracestate"), ",")
+	sc.Remote = true
+	return sc, true
+}
+
+// Inject writes the span context in the W3C traceparent and tracestate headers
+func Inject(sc SpanContext, header http.Header) {
+	if !sc.IsValid() {
+		return
+	}
+	header.Set("traceparent", fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags))
+	header.Del("tracestate")
+	if sc.TraceState != "" {
+		header.Set("tracestate", sc.TraceState)
+	}
+}
+
+func decodeHex(dst []byte, s string) bool {
+	// the IDs are lowercase only
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// SpanKind tells the role of a span in a trace
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// StatusCode is the status of a span
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Attribute is a key value pair describing a span: the values are strings, bools, integers or floats
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Event is something which happened during a span, like an error
+type Event struct {
+	Name       string
+	Time       time.Time
+	Attributes []Attribute
+}
+
+// SpanData is an ended span, as given to the exporters
+type SpanData struct {
+	ServiceName   string
+	Name          string
+	Kind          SpanKind
+	SpanContext   SpanContext
+	Parent        SpanContext
+	Start         time.Time
+	End           time.Time
+	Attributes    []Attribute
+	Events        []Event
+	Status        StatusCode
+	StatusMessage string
+}
+
+// Span is an operation of a trace, exported when ended if the trace is sampled
+type Span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// Tracer returns the tracer which started the span, to start its children
+func (s *Span) Tracer() *Tracer {
+	return s.tracer
+}
+
+// SpanContext returns the span context to propagate to the services called during the span
+func (s *Span) SpanContext() SpanContext {
+	return s.data.SpanContext
+}
+
+// SetName changes the name of the span, like when the route of a request is known
+func (s *Span) SetName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.data.Name = name
+	}
+}
+
+// SetAttribute sets an attribute of the span, replacing the one with the same key
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	for i := range s.data.Attributes {
+		if s.data.Attributes[i].Key == key {
+			s.data.Attributes[i].Value = value
+			return
+		}
+	}
+	s.data.Attributes = append(s.data.Attributes, Attribute{Key: key, Value: value})
+}
+
+// SetStatus sets the status of the span: the message is kept only for StatusError
+func (s *Span) SetStatus(code StatusCode, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.data.Status = code
+	s.data.StatusMessage = ""
+	if code == StatusError {
+		s.data.StatusMessage = message
+	}
+}
+
+// RecordError records an error as an exception event and sets the status of the span to StatusError
+func (s *Span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.data.Events = append(s.data.Events, Event{Name: "exception", Time: time.Now(), Attributes: []Attribute{
+		{Key: "exception.type", Value: fmt.Sprintf("%T", err)},
+		{Key: "exception.message", Value: err.Error()},
+	}})
+	s.mu.Unlock()
+	s.SetStatus(StatusError, err.Error())
+}
+
+// End ends the span, which can't be changed afterwards: ending it again has no effect
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	if data.SpanContext.IsSampled() {
+		s.tracer.enqueue(data)
+	}
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	_, _ = rand.Read(id[:])
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	_, _ = rand.Read(id[:])
+	return id
+}
@@ -0,0 +1,169 @@
+package tracing
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBatch is the number of ended spans which triggers an export
+	maxBatch = 512
+	// maxQueue is the number of ended spans kept while the exporter is slow: the next ones are dropped
+	maxQueue = 4096
+	// exportInterval is the maximum time an ended span waits to be exported
+	exportInterval = 5 * time.Second
+	// exportTimeout bounds an export made in background
+	exportTimeout = 30 * time.Second
+)
+
+// Exporter sends the ended spans to a tracing backend
+type Exporter interface {
+	ExportSpans(ctx context.Context, spans []SpanData) error
+}
+
+// Tracer starts the spans of a service and exports them in batches, in background
+type Tracer struct {
+	serviceName string
+	exporter    Exporter
+
+	mu      sync.Mutex
+	queue   []SpanData
+	dropped int
+	// exportMu serializes the exports
+	exportMu sync.Mutex
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewTracer creates the tracer of a service, exporting its spans with the given exporter
+func NewTracer(serviceName string, exporter Exporter) *Tracer {
+	t := &Tracer{
+		serviceName: serviceName,
+		exporter:    exporter,
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// ContextWithSpan returns a context carrying the given span, the parent of the spans started with it
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span carried by the context, nil when there's none
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithRemoteSpanContext returns a context carrying the span context received from another service,
+// the parent of the next span started with it
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Start starts a span, child of the span of the context or of its remote span context if any, and returns
+// a context carrying the new span. A span without parent starts a new sampled trace.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	var parent SpanContext
+	if span := SpanFromContext(ctx); span != nil {
+		parent = span.SpanContext()
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		parent = remote
+	}
+
+	sc := SpanContext{TraceID: parent.TraceID, SpanID: newSpanID(), Flags: parent.Flags, TraceState: parent.TraceState}
+	if !parent.IsValid() {
+		parent = SpanContext{}
+		sc = SpanContext{TraceID: newTraceID(), SpanID: sc.SpanID, Flags: flagSampled}
+	}
+	span := &Span{tracer: t, data: SpanData{
+		ServiceName: t.serviceName,
+		Name:        name,
+		Kind:        kind,
+		SpanContext: sc,
+		Parent:      parent,
+		Start:       time.Now(),
+	}}
+	return ContextWithSpan(ctx, span), span
+}
+
+// enqueue queues an ended span for the next export
+func (t *Tracer) enqueue(data SpanData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) >= maxQueue {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, data)
+	if len(t.queue) >= maxBatch {
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		case <-t.wake:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		if err := t.Flush(ctx); err != nil {
+			log.Printf("Error exporting spans: %v", err)
+		}
+		cancel()
+	}
+}
+
+// Flush exports the ended spans right away
+func (t *Tracer) Flush(ctx context.Context) error {
+	t.exportMu.Lock()
+	defer t.exportMu.Unlock()
+	t.mu.Lock()
+	queue, dropped := t.queue, t.dropped
+	t.queue, t.dropped = nil, 0
+	t.mu.Unlock()
+	if dropped > 0 {
+		log.Printf("Dropped %d spans: the exporter can't keep up", dropped)
+	}
+
+	for len(queue) > 0 {
+		batch := queue[:min(len(queue), maxBatch)]
+		queue = queue[len(batch):]
+		if err := t.exporter.ExportSpans(ctx, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown stops the background exports and exports the ended spans
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.stopOnce.Do(func() { close(t.stop) })
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return t.Flush(ctx)
+}
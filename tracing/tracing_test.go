@@ -0,0 +1,178 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExtractInject(t *testing.T) {
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	header.Set("tracestate", "vendor=value")
+	sc, ok := Extract(header)
+	if !ok {
+		t.Fatal("the traceparent wasn't extracted")
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" ||
+		!sc.IsSampled() || !sc.Remote || sc.TraceState != "vendor=value" {
+		t.Errorf("span context = %+v", sc)
+	}
+
+	injected := http.Header{}
+	Inject(sc, injected)
+	if injected.Get("traceparent") != header.Get("traceparent") || injected.Get("tracestate") != "vendor=value" {
+		t.Errorf("injected headers = %v, want the extracted ones", injected)
+	}
+}
+
+func TestExtractInvalid(t *testing.T) {
+	for _, traceparent := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902zz-01",
+	} {
+		header := http.Header{}
+		header.Set("traceparent", traceparent)
+		if _, ok := Extract(header); ok {
+			t.Errorf("%q was extracted", traceparent)
+		}
+	}
+}
+
+func TestTracerExportsSpans(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	tracer := NewTracer("checkout", exporter)
+
+	ctx, root := tracer.Start(context.Background(), "GET /orders", SpanKindServer)
+	_, child := root.Tracer().Start(ctx, "SELECT orders", SpanKindClient)
+	child.SetAttribute("db.system", "postgresql")
+	child.SetAttribute("db.system", "mysql")
+	child.RecordError(errors.New("deadlock"))
+	child.End()
+	root.SetStatus(StatusOK, "ignored")
+	root.End()
+	// ending again or changing an ended span has no effect
+	root.End()
+	root.SetName("renamed")
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := exporter.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	c, r := spans[0], spans[1]
+	if r.Name != "GET /orders" || r.ServiceName != "checkout" || r.Kind != SpanKindServer || r.Parent.IsValid() {
+		t.Errorf("root span = %+v", r)
+	}
+	if r.Status != StatusOK || r.StatusMessage != "" {
+		t.Errorf("root status = %d %q, want OK without message", r.Status, r.StatusMessage)
+	}
+	if c.SpanContext.TraceID != r.SpanContext.TraceID || c.Parent.SpanID != r.SpanContext.SpanID {
+		t.Error("the child span isn't in the trace of its parent")
+	}
+	if len(c.Attributes) != 1 || c.Attributes[0].Value != "mysql" {
+		t.Errorf("child attributes = %v, want the replaced one", c.Attributes)
+	}
+	if c.Status != StatusError || c.StatusMessage != "deadlock" || len(c.Events) != 1 || c.Events[0].Name != "exception" {
+		t.Errorf("child status %d %q events %v, want the recorded error", c.Status, c.StatusMessage, c.Events)
+	}
+	if c.End.Before(c.Start) || r.End.Before(c.End) {
+		t.Error("the spans ended before they started")
+	}
+
+	exporter.Reset()
+	if len(exporter.Spans()) != 0 {
+		t.Error("the exporter wasn't reset")
+	}
+}
+
+func TestTracerRemoteParent(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	tracer := NewTracer("checkout", exporter)
+	defer tracer.Shutdown(context.Background())
+
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	sampled, _ := Extract(header)
+	_, span := tracer.Start(ContextWithRemoteSpanContext(context.Background(), sampled), "GET /", SpanKindServer)
+	span.End()
+
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	unsampled, _ := Extract(header)
+	_, dropped := tracer.Start(ContextWithRemoteSpanContext(context.Background(), unsampled), "GET /", SpanKindServer)
+	dropped.End()
+
+	if err := tracer.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := exporter.Spans()
+	if len(spans) != 1 {
+		t.Fatalf("exported %d spans, want only the sampled one", len(spans))
+	}
+	if spans[0].SpanContext.TraceID != sampled.TraceID || spans[0].Parent.SpanID != sampled.SpanID {
+		t.Error("the span isn't a child of the remote span")
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body otlpTraces
+	var auth string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		data, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer collector.Close()
+
+	exporter := NewInMemoryExporter()
+	tracer := NewTracer("checkout", exporter)
+	ctx, root := tracer.Start(context.Background(), "GET /orders", SpanKindServer)
+	_, child := tracer.Start(ctx, "SELECT", SpanKindClient)
+	child.SetAttribute("rows", 3)
+	child.End()
+	root.End()
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	otlp := NewOTLPExporter(collector.URL)
+	otlp.Headers = map[string]string{"Authorization": "Bearer key"}
+	if err := otlp.ExportSpans(context.Background(), exporter.Spans()); err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Bearer key" {
+		t.Errorf("Authorization = %q, want the configured header", auth)
+	}
+	if len(body.ResourceSpans) != 1 || len(body.ResourceSpans[0].ScopeSpans[0].Spans) != 2 {
+		t.Fatalf("request = %+v, want the 2 spans of one service", body)
+	}
+	spans := body.ResourceSpans[0].ScopeSpans[0].Spans
+	if spans[0].ParentSpanID != spans[1].SpanID || spans[1].ParentSpanID != "" {
+		t.Errorf("parent span IDs = %q %q", spans[0].ParentSpanID, spans[1].ParentSpanID)
+	}
+	if a := spans[0].Attributes; len(a) != 1 || a[0].Value["intValue"] != "3" {
+		t.Errorf("attributes = %v, want rows as a string encoded integer", a)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	if err := NewOTLPExporter(failing.URL).ExportSpans(context.Background(), exporter.Spans()); err == nil {
+		t.Error("a failed export returned no error")
+	}
+}
@@ -20,6 +20,29 @@ func GetPathParam(r *http.Request, param string) string {
 	return fields[pathParamsMap[param]]
 }
 
+// matchedRoute is the route matched by the dispatcher
+type matchedRoute struct {
+	pattern string
+}
+
+// TrackRoute prepares a request so that a middleware can read the route matched by the dispatcher with
+// RoutePattern, once the next handler returns: the middleware passes the returned request to the next handler
+func TrackRoute(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(routeKey{}).(*matchedRoute); ok {
+		return r
+	}
+	return enrichRequestContext(r, routeKey{}, &matchedRoute{})
+}
+
+// RoutePattern returns the pattern of the route matching the request, like /stores/{storeId}, or an empty
+// string when no route matches
+func RoutePattern(r *http.Request) string {
+	if m, ok := r.Context().Value(routeKey{}).(*matchedRoute); ok {
+		return m.pattern
+	}
+	return ""
+}
+
 // GetBasicToken fetches a basic authorization token from the http request
 func GetBasicToken(r *http.Request) (username, password string, err error) {
 	if r == nil {